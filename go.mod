@@ -3,3 +3,8 @@ module file-rocket
 go 1.22
 
 require github.com/gorilla/websocket v1.5.3
+
+require (
+	golang.org/x/crypto v0.24.0
+	golang.org/x/sys v0.21.0 // indirect
+)
@@ -6,6 +6,8 @@ let wsConnected = false;
 let currentPickupCode = null;
 let expectedFileInfo = null;
 let expectedFileHash = '';
+let e2eContext = null; // 端到端加密文件的密钥与解密后的元数据
+let downloadAccessToken = ''; // 受密码保护文件解锁后的访问令牌
 let downloadStartTime = null;
 let totalBytesReceived = 0;
 let isConnecting = false;
@@ -24,6 +26,16 @@ let speedSampleWindow = [];
 const SPEED_WINDOW_MS = 1800;
 const MOBILE_MEMORY_LIMIT = 150 * 1024 * 1024;
 
+// 取件码格式，由 /api/features 下发，默认值与服务端默认策略一致
+let codePolicy = {
+    mode: 'chars',
+    length: 4,
+    alphabet: '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ',
+    caseSensitive: false,
+    words: 2,
+    digits: 2
+};
+
 // 移动设备检测
 function isMobileDevice() {
     if (navigator.userAgentData && typeof navigator.userAgentData.mobile === 'boolean') {
@@ -162,8 +174,11 @@ document.addEventListener('DOMContentLoaded', function() {
     setupInputHandlers();
     setupWebSocket();
 
-    // 从服务端同步主题
+    // 从服务端同步主题和取件码格式，之后再处理链接中的取件码
     fetch('/api/features').then(r => r.json()).then(data => {
+        if (data.pickupCode) {
+            applyCodePolicy(data.pickupCode);
+        }
         if (data.theme && data.theme !== localStorage.getItem('file-rocket-theme')) {
             localStorage.setItem('file-rocket-theme', data.theme);
             if (data.theme === 'classic') {
@@ -174,34 +189,28 @@ document.addEventListener('DOMContentLoaded', function() {
             var fav = document.getElementById('favicon');
             if (fav) fav.href = data.theme === 'minimal' ? 'favicon-minimal.svg' : 'favicon-classic.svg';
         }
-    }).catch(() => {});
+    }).catch(() => {}).then(fillCodeFromURL);
+});
 
-    // 检查 URL 参数，自动填入取件码
+// 检查 URL 参数，自动填入取件码并连接
+function fillCodeFromURL() {
     const urlParams = new URLSearchParams(window.location.search);
     const token = urlParams.get('token');
-    if (token && token.length === 4) {
-        // 填入输入框
-        pickupCodeInput.value = token.toUpperCase();
-        // 更新显示的 code-box
-        const codeBoxes = document.querySelectorAll('.code-box');
-        for (let i = 0; i < 4; i++) {
-            if (i < token.length) {
-                codeBoxes[i].textContent = token[i].toUpperCase();
-                codeBoxes[i].classList.add('filled');
-                codeBoxes[i].classList.remove('active');
-            }
+    if (!token) return;
+
+    updateCodeDisplay(filterCodeInput(token));
+    if (!isCodeComplete(pickupCodeInput.value)) return;
+
+    // 等 WebSocket 连接建立后自动触发连接
+    const waitAndConnect = setInterval(() => {
+        if (wsConnected) {
+            clearInterval(waitAndConnect);
+            connectToSender();
         }
-        // 等 WebSocket 连接建立后自动触发连接
-        const waitAndConnect = setInterval(() => {
-            if (wsConnected) {
-                clearInterval(waitAndConnect);
-                connectToSender();
-            }
-        }, 200);
-        // 超时保护：5秒后停止等待
-        setTimeout(() => clearInterval(waitAndConnect), 5000);
-    }
-});
+    }, 200);
+    // 超时保护：5秒后停止等待
+    setTimeout(() => clearInterval(waitAndConnect), 5000);
+}
 
 // 连接 WebSocket
 function setupWebSocket() {
@@ -593,7 +602,7 @@ function handleSessionJoined(msg) {
 
     previewFileName.textContent = fileName;
     previewFileSize.textContent = formatFileSize(size);
-    previewFileType.textContent = getFileType(fileName);
+    previewFileType.textContent = isBundle ? `${fileCount} 个文件（ZIP 打包下载）` : getFileType(fileName);
 
     connectBtn.disabled = false;
     connectBtn.textContent = '连接';
@@ -614,12 +623,35 @@ function handleSessionJoined(msg) {
     showStage('file-confirm-stage');
 }
 
-function handleStorageMode(msg) {
+async function handleStorageMode(msg) {
     stopSinkReadyResend();
-    const { pickupCode, fileName, size, fileHash } = msg.payload;
+    let { pickupCode, fileName, size, fileHash, isBundle, fileCount, e2e, encryptedMeta, passwordRequired } = msg.payload;
+
+    // 受密码保护的文件在解锁前服务器不下发文件信息
+    if (passwordRequired && !downloadAccessToken) {
+        showPasswordPrompt(pickupCode);
+        return;
+    }
+
+    // 端到端加密：服务器只有密文，用链接 # 片段中的密钥解出真实文件名和大小
+    e2eContext = null;
+    let cipherSize = 0;
+    if (e2e) {
+        try {
+            e2eContext = await openE2EMeta(encryptedMeta);
+        } catch (err) {
+            console.error('[端到端加密] 解密元数据失败:', err);
+            showError(err.message || '解密密钥错误，无法打开此文件');
+            return;
+        }
+        cipherSize = size;
+        fileName = e2eContext.meta.name;
+        size = e2eContext.meta.size;
+    }
+
     currentPickupCode = pickupCode;
-    expectedFileInfo = { fileName, size };
-    expectedFileHash = fileHash || '';
+    expectedFileInfo = { fileName, size, isBundle: !!isBundle, fileCount: fileCount || 0, e2e: !!e2e, cipherSize };
+    expectedFileHash = e2e ? '' : (fileHash || '');
     transferMode = 'storage';
 
     clearJoinState();
@@ -627,7 +659,7 @@ function handleStorageMode(msg) {
 
     previewFileName.textContent = fileName;
     previewFileSize.textContent = formatFileSize(size);
-    previewFileType.textContent = getFileType(fileName);
+    previewFileType.textContent = isBundle ? `${fileCount} 个文件（ZIP 打包下载）` : getFileType(fileName);
 
     connectBtn.disabled = false;
     connectBtn.textContent = '连接';
@@ -1294,26 +1326,97 @@ function showError(message, title) {
 }
 
 // 设置输入处理
-function setupInputHandlers() {
-    const boxes = document.querySelectorAll('.code-box');
+// 字符码不超过 6 位时使用分格输入框，否则使用普通输入框
+function usesCodeBoxes() {
+    return codePolicy.mode === 'chars' && codePolicy.length <= 6;
+}
 
-    function updateDisplay(value) {
-        boxes.forEach((box, index) => {
-            const char = value[index] || '';
-            box.textContent = char;
+// 按取件码格式过滤输入：字符码只保留字符集中的字符，单词码转小写并用 - 分隔
+function filterCodeInput(value) {
+    if (codePolicy.mode === 'words') {
+        return value.toLowerCase()
+            .replace(/[\s_]+/g, '-')
+            .replace(/[^a-z0-9-]/g, '')
+            .replace(/-{2,}/g, '-')
+            .replace(/^-/, '');
+    }
+    if (!codePolicy.caseSensitive) {
+        value = value.toUpperCase();
+    }
+    return value.split('').filter(c => codePolicy.alphabet.includes(c)).join('').slice(0, codePolicy.length);
+}
 
-            if (char) {
-                box.classList.add('filled');
-            } else {
-                box.classList.remove('filled');
+// 单词码也接受修改策略前生成的字符码
+function isCodeComplete(code) {
+    if (codePolicy.mode === 'words') {
+        const parts = code.split('-').filter(Boolean);
+        return parts.length >= codePolicy.words + (codePolicy.digits > 0 ? 1 : 0) || /^[a-z0-9]{4,16}$/.test(code);
+    }
+    return code.length === codePolicy.length;
+}
+
+function updateCodeDisplay(value) {
+    document.querySelectorAll('.code-box').forEach((box, index) => {
+        const char = value[index] || '';
+        box.textContent = char;
+
+        if (char) {
+            box.classList.add('filled');
+        } else {
+            box.classList.remove('filled');
+        }
+    });
+
+    pickupCodeInput.value = value;
+    connectBtn.disabled = !isCodeComplete(value);
+}
+
+// 按服务端的取件码策略调整输入框与提示
+function applyCodePolicy(policy) {
+    codePolicy = Object.assign({}, codePolicy, policy);
+
+    const wrapper = document.querySelector('.code-input-wrapper');
+    const hint = document.querySelector('.input-hint');
+    const boxes = wrapper.querySelectorAll('.code-box');
+
+    if (usesCodeBoxes()) {
+        if (boxes.length !== codePolicy.length) {
+            boxes.forEach(box => box.remove());
+            for (let i = 0; i < codePolicy.length; i++) {
+                const box = document.createElement('div');
+                box.className = i === 0 ? 'code-box active' : 'code-box';
+                wrapper.insertBefore(box, pickupCodeInput);
             }
-        });
+        }
+        pickupCodeInput.maxLength = codePolicy.length;
+    } else {
+        boxes.forEach(box => box.remove());
+        wrapper.classList.add('free-input');
+        pickupCodeInput.removeAttribute('style');
+        pickupCodeInput.classList.add('code-text-input');
+        pickupCodeInput.maxLength = codePolicy.mode === 'words' ? 64 : codePolicy.length;
+    }
 
-        const upperValue = value.toUpperCase();
-        pickupCodeInput.value = upperValue;
-        connectBtn.disabled = upperValue.length !== 4;
+    const digitsOnly = codePolicy.mode === 'chars' && /^[0-9]+$/.test(codePolicy.alphabet);
+    pickupCodeInput.inputMode = digitsOnly ? 'numeric' : 'text';
+
+    if (codePolicy.mode === 'words') {
+        const sample = ['lucky', 'quick', 'purple', 'otter'].slice(-codePolicy.words);
+        if (codePolicy.digits > 0) {
+            sample.push('4271'.slice(0, codePolicy.digits));
+        }
+        pickupCodeInput.placeholder = sample.join('-');
+        hint.textContent = `请输入发送方提供的取件码，如 ${sample.join('-')}`;
+    } else {
+        hint.textContent = `请输入发送方提供的${codePolicy.length}位${digitsOnly ? '数字' : '数字字母'}代码`;
     }
 
+    updateCodeDisplay(filterCodeInput(pickupCodeInput.value));
+}
+
+function setupInputHandlers() {
+    const boxes = document.querySelectorAll('.code-box');
+
     boxes.forEach((box) => {
         box.addEventListener('click', () => {
             pickupCodeInput.focus();
@@ -1321,18 +1424,20 @@ function setupInputHandlers() {
     });
 
     pickupCodeInput.addEventListener('input', (e) => {
-        let value = e.target.value.replace(/[^A-Za-z0-9]/g, '').toUpperCase();
-        if (value.length > 4) {
-            value = value.slice(0, 4);
-        }
-        updateDisplay(value);
+        updateCodeDisplay(filterCodeInput(e.target.value));
     });
 
     pickupCodeInput.focus();
 
+    document.getElementById('downloadPasswordInput').addEventListener('keydown', (e) => {
+        if (e.key === 'Enter') {
+            unlockStoredFile();
+        }
+    });
+
     connectBtn.addEventListener('click', () => {
-        const code = pickupCodeInput.value.toUpperCase();
-        if (code.length === 4) {
+        const code = pickupCodeInput.value;
+        if (isCodeComplete(code)) {
             joinSession(code);
         }
     });
@@ -1340,8 +1445,8 @@ function setupInputHandlers() {
 
 // 保留兼容旧内联调用
 function connectToSender() {
-    const code = pickupCodeInput.value.toUpperCase();
-    if (code.length === 4) {
+    const code = pickupCodeInput.value;
+    if (isCodeComplete(code)) {
         joinSession(code);
     }
 }
@@ -1359,16 +1464,27 @@ async function joinSession(code) {
     errorText.style.display = 'none';
 
     try {
-        const response = await fetch(`/api/pickup-code/${code}`);
+        const response = await fetch(`/api/pickup-code/${encodeURIComponent(code)}`);
         const data = await response.json();
 
+        // 查找失败次数过多，来源已被暂时锁定
+        if (response.status === 429) {
+            showError(data.message, '请稍后再试');
+            return;
+        }
+
         if (data.success && data.exists && data.mode === 'storage') {
             handleStorageMode({
                 payload: {
-                    pickupCode: code,
+                    pickupCode: data.pickupCode || code,
                     fileName: data.fileName,
                     size: data.size,
-                    fileHash: data.fileHash || ''
+                    fileHash: data.fileHash || '',
+                    isBundle: data.isBundle,
+                    fileCount: data.fileCount,
+                    e2e: data.e2e,
+                    encryptedMeta: data.encryptedMeta,
+                    passwordRequired: data.passwordRequired
                 }
             });
             return;
@@ -1396,6 +1512,67 @@ async function joinSession(code) {
     }
 }
 
+function showPasswordPrompt(pickupCode) {
+    currentPickupCode = pickupCode;
+    clearJoinState();
+    connectBtn.disabled = false;
+    connectBtn.textContent = '连接';
+    isConnecting = false;
+
+    const input = document.getElementById('downloadPasswordInput');
+    input.value = '';
+    document.getElementById('passwordError').style.display = 'none';
+    showStage('password-stage');
+    input.focus();
+}
+
+// 提交下载密码，换取访问令牌后再获取文件信息
+async function unlockStoredFile() {
+    const input = document.getElementById('downloadPasswordInput');
+    const passwordError = document.getElementById('passwordError');
+    const unlockBtn = document.getElementById('unlockBtn');
+    if (!input.value || !currentPickupCode) return;
+
+    unlockBtn.disabled = true;
+    passwordError.style.display = 'none';
+    try {
+        const response = await fetch(`/api/unlock/${encodeURIComponent(currentPickupCode)}`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ password: input.value })
+        });
+        const data = await response.json();
+        if (response.status === 429) {
+            showError(data.message, '请稍后再试');
+            return;
+        }
+        if (!response.ok || !data.success) {
+            passwordError.textContent = data.message || '下载密码错误';
+            passwordError.style.display = 'block';
+            input.select();
+            return;
+        }
+        downloadAccessToken = data.accessToken;
+
+        const infoResponse = await fetch(`/api/stored-file/${encodeURIComponent(currentPickupCode)}${accessQuery()}`);
+        const info = await infoResponse.json();
+        if (!infoResponse.ok || !info.success) {
+            showError(info.message || '获取文件信息失败');
+            return;
+        }
+        handleStorageMode({ payload: info });
+    } catch (err) {
+        passwordError.textContent = '网络错误，请重试';
+        passwordError.style.display = 'block';
+    } finally {
+        unlockBtn.disabled = false;
+    }
+}
+
+function accessQuery() {
+    return downloadAccessToken ? `?access=${encodeURIComponent(downloadAccessToken)}` : '';
+}
+
 function acceptTransfer() {
     confirmDownload();
 }
@@ -1404,6 +1581,7 @@ function declineTransfer() {
     stopSinkReadyResend();
     clearJoinState();
     currentPickupCode = null;
+    downloadAccessToken = '';
     expectedFileInfo = null;
     expectedFileHash = '';
     transferMode = null;
@@ -1509,6 +1687,10 @@ async function confirmDownload() {
     speedSampleWindow = [];
 
     if (transferMode === 'storage') {
+        if (expectedFileInfo.isBundle) {
+            downloadStoredBundle();
+            return;
+        }
         downloadSpeed.textContent = '正在下载并校验...';
         await downloadStoredFileInChunks();
         return;
@@ -1803,7 +1985,7 @@ function updateReceiveProgressAndSpeed() {
 
 async function downloadStoredWithVerify() {
     try {
-        const response = await fetch(`/api/download-stored/${currentPickupCode}`);
+        const response = await fetch(`/api/download-stored/${currentPickupCode}${accessQuery()}`);
         if (!response.ok) {
             throw new Error('下载失败');
         }
@@ -1838,6 +2020,21 @@ async function downloadStoredWithVerify() {
     }
 }
 
+// 多文件包由服务器实时打包为 ZIP，不支持分块 Range 下载，交给浏览器直接下载
+function downloadStoredBundle() {
+    const link = document.createElement('a');
+    link.href = `/api/download-stored/${currentPickupCode}${accessQuery()}`;
+    link.download = `${expectedFileInfo.fileName}.zip`;
+    document.body.appendChild(link);
+    link.click();
+    document.body.removeChild(link);
+
+    updateProgress(100);
+    downloadSpeed.textContent = '已交给浏览器下载';
+    setVerifyResult(true, `多文件包（${expectedFileInfo.fileCount} 个文件）已开始下载，各文件 SHA-256 可在 /api/bundle/${currentPickupCode} 查看`);
+    showStage('download-complete-stage');
+}
+
 // 下载单个块
 async function downloadChunk(pickupCode, chunkIndex, chunkSize, fileSize, downloadState) {
     const start = chunkIndex * chunkSize;
@@ -1847,9 +2044,10 @@ async function downloadChunk(pickupCode, chunkIndex, chunkSize, fileSize, downlo
     downloadState.chunksInFlight.set(chunkIndex, { startTime });
 
     try {
-        const response = await fetch(`/api/download-stored/${pickupCode}`, {
+        const response = await fetch(`/api/download-stored/${pickupCode}${accessQuery()}`, {
             headers: {
-                'Range': `bytes=${start}-${end}`
+                'Range': `bytes=${start}-${end}`,
+                'X-Download-ID': downloadState.downloadID
             }
         });
 
@@ -1872,10 +2070,16 @@ async function downloadChunk(pickupCode, chunkIndex, chunkSize, fileSize, downlo
 // 分块下载存储的文件
 async function downloadStoredFileInChunks() {
     try {
-        const CHUNK_SIZE = 512 * 1024; // 固定 512KB
+        // 端到端加密文件按密文块（明文块 + 16 字节标签）对齐下载，逐块解密后写入
+        const e2e = expectedFileInfo.e2e ? e2eContext : null;
+        const CHUNK_SIZE = e2e ? e2e.meta.chunkSize + 16 : 512 * 1024; // 固定 512KB
         const fileSize = expectedFileInfo.size || 0;
+        const remoteSize = e2e ? expectedFileInfo.cipherSize : fileSize;
         const fileName = expectedFileInfo.fileName;
-        const totalChunks = Math.ceil(fileSize / CHUNK_SIZE);
+        const totalChunks = Math.ceil(remoteSize / CHUNK_SIZE);
+        if (e2e && totalChunks !== e2e.meta.totalChunks) {
+            throw new Error('加密文件不完整，无法解密');
+        }
 
         // 检测能力
         const capabilities = detectCapabilities();
@@ -1956,7 +2160,9 @@ async function downloadStoredFileInChunks() {
             completedChunks: new Map(), // chunkIndex -> data
             failedChunks: new Map(),
             nextChunkToWrite: 0,
-            downloadedBytes: 0
+            downloadedBytes: 0,
+            // 服务器按此 ID 汇总各块，所有块都收到后才计为一次完整下载
+            downloadID: Array.from(crypto.getRandomValues(new Uint8Array(12)), b => b.toString(16).padStart(2, '0')).join('')
         };
 
         // 并行下载逻辑
@@ -1966,7 +2172,7 @@ async function downloadStoredFileInChunks() {
             while (downloadState.chunksInFlight.size < currentWindow &&
                    downloadState.nextChunkToDownload < totalChunks) {
                 const chunkIndex = downloadState.nextChunkToDownload++;
-                promises.push(downloadChunk(currentPickupCode, chunkIndex, CHUNK_SIZE, fileSize, downloadState));
+                promises.push(downloadChunk(currentPickupCode, chunkIndex, CHUNK_SIZE, remoteSize, downloadState));
             }
 
             // 等待至少一个块完成
@@ -1976,7 +2182,10 @@ async function downloadStoredFileInChunks() {
 
             // 写入已完成的连续块
             while (downloadState.completedChunks.has(downloadState.nextChunkToWrite)) {
-                const chunkData = downloadState.completedChunks.get(downloadState.nextChunkToWrite);
+                let chunkData = downloadState.completedChunks.get(downloadState.nextChunkToWrite);
+                if (e2e) {
+                    chunkData = await decryptE2EChunk(e2e, downloadState.nextChunkToWrite, chunkData);
+                }
                 await writable.write(chunkData);
                 downloadState.completedChunks.delete(downloadState.nextChunkToWrite);
                 downloadState.nextChunkToWrite++;
@@ -2022,8 +2231,15 @@ async function downloadStoredFileInChunks() {
         const elapsedSec = Math.max((Date.now() - downloadStartTime) / 1000, 0.001);
         downloadSpeed.textContent = `${formatFileSize(totalBytesReceived / elapsedSec)}/s`;
 
+        // 端到端加密文件的每一块都已通过 AES-GCM 认证，服务器端摘要只对应密文
+        if (e2e) {
+            setVerifyResult(true, '端到端加密：所有数据块均通过 AES-GCM 认证解密');
+            showStage('download-complete-stage');
+            return;
+        }
+
         // 获取文件哈希（从响应头）
-        const response = await fetch(`/api/stored-file/${currentPickupCode}`);
+        const response = await fetch(`/api/stored-file/${currentPickupCode}${accessQuery()}`);
         if (response.ok) {
             const data = await response.json();
             const serverHash = (data.fileHash || '').toLowerCase();
@@ -2043,6 +2259,89 @@ async function downloadStoredFileInChunks() {
     }
 }
 
+// 端到端加密：密钥来自分享链接的 #k= 片段，没有时请用户输入发送方提供的密钥
+function getE2EKeyString() {
+    const hashParams = new URLSearchParams(window.location.hash.slice(1));
+    const fromLink = hashParams.get('k');
+    if (fromLink) {
+        return fromLink;
+    }
+    return (window.prompt('此文件已端到端加密，请输入发送方提供的解密密钥') || '').trim();
+}
+
+function base64ToBytes(text) {
+    const normalized = text.replace(/-/g, '+').replace(/_/g, '/');
+    const padded = normalized + '='.repeat((4 - normalized.length % 4) % 4);
+    const binary = atob(padded);
+    const bytes = new Uint8Array(binary.length);
+    for (let i = 0; i < binary.length; i++) {
+        bytes[i] = binary.charCodeAt(i);
+    }
+    return bytes;
+}
+
+async function openE2EMeta(encryptedMeta) {
+    if (!window.crypto || !window.crypto.subtle) {
+        throw new Error('当前浏览器环境不支持解密（需要 HTTPS 或 localhost）');
+    }
+    const keyString = getE2EKeyString();
+    if (!keyString) {
+        throw new Error('缺少解密密钥，请使用发送方提供的完整分享链接');
+    }
+
+    let key;
+    try {
+        key = await crypto.subtle.importKey('raw', base64ToBytes(keyString), { name: 'AES-GCM' }, false, ['decrypt']);
+    } catch (err) {
+        throw new Error('解密密钥格式错误');
+    }
+
+    let meta;
+    try {
+        const data = base64ToBytes(encryptedMeta || '');
+        const plain = await crypto.subtle.decrypt(
+            { name: 'AES-GCM', iv: data.slice(0, 12), additionalData: new TextEncoder().encode('file-rocket-meta') },
+            key,
+            data.slice(12)
+        );
+        meta = JSON.parse(new TextDecoder().decode(plain));
+    } catch (err) {
+        throw new Error('解密密钥错误，无法打开此文件');
+    }
+
+    return { key, meta, noncePrefix: base64ToBytes(meta.noncePrefix) };
+}
+
+function e2eChunkIV(noncePrefix, chunkIndex) {
+    const iv = new Uint8Array(12);
+    iv.set(noncePrefix, 0);
+    new DataView(iv.buffer).setUint32(8, chunkIndex);
+    return iv;
+}
+
+function e2eChunkAAD(chunkIndex, isFinal) {
+    const aad = new Uint8Array(5);
+    new DataView(aad.buffer).setUint32(0, chunkIndex);
+    aad[4] = isFinal ? 1 : 0;
+    return aad;
+}
+
+async function decryptE2EChunk(e2e, chunkIndex, cipherBuffer) {
+    try {
+        return await crypto.subtle.decrypt(
+            {
+                name: 'AES-GCM',
+                iv: e2eChunkIV(e2e.noncePrefix, chunkIndex),
+                additionalData: e2eChunkAAD(chunkIndex, chunkIndex === e2e.meta.totalChunks - 1)
+            },
+            e2e.key,
+            cipherBuffer
+        );
+    } catch (err) {
+        throw new Error(`块 ${chunkIndex} 解密失败，文件可能已损坏或被篡改`);
+    }
+}
+
 function setVerifyResult(ok, text) {
     // 验证结果文本（如果元素存在才设置）
     if (verifyResultText) {
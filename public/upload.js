@@ -21,6 +21,7 @@ let storageConfig = {
     deleteOnDownload: false
 };
 let receiverCapabilities = null; // 接收端能力信息
+let e2eKeyString = null; // 端到端加密密钥（base64url），只放在分享链接的 # 片段中
 
 let memoryTransferState = null;
 let p2pPeerConnection = null;
@@ -234,13 +235,19 @@ function handleWSMessage(msg) {
             break;
         case 'error':
             console.error('[WS] 服务器错误:', msg.payload);
+            // 会话创建被拒绝（模式禁用、文件类型不允许等）时提示用户并恢复按钮
+            if (!pickupCode) {
+                alert(msg.payload);
+                generateBtn.disabled = false;
+                generateBtn.textContent = '生成取件码';
+            }
             break;
     }
 }
 
 function handleSessionCreated(msg) {
     pickupCode = msg.payload.pickupCode;
-    pickupCodeDisplay.textContent = pickupCode;
+    showPickupCode(pickupCode);
     receiverReady = false;
     receiverSinkReady = false;
     transferStartRequested = false;
@@ -783,6 +790,12 @@ function handleChunkNack(msg) {
     }
 }
 
+// 显示取件码，单词取件码等较长的取件码缩小字号
+function showPickupCode(code) {
+    pickupCodeDisplay.textContent = code;
+    pickupCodeDisplay.classList.toggle('long', code.length > 6);
+}
+
 // 点击取件码复制到剪贴板
 document.getElementById('pickupCode').addEventListener('click', function() {
     if (pickupCode && pickupCode !== '----') {
@@ -867,6 +880,12 @@ async function loadAvailableFeatures() {
                 var fav = document.getElementById('favicon');
                 if (fav) fav.href = data.theme === 'minimal' ? 'favicon-minimal.svg' : 'favicon-classic.svg';
             }
+            // 服务器要求上传提供 API 密钥时显示输入框
+            const apiKeyOption = document.getElementById('apiKeyOption');
+            if (apiKeyOption) {
+                apiKeyOption.style.display = data.uploadRequiresApiKey ? 'block' : 'none';
+                document.getElementById('uploadApiKey').value = localStorage.getItem('file-rocket-api-key') || '';
+            }
             updateTransferModeOptions();
             updateStorageDescription();
         }
@@ -937,6 +956,55 @@ function updateTransferModeOptions() {
         console.log('[调试] 默认选中: P2P直连');
     }
     console.log('[调试] 当前 transferMode:', transferMode);
+    updateE2EOption();
+}
+
+// 管理员配置了文件类型限制时服务器需要检查文件内容，此时不能使用端到端加密
+function contentPolicyActive() {
+    const policy = storageConfig.contentPolicy || {};
+    return ['allowedExtensions', 'deniedExtensions', 'allowedMimeTypes', 'deniedMimeTypes']
+        .some(key => (policy[key] || []).length > 0);
+}
+
+// 端到端加密只适用于服务器存储模式
+function updateE2EOption() {
+    const e2eOption = document.getElementById('e2eOption');
+    if (e2eOption) {
+        e2eOption.style.display = transferMode === 'storage' && !contentPolicyActive() ? 'block' : 'none';
+    }
+}
+
+// 上传使用的 API 密钥，保存在本地以便下次使用；服务器未要求时可以留空
+function getUploadApiKey() {
+    const input = document.getElementById('uploadApiKey');
+    const key = input ? input.value.trim() : '';
+    if (key) {
+        localStorage.setItem('file-rocket-api-key', key);
+    }
+    return key;
+}
+
+function uploadAuthHeaders() {
+    const key = getUploadApiKey();
+    return key ? { 'X-API-Key': key } : {};
+}
+
+// 下载密码只适用于服务器存储模式，留空表示不设密码
+function getDownloadPassword() {
+    const input = document.getElementById('downloadPassword');
+    return transferMode === 'storage' && input ? input.value : '';
+}
+
+// 完整下载次数上限，留空或 0 表示不限制
+function getMaxDownloads() {
+    const input = document.getElementById('maxDownloads');
+    const value = transferMode === 'storage' && input ? parseInt(input.value, 10) : 0;
+    return value > 0 ? value : 0;
+}
+
+function isE2ESelected() {
+    const e2eCheckbox = document.getElementById('e2eMode');
+    return transferMode === 'storage' && !contentPolicyActive() && !!(e2eCheckbox && e2eCheckbox.checked);
 }
 
 // 更新服务器存储模式描述
@@ -988,12 +1056,23 @@ function updateCodeHint() {
     } else {
         codeHint.textContent = '请将此码分享给接收方 (发送端需保持在线)';
     }
+
+    const e2eKeyHint = document.getElementById('e2eKeyHint');
+    if (e2eKeyHint) {
+        if (transferMode === 'storage' && e2eKeyString) {
+            e2eKeyHint.textContent = `🔒 端到端加密，分享链接已包含解密密钥；只告知取件码时请同时提供密钥：${e2eKeyString}`;
+            e2eKeyHint.style.display = 'block';
+        } else {
+            e2eKeyHint.style.display = 'none';
+        }
+    }
 }
 
 // 处理文件选择
 function handleFileSelect(file) {
     selectedFile = file;
     transferCompleted = false; // 重置传输完成标志
+    e2eKeyString = null;
 
     // 显示文件信息
     fileName.textContent = file.name;
@@ -1011,6 +1090,7 @@ function handleFileSelect(file) {
         radio.addEventListener('change', (e) => {
             transferMode = e.target.value;
             console.log('切换传输模式:', transferMode);
+            updateE2EOption();
         });
     });
 }
@@ -1058,11 +1138,19 @@ async function generateCode() {
 }
 
 // 创建内存流式传输会话
-function createMemoryStreamSession(requestedMode = 'memory') {
+async function createMemoryStreamSession(requestedMode = 'memory') {
+    // 附带文件开头字节，供服务器按内容策略检查文件类型
+    const headBuffer = await selectedFile.slice(0, 4096).arrayBuffer();
+    let head = '';
+    new Uint8Array(headBuffer).forEach(byte => { head += String.fromCharCode(byte); });
+
     wsSend('create-session', {
         fileName: selectedFile.name,
         fileSize: selectedFile.size,
-        mode: requestedMode
+        fileType: selectedFile.type,
+        head: btoa(head),
+        mode: requestedMode,
+        apiKey: getUploadApiKey()
     });
 }
 
@@ -1097,7 +1185,7 @@ async function uploadFileToServer() {
 
                     if (data.success) {
                         pickupCode = data.pickupCode;
-                        pickupCodeDisplay.textContent = pickupCode;
+                        showPickupCode(pickupCode);
 
                         let statusMessage = '文件已上传到服务器';
                         if (data.neverDelete) {
@@ -1108,6 +1196,9 @@ async function uploadFileToServer() {
                             const retentionHours = data.retentionHours || 24;
                             statusMessage += `，${retentionHours}小时内有效`;
                         }
+                        if (data.maxDownloads > 0 && !data.deleteOnDownload) {
+                            statusMessage += `，完整下载 ${data.maxDownloads} 次后删除`;
+                        }
                         statusText.textContent = statusMessage;
                         setStatusBadge('success');
 
@@ -1130,7 +1221,12 @@ async function uploadFileToServer() {
                     reject(error);
                 }
             } else {
-                alert('上传失败，HTTP状态码：' + xhr.status);
+                // 未通过安全扫描等错误会在响应中给出原因
+                let message = '上传失败，HTTP状态码：' + xhr.status;
+                try {
+                    message = JSON.parse(xhr.responseText).message || message;
+                } catch (e) {}
+                alert(message);
                 const generateBtn = document.getElementById('generateCodeBtn');
                 generateBtn.disabled = false;
                 generateBtn.textContent = '生成取件码';
@@ -1149,21 +1245,72 @@ async function uploadFileToServer() {
 
         // 准备并发送请求
         const formData = new FormData();
+        const password = getDownloadPassword();
+        if (password) {
+            formData.append('password', password);
+        }
+        const maxDownloads = getMaxDownloads();
+        if (maxDownloads) {
+            formData.append('maxDownloads', maxDownloads.toString());
+        }
         formData.append('file', selectedFile);
 
         xhr.open('POST', '/api/upload-file');
+        Object.entries(uploadAuthHeaders()).forEach(([name, value]) => xhr.setRequestHeader(name, value));
         xhr.send(formData);
     });
 }
 
-// 生成唯一取件码
-function generatePickupCode() {
-    const chars = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ';
-    let code = '';
-    for (let i = 0; i < 4; i++) {
-        code += chars.charAt(Math.floor(Math.random() * chars.length));
+// 分块上传 ID 只用于标识上传，取件码在合并完成后由服务器按取件码策略生成
+function generateUploadID() {
+    const bytes = crypto.getRandomValues(new Uint8Array(12));
+    return Array.from(bytes, b => b.toString(16).padStart(2, '0')).join('');
+}
+
+// 断点续传：同一文件复用上传 ID，网络切换后可以从服务器已保存的块继续
+function getResumableUploadKey(file) {
+    return `fr-chunk-upload:${file.name}:${file.size}:${file.lastModified}`;
+}
+
+function getResumableFileID(file) {
+    const key = getResumableUploadKey(file);
+    try {
+        const saved = localStorage.getItem(key);
+        if (saved) {
+            return saved;
+        }
+        const fileID = generateUploadID();
+        localStorage.setItem(key, fileID);
+        return fileID;
+    } catch (error) {
+        return generateUploadID();
+    }
+}
+
+function clearResumableFileID(file) {
+    try {
+        localStorage.removeItem(getResumableUploadKey(file));
+    } catch (error) {
+        // localStorage 不可用时忽略
+    }
+}
+
+// 查询服务器已收到的块
+async function fetchUploadedChunks(fileID, totalChunks) {
+    try {
+        const response = await fetch(`/api/upload-status/${fileID}`);
+        if (!response.ok) {
+            return [];
+        }
+        const data = await response.json();
+        if (!data.success || !data.exists || data.totalChunks !== totalChunks) {
+            return [];
+        }
+        return data.chunks || [];
+    } catch (error) {
+        console.warn('[上传] 查询续传状态失败:', error);
+        return [];
     }
-    return code;
 }
 
 // 上传单个块
@@ -1172,18 +1319,38 @@ async function uploadChunk(file, fileID, chunkIndex, totalChunks, chunkSize, upl
     const end = Math.min(start + chunkSize, file.size);
     const chunk = file.slice(start, end);
 
-    const formData = new FormData();
-    formData.append('fileID', fileID);
-    formData.append('chunkIndex', chunkIndex.toString());
-    formData.append('totalChunks', totalChunks.toString());
-    formData.append('chunk', chunk);
-
     const startTime = Date.now();
     uploadState.chunksInFlight.set(chunkIndex, { startTime });
 
     try {
+        // 端到端加密时上传的是密文，摘要也按密文计算
+        let chunkBody = chunk;
+        let chunkBuffer = await chunk.arrayBuffer();
+        if (uploadState.e2e) {
+            chunkBuffer = await encryptE2EChunk(uploadState.e2e, chunkIndex, chunkBuffer);
+            chunkBody = new Blob([chunkBuffer]);
+        }
+
+        // 附带块摘要，服务器写入时校验，损坏的块只需单独重传
+        const chunkHash = await sha256OfArrayBuffer(chunkBuffer);
+
+        const formData = new FormData();
+        formData.append('fileID', fileID);
+        formData.append('chunkIndex', chunkIndex.toString());
+        formData.append('totalChunks', totalChunks.toString());
+        if (chunkHash) {
+            formData.append('chunkHash', chunkHash);
+        }
+        // 第 0 块附带文件名和大小，服务器可以提前检查内容策略和单文件上限
+        if (chunkIndex === 0) {
+            formData.append(uploadState.e2e ? 'e2e' : 'fileName', uploadState.e2e ? '1' : file.name);
+            formData.append('fileSize', file.size.toString());
+        }
+        formData.append('chunk', chunkBody);
+
         const response = await fetch('/api/upload-chunk', {
             method: 'POST',
+            headers: uploadAuthHeaders(),
             body: formData
         });
 
@@ -1196,11 +1363,22 @@ async function uploadChunk(file, fileID, chunkIndex, totalChunks, chunkSize, upl
             } else {
                 throw new Error(data.message || 'Upload failed');
             }
+        } else if (response.status === 422) {
+            throw new Error(`块 ${chunkIndex} 校验失败`);
+        } else if ([401, 403, 413, 415, 429].includes(response.status)) {
+            // API 密钥无效、无权限、超出额度或文件类型不允许，重传无济于事
+            const data = await response.json().catch(() => ({}));
+            const error = new Error(data.message || 'HTTP Error: ' + response.status);
+            error.fatal = true;
+            throw error;
         } else {
             throw new Error('HTTP Error: ' + response.status);
         }
     } catch (error) {
         console.error(`[上传] 块 ${chunkIndex} 失败:`, error);
+        if (error.fatal) {
+            uploadState.fatalError = error;
+        }
         uploadState.failedChunks.set(chunkIndex, error);
         uploadState.chunksInFlight.delete(chunkIndex);
         // 重传逻辑：将失败的块重新加入队列
@@ -1222,25 +1400,50 @@ function waitForChunkCompletion(uploadState) {
 }
 
 // 合并所有块
-async function mergeChunks(fileID, totalChunks, fileName, fileSize) {
+async function mergeChunks(fileID, totalChunks, fileName, fileSize, e2e = null) {
+    const request = { fileID, totalChunks, fileName, fileSize };
+    const password = getDownloadPassword();
+    if (password) {
+        request.password = password;
+    }
+    const maxDownloads = getMaxDownloads();
+    if (maxDownloads) {
+        request.maxDownloads = maxDownloads;
+    }
+    if (e2e) {
+        // 文件名与大小只以密文形式提交
+        request.fileName = '';
+        request.fileSize = 0;
+        request.e2e = true;
+        request.encryptedMeta = e2e.encryptedMeta;
+    }
+
     const response = await fetch('/api/merge-chunks', {
         method: 'POST',
         headers: {
-            'Content-Type': 'application/json'
+            'Content-Type': 'application/json',
+            ...uploadAuthHeaders()
         },
-        body: JSON.stringify({
-            fileID,
-            totalChunks,
-            fileName,
-            fileSize
-        })
+        body: JSON.stringify(request)
     });
 
     if (response.ok) {
         return await response.json();
     } else {
         const errorText = await response.text();
-        throw new Error('Merge failed: ' + errorText);
+        const error = new Error('Merge failed: ' + errorText);
+        try {
+            const data = JSON.parse(errorText);
+            if (data.code === 'CHUNK_HASH_MISMATCH') {
+                error.chunkIndex = data.chunkIndex;
+            }
+            if (data.message) {
+                error.message = data.message;
+            }
+        } catch (e) {
+            // 非 JSON 响应
+        }
+        throw error;
     }
 }
 
@@ -1251,8 +1454,25 @@ async function uploadFileToServerChunked() {
     transferStartTime = Date.now();
 
     const CHUNK_SIZE = 512 * 1024; // 固定 512KB
-    const totalChunks = Math.ceil(selectedFile.size / CHUNK_SIZE);
-    const fileID = generatePickupCode(); // 生成唯一 ID 作为取件码
+
+    // 端到端加密：每次上传生成新密钥，刷新页面后密钥丢失，因此不做断点续传
+    let e2e = null;
+    if (isE2ESelected()) {
+        if (!isE2EAvailable()) {
+            alert('当前浏览器环境不支持端到端加密（需要 HTTPS 或 localhost）');
+            const generateBtn = document.getElementById('generateCodeBtn');
+            if (generateBtn) {
+                generateBtn.disabled = false;
+                generateBtn.textContent = '生成取件码';
+            }
+            showStage('code-generate-stage');
+            return;
+        }
+        e2e = await createE2EContext(selectedFile, CHUNK_SIZE);
+    }
+
+    const totalChunks = e2e ? e2e.totalChunks : Math.ceil(selectedFile.size / CHUNK_SIZE);
+    const fileID = e2e ? generateUploadID() : getResumableFileID(selectedFile); // 同一文件复用 ID，支持断点续传
 
     // 注册分块上传会话（用于断开时清理）
     if (socket && wsConnected) {
@@ -1269,9 +1489,22 @@ async function uploadFileToServerChunked() {
         chunksInFlight: new Map(),
         completedChunks: new Set(),
         failedChunks: new Map(),
-        uploadedBytes: 0
+        uploadedBytes: 0,
+        e2e
     };
 
+    // 跳过服务器已保存且大小一致的块
+    const uploadedChunks = e2e ? [] : await fetchUploadedChunks(fileID, totalChunks);
+    for (const chunk of uploadedChunks) {
+        const expectedSize = Math.min(CHUNK_SIZE, selectedFile.size - chunk.index * CHUNK_SIZE);
+        if (chunk.size === expectedSize) {
+            uploadState.completedChunks.add(chunk.index);
+        }
+    }
+    if (uploadState.completedChunks.size > 0) {
+        console.log(`[上传] 续传 ${fileID}：服务器已有 ${uploadState.completedChunks.size}/${totalChunks} 块`);
+    }
+
     // 并行上传逻辑
     try {
         while (uploadState.completedChunks.size < totalChunks) {
@@ -1280,6 +1513,9 @@ async function uploadFileToServerChunked() {
             while (uploadState.chunksInFlight.size < currentWindow &&
                    uploadState.nextChunkToSend < totalChunks) {
                 const chunkIndex = uploadState.nextChunkToSend++;
+                if (uploadState.completedChunks.has(chunkIndex)) {
+                    continue;
+                }
                 promises.push(uploadChunk(selectedFile, fileID, chunkIndex, totalChunks, CHUNK_SIZE, uploadState));
             }
 
@@ -1288,6 +1524,9 @@ async function uploadFileToServerChunked() {
                 await Promise.race(promises);
             }
             await waitForChunkCompletion(uploadState);
+            if (uploadState.fatalError) {
+                throw uploadState.fatalError;
+            }
 
             // 更新进度
             const percent = (uploadState.completedChunks.size / totalChunks) * 100;
@@ -1309,18 +1548,34 @@ async function uploadFileToServerChunked() {
 
         // 所有块上传完成，通知服务器合并
         statusText.textContent = '正在合并文件...';
-        const mergeResult = await mergeChunks(fileID, totalChunks, selectedFile.name, selectedFile.size);
+        let mergeResult;
+        for (let attempt = 0; ; attempt++) {
+            try {
+                mergeResult = await mergeChunks(fileID, totalChunks, selectedFile.name, selectedFile.size, e2e);
+                break;
+            } catch (error) {
+                if (error.chunkIndex === undefined || attempt >= 3) {
+                    throw error;
+                }
+                // 合并时发现块已损坏，服务器已丢弃该块，重传后再合并
+                uploadState.completedChunks.delete(error.chunkIndex);
+                await uploadChunk(selectedFile, fileID, error.chunkIndex, totalChunks, CHUNK_SIZE, uploadState);
+            }
+        }
 
         if (mergeResult.success) {
+            clearResumableFileID(selectedFile);
+
             // 通知服务器上传完成，清除跟踪
             if (socket && wsConnected) {
                 wsSend('chunk-upload-complete', { fileID });
             }
 
             pickupCode = mergeResult.pickupCode;
-            pickupCodeDisplay.textContent = pickupCode;
+            showPickupCode(pickupCode);
+            e2eKeyString = e2e ? e2e.keyString : null;
 
-            let statusMessage = '文件已上传到服务器';
+            let statusMessage = e2e ? '文件已加密上传到服务器' : '文件已上传到服务器';
             if (mergeResult.neverDelete) {
                 statusMessage += '，文件永久保存';
             } else if (mergeResult.deleteOnDownload) {
@@ -1329,6 +1584,9 @@ async function uploadFileToServerChunked() {
                 const retentionHours = storageConfig.fileRetentionHours || 24;
                 statusMessage += `，${retentionHours}小时内有效`;
             }
+            if (mergeResult.maxDownloads > 0 && !mergeResult.deleteOnDownload) {
+                statusMessage += `，完整下载 ${mergeResult.maxDownloads} 次后删除`;
+            }
             statusText.textContent = statusMessage;
             setStatusBadge('success');
 
@@ -1415,6 +1673,87 @@ async function sha256OfArrayBuffer(buffer) {
     return '';
 }
 
+// 端到端加密：每个 512KB 明文块用 AES-256-GCM 单独加密（密文多 16 字节认证标签），
+// IV = 8 字节随机前缀 + 4 字节块序号，附加数据包含块序号与是否末块，防止块被调换或截断。
+// 文件名、大小等元数据加密后随合并请求提交，服务器只保存密文。
+
+function isE2EAvailable() {
+    return !!(window.crypto && window.crypto.subtle);
+}
+
+function bytesToBase64(bytes) {
+    let binary = '';
+    for (let i = 0; i < bytes.length; i++) {
+        binary += String.fromCharCode(bytes[i]);
+    }
+    return btoa(binary);
+}
+
+function bytesToBase64Url(bytes) {
+    return bytesToBase64(bytes).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function e2eChunkIV(noncePrefix, chunkIndex) {
+    const iv = new Uint8Array(12);
+    iv.set(noncePrefix, 0);
+    new DataView(iv.buffer).setUint32(8, chunkIndex);
+    return iv;
+}
+
+function e2eChunkAAD(chunkIndex, isFinal) {
+    const aad = new Uint8Array(5);
+    new DataView(aad.buffer).setUint32(0, chunkIndex);
+    aad[4] = isFinal ? 1 : 0;
+    return aad;
+}
+
+async function createE2EContext(file, chunkSize) {
+    const key = await crypto.subtle.generateKey({ name: 'AES-GCM', length: 256 }, true, ['encrypt']);
+    const rawKey = new Uint8Array(await crypto.subtle.exportKey('raw', key));
+    const noncePrefix = crypto.getRandomValues(new Uint8Array(8));
+    // 空文件也加密一个空块，接收方据此确认文件完整
+    const totalChunks = Math.max(1, Math.ceil(file.size / chunkSize));
+
+    const meta = {
+        v: 1,
+        name: file.name,
+        size: file.size,
+        type: file.type || '',
+        chunkSize,
+        totalChunks,
+        noncePrefix: bytesToBase64(noncePrefix)
+    };
+    const metaIV = crypto.getRandomValues(new Uint8Array(12));
+    const metaCipher = new Uint8Array(await crypto.subtle.encrypt(
+        { name: 'AES-GCM', iv: metaIV, additionalData: new TextEncoder().encode('file-rocket-meta') },
+        key,
+        new TextEncoder().encode(JSON.stringify(meta))
+    ));
+    const encryptedMeta = new Uint8Array(metaIV.length + metaCipher.length);
+    encryptedMeta.set(metaIV, 0);
+    encryptedMeta.set(metaCipher, metaIV.length);
+
+    return {
+        key,
+        keyString: bytesToBase64Url(rawKey),
+        noncePrefix,
+        totalChunks,
+        encryptedMeta: bytesToBase64(encryptedMeta)
+    };
+}
+
+async function encryptE2EChunk(e2e, chunkIndex, plainBuffer) {
+    return crypto.subtle.encrypt(
+        {
+            name: 'AES-GCM',
+            iv: e2eChunkIV(e2e.noncePrefix, chunkIndex),
+            additionalData: e2eChunkAAD(chunkIndex, chunkIndex === e2e.totalChunks - 1)
+        },
+        e2e.key,
+        plainBuffer
+    );
+}
+
 function pruneChunkCache(state) {
     const maxKeep = Math.max(state.windowSize + CACHE_SLACK_CHUNKS, MIN_WINDOW_SIZE + CACHE_SLACK_CHUNKS);
     if (state.chunkCache.size <= maxKeep) {
@@ -1968,7 +2307,9 @@ function formatFileSize(bytes) {
 // 生成分享链接
 function getShareLink(code) {
     const origin = window.location.origin;
-    return `${origin}/receive?token=${code}`;
+    const link = `${origin}/receive?token=${code}`;
+    // 密钥放在 # 片段中，浏览器不会把它发送给服务器
+    return e2eKeyString && transferMode === 'storage' ? `${link}#k=${e2eKeyString}` : link;
 }
 
 // 显示分享区域（二维码 + 复制链接按钮）
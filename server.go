@@ -1,36 +1,74 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
 	"math"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/argon2"
 )
 
 // ==================== 配置 ====================
 type Config struct {
-	AdminPassword     string        `json:"adminPassword"`
-	AdminPasswordHash string        `json:"adminPasswordHash,omitempty"`
-	Features          Features      `json:"features"`
-	StorageConfig     StorageConfig `json:"storageConfig"`
-	Security          Security      `json:"security"`
-	Stats             AdminStats    `json:"stats"`
-	Theme             string        `json:"theme"`
+	AdminPassword     string           `json:"adminPassword,omitempty"`     // 旧版本的明文密码，启动时迁移为账户
+	AdminPasswordHash string           `json:"adminPasswordHash,omitempty"` // 旧版本的无盐 SHA-256 哈希，启动时迁移为账户
+	AdminUsers        []*AdminUser     `json:"adminUsers,omitempty"`
+	APIKeys           []*APIKey        `json:"apiKeys,omitempty"`
+	Features          Features         `json:"features"`
+	StorageConfig     StorageConfig    `json:"storageConfig"`
+	Security          Security         `json:"security"`
+	Encryption        Encryption       `json:"encryption"`
+	Scanner           ScannerConfig    `json:"scanner"`
+	TLS               TLSConfig        `json:"tls"`
+	PickupCode        PickupCodePolicy `json:"pickupCode"`
+	Stats             AdminStats       `json:"stats"`
+	Theme             string           `json:"theme"`
 }
 
 type Features struct {
@@ -40,17 +78,92 @@ type Features struct {
 }
 
 type StorageConfig struct {
-	UploadDir          string `json:"uploadDir"`
-	MaxStorageSize     int64  `json:"maxStorageSize"`
-	FileRetentionHours int    `json:"fileRetentionHours"`
-	DeleteOnDownload   bool   `json:"deleteOnDownload"`
-	NeverDelete        bool   `json:"neverDelete"`
+	UploadDir          string        `json:"uploadDir"`
+	MaxStorageSize     int64         `json:"maxStorageSize"`
+	FileRetentionHours int           `json:"fileRetentionHours"`
+	DeleteOnDownload   bool          `json:"deleteOnDownload"`
+	NeverDelete        bool          `json:"neverDelete"`
+	ChunkGraceMinutes  int           `json:"chunkGraceMinutes"` // 未完成分块上传的保留时间，超时后清理
+	ReconcileMinutes   int           `json:"reconcileMinutes"`  // 后台核对存储用量的间隔，负数表示关闭
+	Backend            string        `json:"backend"`           // 存储后端："local"（默认）或 "s3"，修改后需重启
+	S3                 S3Config      `json:"s3"`
+	ContentPolicy      ContentPolicy `json:"contentPolicy"`
+}
+
+// ContentPolicy 限制可以上传的文件类型。扩展名按文件名后缀匹配（如 ".pdf"、".tar.gz"），
+// MIME 类型根据文件开头的字节检测，支持 "image/*" 形式的通配；拒绝列表优先，允许列表为空表示不限制
+type ContentPolicy struct {
+	AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+	DeniedExtensions  []string `json:"deniedExtensions,omitempty"`
+	AllowedMIMETypes  []string `json:"allowedMimeTypes,omitempty"`
+	DeniedMIMETypes   []string `json:"deniedMimeTypes,omitempty"`
+}
+
+// S3Config 是 S3 兼容对象存储的连接配置，uploadDir 仍用作上传过程中的本地暂存目录
+type S3Config struct {
+	Endpoint        string `json:"endpoint"` // 如 http://127.0.0.1:9000，留空使用 AWS 官方地址
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"` // 也可通过环境变量 AWS_SECRET_ACCESS_KEY 提供
+	PathStyle       bool   `json:"pathStyle"`                 // 使用 endpoint/bucket/key 形式的地址，MinIO 需要开启
 }
 
 type Security struct {
-	MaxCodeAttempts  int `json:"maxCodeAttempts"`
-	SessionTimeout   int `json:"sessionTimeout"`
-	AdminTokenExpiry int `json:"adminTokenExpiry"`
+	MaxCodeAttempts       int  `json:"maxCodeAttempts"`       // 同一 IP 查找取件码连续失败的次数上限，达到后锁定
+	SubnetMaxCodeAttempts int  `json:"subnetMaxCodeAttempts"` // 同一网段（IPv4 /24、IPv6 /64）的失败次数上限
+	LockoutSeconds        int  `json:"lockoutSeconds"`        // 首次锁定时长，之后每次锁定翻倍
+	MaxLockoutSeconds     int  `json:"maxLockoutSeconds"`
+	AttemptWindowMinutes  int  `json:"attemptWindowMinutes"` // 超过这段时间没有失败则清除记录
+	TrustProxy            bool `json:"trustProxy"`           // 部署在反向代理后时，从 X-Forwarded-For 取客户端 IP
+	SessionTimeout        int  `json:"sessionTimeout"`
+	AdminTokenExpiry      int  `json:"adminTokenExpiry"`
+	// 签名下载链接的 HMAC 密钥（64 位十六进制），为空时启动自动生成；也可通过环境变量 FILE_ROCKET_LINK_SECRET 提供（优先）
+	LinkSecret   string `json:"linkSecret,omitempty"`
+	MaxLinkHours int    `json:"maxLinkHours"` // 签名链接的最长有效期（小时）
+	// 把管理员登录会话保存到 admin_sessions.json（只含 token 哈希），重启后无需重新登录
+	PersistAdminSessions bool `json:"persistAdminSessions"`
+	// 除与请求同源外，额外允许发起 WebSocket 连接和管理接口写操作的来源，如 https://files.example.com；"*" 表示不限制
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	// 开启后上传（含内存流式和 P2P 会话）必须提供带 upload 权限的 API 密钥
+	RequireAPIKeyForUpload bool `json:"requireApiKeyForUpload"`
+	AuditLogMaxMB          int  `json:"auditLogMaxMB"`   // 审计日志单个文件的大小上限（MB），超过后轮转
+	AuditLogBackups        int  `json:"auditLogBackups"` // 轮转后保留的旧文件数量
+}
+
+// PickupCodePolicy 取件码生成规则，修改后只影响新生成的取件码
+type PickupCodePolicy struct {
+	Mode     string `json:"mode"`     // "chars"（默认）按字符集随机生成，"words" 生成 purple-otter-42 形式
+	Length   int    `json:"length"`   // chars 模式的位数
+	Alphabet string `json:"alphabet"` // chars 模式的字符集：alnum、digits、unambiguous 或自定义的字母数字
+	Words    int    `json:"words"`    // words 模式的单词数
+	Digits   int    `json:"digits"`   // words 模式末尾数字的位数，0 表示不带数字
+}
+
+// Encryption 静态加密配置，密钥也可以通过环境变量 FILE_ROCKET_ENCRYPTION_KEY 提供（优先）
+type Encryption struct {
+	Enabled bool   `json:"enabled"`
+	Key     string `json:"key,omitempty"` // 32 字节，64 位十六进制或 base64
+}
+
+// ScannerConfig 恶意文件扫描配置，上传的文件在发放取件码之前扫描
+type ScannerConfig struct {
+	Type           string `json:"type"`           // 空表示不扫描，"clamd" 使用 ClamAV 守护进程
+	Address        string `json:"address"`        // clamd 地址：tcp://127.0.0.1:3310 或 unix:///run/clamav/clamd.ctl
+	TimeoutSeconds int    `json:"timeoutSeconds"` // 连接和每次读写的超时时间
+	FailOpen       bool   `json:"failOpen"`       // 扫描器不可用时仍然发布文件，默认拒绝上传
+}
+
+// TLSConfig 内置 HTTPS 配置（修改后需重启），监听端口仍由环境变量 PORT 决定；证书文件更新后自动重新加载
+type TLSConfig struct {
+	Enabled          bool     `json:"enabled"`
+	CertFile         string   `json:"certFile"`         // PEM 格式证书，可包含中间证书链
+	KeyFile          string   `json:"keyFile"`          // PEM 格式私钥
+	SelfSigned       bool     `json:"selfSigned"`       // 证书文件不存在时生成自签名证书，适合局域网使用
+	Hosts            []string `json:"hosts,omitempty"`  // 自签名证书额外包含的域名或 IP，默认已包含 localhost、主机名和本机地址
+	HTTPRedirectPort string   `json:"httpRedirectPort"` // 额外监听的 HTTP 端口，所有请求重定向到 HTTPS；空表示不监听
+	ReloadSeconds    int      `json:"reloadSeconds"`    // 检查证书文件是否更新的间隔
 }
 
 type AdminStats struct {
@@ -60,7 +173,9 @@ type AdminStats struct {
 }
 
 type StorageIndex struct {
-	Files map[string]*FileSession `json:"files"`
+	Files      map[string]*FileSession `json:"files"`
+	Links      map[string]*SignedLink  `json:"links,omitempty"`
+	Quarantine map[string]*FileSession `json:"quarantine,omitempty"` // 未通过扫描的文件，取件码不可用
 }
 
 var config Config
@@ -74,9 +189,30 @@ type FileSession struct {
 	FileHash         string
 	UploadTime       time.Time
 	DeleteTime       time.Time
-	DeleteMode       string // "timer", "download", "never"
+	DeleteMode       string // "timer", "download"（首次完整下载后删除）, "never"
 	Downloaded       bool
 	ReceiverSocketID string
+	Files            []*BundleFile `json:",omitempty"` // 多文件包内的文件，非空时 FileName 为空
+	Encrypted        bool          `json:",omitempty"` // 文件以静态加密格式保存
+	E2E              bool          `json:",omitempty"` // 端到端加密：内容由浏览器加密，服务器只有密文
+	EncryptedMeta    string        `json:",omitempty"` // 端到端加密的文件名、大小等元数据（base64），服务器无法解读
+	PasswordHash     string        `json:",omitempty"` // 下载密码的 argon2id 哈希，为空表示无需密码
+	MaxDownloads     int           `json:",omitempty"` // 完整下载次数上限，0 表示不限制
+	DownloadCount    int           `json:",omitempty"` // 已完成的完整下载次数
+	InfectedWith     string        `json:",omitempty"` // 扫描发现的病毒名称，非空表示文件已被隔离
+}
+
+// BundleFile 是多文件包中的一个文件，Name 为包内相对路径
+type BundleFile struct {
+	Name      string
+	FileName  string
+	Size      int64
+	FileHash  string
+	Encrypted bool `json:",omitempty"`
+}
+
+func (f *FileSession) IsBundle() bool {
+	return len(f.Files) > 0
 }
 
 type ActiveSession struct {
@@ -102,9 +238,16 @@ type ActiveSession struct {
 	ReceiverNAT         map[string]interface{}
 }
 
+// AdminToken 一个管理员登录会话。map 的键和持久化文件中只保存 token 的 SHA-256，ID 用于在后台展示和撤销
 type AdminToken struct {
-	Token     string
-	ExpiresAt time.Time
+	ID         string    `json:"id"`
+	TokenHash  string    `json:"tokenHash"`
+	Username   string    `json:"username"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
 }
 
 type NATInfo struct {
@@ -117,17 +260,21 @@ var (
 	activeSessions   = make(map[string]*ActiveSession)
 	activeSessionsMu sync.RWMutex
 
-	storedFiles   = make(map[string]*FileSession)
-	storedFilesMu sync.RWMutex
+	storedFiles      = make(map[string]*FileSession)
+	quarantinedFiles = make(map[string]*FileSession) // 未通过扫描的文件，同样由 storedFilesMu 保护
+	storedFilesMu    sync.RWMutex
 
-	adminTokens   = make(map[string]*AdminToken)
+	adminTokens   = make(map[string]*AdminToken) // token 的 SHA-256 -> 会话
 	adminTokensMu sync.RWMutex
 
 	wsClients   = make(map[string]*WSClient)
 	wsClientsMu sync.RWMutex
 
-	codeAttempts   = make(map[string]int)
-	codeAttemptsMu sync.RWMutex
+	codeLimits   = make(map[string]*CodeLimit) // IP 或网段 -> 取件码查找失败记录
+	codeLimitsMu sync.Mutex
+
+	chunkManifests   = make(map[string]*ChunkManifest)
+	chunkManifestsMu sync.Mutex
 
 	fileTransferChannels = make(map[string]chan []byte)
 	transferChanMu       sync.RWMutex
@@ -135,19 +282,20 @@ var (
 
 	configPath      = "./config.json"
 	storageIndexPath = "./storage_index.json"
+	adminSessionsPath = "./admin_sessions.json"
+	auditLogPath = "./audit.log"
 	uploadDir       = "./files"
 
 	maxFileSize int64 = 5 * 1024 * 1024 * 1024 // 5GB
 )
 
-const letterBytes = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
-
 // ==================== WebSocket 设置 ====================
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  32 * 1024,
 	WriteBufferSize: 32 * 1024,
+	// wsHandler 已在升级前用 rejectDisallowedOrigin 返回明确的错误，这里作为兜底
 	CheckOrigin: func(r *http.Request) bool {
-		return true
+		return originAllowed(r)
 	},
 }
 
@@ -157,20 +305,59 @@ type WSMessage struct {
 }
 
 // ==================== 初始化 ====================
-func init() {
-	// 加载配置
+// setup 加载配置和存储索引并启动后台任务，由 main 调用（不放在 init 中，测试时不会在工作目录生成数据文件）
+func setup() {
+	// 加载配置，先迁移管理员账户，之后任何 saveConfig 都不会再写入旧版的明文密码
 	loadConfig()
+	if err := migrateAdminAccounts(); err != nil {
+		log.Fatalf("[安全] %v", err)
+	}
+	if err := loadEncryptionKey(); err != nil {
+		log.Fatalf("[加密] %v", err)
+	}
+	if err := applyPickupCodePolicy(); err != nil {
+		log.Fatalf("[取件码] %v", err)
+	}
+	if err := loadLinkSecret(); err != nil {
+		log.Fatalf("[签名链接] %v", err)
+	}
 	loadStorageIndex()
+	loadAdminSessions()
+
+	if err := checkUploadDirPrivate(uploadDir); err != nil {
+		log.Fatalf("[存储] %v", err)
+	}
 
 	// 确保上传目录存在
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
 		log.Printf("[警告] 无法创建上传目录: %v", err)
 	}
 
+	backend, err := newStorageBackend(config.StorageConfig)
+	if err != nil {
+		log.Fatalf("[存储] %v", err)
+	}
+	storageBackend = backend
+
+	scanner, err := newScanner(config.Scanner)
+	if err != nil {
+		log.Fatalf("[扫描] %v", err)
+	}
+	fileScanner = scanner
+	if fileScanner != nil {
+		log.Printf("[扫描] 已启用 %s 扫描 (%s)，扫描器不可用时放行: %t", config.Scanner.Type, config.Scanner.Address, config.Scanner.FailOpen)
+	}
+
 	refreshLegacyFileHashesAndPersist()
 
+	storedFilesMu.Lock()
+	rebuildBlobIndexLocked()
+	storedFilesMu.Unlock()
+
 	// 定期清理过期会话和文件
 	go cleanupRoutine()
+	go storageReconcileRoutine()
+	go apiKeyUsageFlushRoutine()
 }
 
 func loadConfig() {
@@ -181,6 +368,8 @@ func loadConfig() {
 		return
 	}
 
+	// 取件码策略中 0 是有效值（digits），先填入默认值，未配置的字段保持默认
+	config.PickupCode = getDefaultConfig().PickupCode
 	if err := json.Unmarshal(data, &config); err != nil {
 		log.Printf("[配置] 解析失败，使用默认: %v", err)
 		config = getDefaultConfig()
@@ -191,15 +380,54 @@ func loadConfig() {
 	if config.Security.MaxCodeAttempts == 0 {
 		config.Security.MaxCodeAttempts = 10
 	}
+	if config.Security.SubnetMaxCodeAttempts == 0 {
+		config.Security.SubnetMaxCodeAttempts = 50
+	}
+	if config.Security.LockoutSeconds == 0 {
+		config.Security.LockoutSeconds = 60
+	}
+	if config.Security.MaxLockoutSeconds == 0 {
+		config.Security.MaxLockoutSeconds = 3600
+	}
+	if config.Security.AttemptWindowMinutes == 0 {
+		config.Security.AttemptWindowMinutes = 30
+	}
 	if config.Security.SessionTimeout == 0 {
 		config.Security.SessionTimeout = 1800000
 	}
 	if config.Security.AdminTokenExpiry == 0 {
 		config.Security.AdminTokenExpiry = 3600000
 	}
+	if config.Security.MaxLinkHours == 0 {
+		config.Security.MaxLinkHours = 168
+	}
+	if config.Security.AuditLogMaxMB == 0 {
+		config.Security.AuditLogMaxMB = 10
+	}
+	if config.Security.AuditLogBackups == 0 {
+		config.Security.AuditLogBackups = 5
+	}
+	if config.Scanner.TimeoutSeconds == 0 {
+		config.Scanner.TimeoutSeconds = 60
+	}
+	if config.TLS.CertFile == "" {
+		config.TLS.CertFile = "./cert.pem"
+	}
+	if config.TLS.KeyFile == "" {
+		config.TLS.KeyFile = "./key.pem"
+	}
+	if config.TLS.ReloadSeconds == 0 {
+		config.TLS.ReloadSeconds = 30
+	}
 	if config.Stats.TodayDate == "" {
 		config.Stats.TodayDate = time.Now().Format("2006-01-02")
 	}
+	if config.StorageConfig.ChunkGraceMinutes == 0 {
+		config.StorageConfig.ChunkGraceMinutes = 30
+	}
+	if config.StorageConfig.ReconcileMinutes == 0 {
+		config.StorageConfig.ReconcileMinutes = 60
+	}
 
 	uploadDir = config.StorageConfig.UploadDir
 	if uploadDir == "" {
@@ -215,7 +443,6 @@ func loadConfig() {
 
 func getDefaultConfig() Config {
 	return Config{
-		AdminPassword: "7428",
 		Features: Features{
 			MemoryStreaming: true,
 			ServerStorage:   true,
@@ -227,11 +454,35 @@ func getDefaultConfig() Config {
 			FileRetentionHours: 24,
 			DeleteOnDownload:   false,
 			NeverDelete:        false,
+			ChunkGraceMinutes:  30,
+			ReconcileMinutes:   60,
 		},
 		Security: Security{
-			MaxCodeAttempts:  10,
-			SessionTimeout:   1800000,
-			AdminTokenExpiry: 3600000,
+			MaxCodeAttempts:       10,
+			SubnetMaxCodeAttempts: 50,
+			LockoutSeconds:        60,
+			MaxLockoutSeconds:     3600,
+			AttemptWindowMinutes:  30,
+			SessionTimeout:        1800000,
+			AdminTokenExpiry:      3600000,
+			MaxLinkHours:          168,
+			AuditLogMaxMB:         10,
+			AuditLogBackups:       5,
+		},
+		PickupCode: PickupCodePolicy{
+			Mode:     "chars",
+			Length:   4,
+			Alphabet: "alnum",
+			Words:    2,
+			Digits:   2,
+		},
+		Scanner: ScannerConfig{
+			TimeoutSeconds: 60,
+		},
+		TLS: TLSConfig{
+			CertFile:      "./cert.pem",
+			KeyFile:       "./key.pem",
+			ReloadSeconds: 30,
 		},
 		Stats: AdminStats{
 			TotalTransfers: 0,
@@ -242,13 +493,55 @@ func getDefaultConfig() Config {
 	}
 }
 
+// publicStorageConfig 是 /api/features 对外公开的存储配置，不包含目录与对象存储连接信息
+func publicStorageConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"maxStorageSize":     config.StorageConfig.MaxStorageSize,
+		"fileRetentionHours": config.StorageConfig.FileRetentionHours,
+		"deleteOnDownload":   config.StorageConfig.DeleteOnDownload,
+		"neverDelete":        config.StorageConfig.NeverDelete,
+		"contentPolicy":      config.StorageConfig.ContentPolicy, // 上传页据此隐藏端到端加密选项
+	}
+}
+
+// adminStorageConfig 返回给管理后台的存储配置，隐藏 S3 密钥（保存时未提交则保持原值）
+func adminStorageConfig() StorageConfig {
+	storageConfig := config.StorageConfig
+	storageConfig.S3.SecretAccessKey = ""
+	return storageConfig
+}
+
+// configSaveMu 串行化配置文件的写入，保证最后序列化的配置最后落盘
+var configSaveMu sync.Mutex
+
+// saveConfig 先写入临时文件再原子重命名，写入中途崩溃也不会留下残缺的配置文件
+// （残缺的配置会让 loadConfig 回退到带默认密码的默认配置）。配置中包含密码哈希和密钥，只允许当前用户读写
 func saveConfig() {
+	configSaveMu.Lock()
+	defer configSaveMu.Unlock()
+
+	adminUsersMu.RLock()
+	apiKeysMu.RLock()
+	apiKeyUsageMu.Lock()
+	statsMu.Lock()
 	data, err := json.MarshalIndent(config, "", "  ")
+	statsMu.Unlock()
+	apiKeyUsageDirty = false
+	apiKeyUsageMu.Unlock()
+	apiKeysMu.RUnlock()
+	adminUsersMu.RUnlock()
 	if err != nil {
 		log.Printf("[配置] 保存失败: %v", err)
 		return
 	}
-	if err := os.WriteFile(configPath, data, 0644); err != nil {
+
+	tmpPath := configPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		log.Printf("[配置] 保存失败: %v", err)
+		return
+	}
+	if err := os.Rename(tmpPath, configPath); err != nil {
+		os.Remove(tmpPath)
 		log.Printf("[配置] 保存失败: %v", err)
 	}
 }
@@ -270,16 +563,21 @@ func loadStorageIndex() {
 		return
 	}
 
-	if index.Files == nil {
+	// 三个表分别初始化：没有存储文件时签名链接和隔离区仍可能有记录
+	storedFiles = index.Files
+	if storedFiles == nil {
 		storedFiles = make(map[string]*FileSession)
-		return
 	}
-
-	storedFiles = index.Files
+	if index.Links != nil {
+		signedLinks = index.Links
+	}
+	if index.Quarantine != nil {
+		quarantinedFiles = index.Quarantine
+	}
 }
 
 func saveStorageIndex() {
-	index := StorageIndex{Files: storedFiles}
+	index := StorageIndex{Files: storedFiles, Links: signedLinks, Quarantine: quarantinedFiles}
 	data, err := json.MarshalIndent(index, "", "  ")
 	if err != nil {
 		log.Printf("[存储索引] 序列化失败: %v", err)
@@ -299,11 +597,10 @@ func refreshLegacyFileHashesAndPersist() {
 		if file == nil {
 			continue
 		}
-		if file.FileHash != "" {
+		if file.FileHash != "" || file.IsBundle() {
 			continue
 		}
-		filePath := filepath.Join(uploadDir, file.FileName)
-		hash, err := computeFileSHA256(filePath)
+		hash, err := computeStoredSHA256(file.FileName)
 		if err != nil {
 			continue
 		}
@@ -337,1908 +634,8271 @@ func cleanupRoutine() {
 		}
 		activeSessionsMu.Unlock()
 
-		// 清理过期文件
+		// 清理过期文件和签名链接，审计日志在释放锁之后写入
+		var expired, expiredQuarantine, orphaned []string
 		storedFilesMu.Lock()
 		for code, file := range storedFiles {
 			if !file.DeleteTime.IsZero() && now.After(file.DeleteTime) {
-				deleteStoredFile(code)
+				orphaned = append(orphaned, deleteStoredFile(code)...)
 				log.Printf("[清理] 移除过期文件: %s", code)
+				expired = append(expired, code)
+			}
+		}
+		for code, file := range quarantinedFiles {
+			if !file.DeleteTime.IsZero() && now.After(file.DeleteTime) {
+				orphaned = append(orphaned, deleteStoredFile(code)...)
+				log.Printf("[清理] 移除过期的隔离文件: %s", code)
+				expiredQuarantine = append(expiredQuarantine, code)
 			}
 		}
+		pruneSignedLinksLocked(now)
 		storedFilesMu.Unlock()
+		deleteBlobs(orphaned)
+		for _, code := range expired {
+			auditLog(nil, auditActorSystem, "file.delete", code, auditSuccess, "已过期")
+		}
+		for _, code := range expiredQuarantine {
+			auditLog(nil, auditActorSystem, "file.delete", code, auditSuccess, "隔离文件已过期")
+		}
 
-		// 清理过期 admin token
+		// 清理过期的取件码查找失败记录和下载授权
+		pruneCodeLimits(now)
+		pruneDownloadGrants(now)
+		pruneDownloadProgress(now)
+
+		// 清理超过保留期的未完成分块上传
+		cleanupStaleChunkUploads(now)
+		cleanupStaleTusUploads(now)
+
+		// 清理过期 admin token，并把最近使用时间写回会话文件
 		adminTokensMu.Lock()
-		for token, admin := range adminTokens {
+		for key, admin := range adminTokens {
 			if now.After(admin.ExpiresAt) {
-				delete(adminTokens, token)
+				delete(adminTokens, key)
 			}
 		}
 		adminTokensMu.Unlock()
+		saveAdminSessions()
+		pruneTOTPEnrollments(now)
 	}
 }
 
-func deleteStoredFile(code string) {
+// deleteStoredFile 删除存储文件或隔离区中的文件，调用方需持有 storedFilesMu。
+// 返回引用已归零的 blob，调用方释放 storedFilesMu 后交给 deleteBlobs 删除
+func deleteStoredFile(code string) []string {
 	file, exists := storedFiles[code]
 	if !exists {
-		return
+		if file, exists = quarantinedFiles[code]; !exists {
+			return nil
+		}
 	}
 
-	filePath := filepath.Join(uploadDir, file.FileName)
-	if _, err := os.Stat(filePath); err == nil {
-		os.Remove(filePath)
+	orphaned := releaseFileBlobsLocked(file)
+	if file.IsBundle() {
+		log.Printf("[文件] 已删除多文件包: %s (%s, %d 个文件)", code, file.OriginalName, len(file.Files))
+	} else if len(orphaned) > 0 {
 		log.Printf("[文件] 已删除: %s (%s)", code, file.OriginalName)
+	} else {
+		log.Printf("[文件] 已删除: %s (%s)，数据仍被其他取件码引用", code, file.OriginalName)
 	}
 	delete(storedFiles, code)
+	delete(quarantinedFiles, code)
+	storageLogicalSize -= file.Size
+	for id, link := range signedLinks {
+		if link.PickupCode == code {
+			delete(signedLinks, id)
+		}
+	}
 	saveStorageIndex()
+	return orphaned
 }
 
-// ==================== 工具函数 ====================
-func generatePickupCode() string {
-	b := make([]byte, 4)
-	for i := range b {
-		randByte := make([]byte, 1)
-		rand.Read(randByte)
-		b[i] = letterBytes[int(randByte[0])%len(letterBytes)]
-	}
-	return string(b)
+// ==================== 取件码 ====================
+// 取件码有两种形式：按字符集随机生成的定长字符码（如 7K3Q），以及由单词和数字组成的单词码
+// （如 purple-otter-42），便于口头转述。单词码总是包含 -，两种形式可以按形状区分，
+// 因此修改策略后之前生成的取件码仍能正常查找。
+
+var pickupCodeAlphabets = map[string]string{
+	"alnum":       "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"digits":      "0123456789",
+	"unambiguous": "23456789ABCDEFGHJKMNPQRSTUVWXYZ", // 去掉易混淆的 0/O、1/I/L
 }
 
-func generateUniquePickupCode() string {
-	for {
-		code := generatePickupCode()
-		storedFilesMu.RLock()
-		_, inStored := storedFiles[code]
-		storedFilesMu.RUnlock()
+var pickupAdjectives = strings.Fields(`
+	able airy alert alive amber ample apt arctic ashen avid awake azure balmy basic beige big black
+	bland blank blond blue blunt bold bony brave brief bright brisk broad brown bumpy busy calm
+	candid chief chilly civic clean clear clever close cloudy coarse cold comic cool cosmic cozy
+	crisp cubic curly cute daily damp dapper dark dear deep dense dizzy dotted dry dusty eager early
+	easy elder empty epic equal even exact extra faint fair fancy far fast fierce fine firm fixed
+	flat fluffy fond formal frank free fresh frosty full funny fuzzy gentle giant giddy glad glossy
+	golden good grand gray great green happy hardy hasty hazy heavy hidden high hollow honest huge
+	humble hungry icy ideal idle iron jade jolly juicy jumbo keen kind large late lazy lean lemon
+	level light lilac liquid little live lively local long loose loud lovely loyal lucky lunar lush
+	magic major merry mild mini minty misty modern modest moody muddy narrow navy neat new nice
+	nimble noble noisy north novel odd open orange oval pale patient peachy perky pink plain plump
+	plush polar polite proud pure purple quick quiet rainy rapid rare ready regal rich rigid ripe
+	rosy rough round royal ruby rusty sandy shiny short shy silent silky silver simple sleek sleepy
+	slim slow small smart smooth snowy soft solar solid sonic spare spicy steady steep stormy sunny
+	super sweet swift tall tame tidy tiny topaz tough tricky true twin urban vast velvet violet
+	vivid warm wavy white wide wild windy wise witty woody young zany zesty
+`)
+
+var pickupNouns = strings.Fields(`
+	acorn anchor anvil apple arrow aspen badge badger bagel bamboo banjo barn basil bean bear beaver
+	bee beetle bell berry birch biscuit bison blossom boat bobcat bongo branch bread breeze brook
+	broom bubble bucket buffalo bunny button cabin cactus camel candle canoe canyon carrot castle
+	cedar cherry chess cloud clover cobra comet cookie coral cougar crab crane crayon cricket crow
+	crown cub cupcake dahlia daisy deer delta desert dingo dolphin donkey dove dragon drum duck dune
+	eagle echo eel elk ember falcon fern ferret fig finch fjord flame flute forest fox frog garden
+	gecko geyser ginger glacier glove goat goose grape gull hammock hamster harbor harp harvest hawk
+	hazel hedge heron hippo honey horse husky ibis igloo iris island ivy jackal jaguar jam jelly
+	jewel kayak kettle kite kiwi koala lagoon lake lantern lark lemur leopard lily lime lion llama
+	lobster lotus lynx magpie mango maple marble maze meadow melon mint mitten mole moon moose moth
+	mouse muffin mule nectar nest newt noodle nova nut oak oasis ocean olive onion opal orbit orca
+	orchid osprey otter owl paddle panda parrot peach pear pebble pelican pepper piano pickle pigeon
+	pillow pine planet plum pony poppy prairie pretzel prism puffin puma puzzle quail quartz quill
+	rabbit radish rainbow raven reef rhino ribbon river robin rocket rose saddle salmon sandal seal
+	shark sheep shell sloth snail sparrow spider sprout squid star stone stork sun swan taco tiger
+	toad tomato torch tower trout tulip tuna turtle valley violin waffle wagon walnut walrus wand
+	wasp whale willow wolf wombat yak zebra
+`)
 
-		activeSessionsMu.RLock()
-		_, inActive := activeSessions[code]
-		activeSessionsMu.RUnlock()
+var (
+	pickupAlphabet      string // 解析后的 chars 模式字符集
+	pickupCaseSensitive bool   // 字符集同时包含大小写字母时区分大小写，否则统一为大写
+)
 
-		if !inStored && !inActive {
-			return code
+// applyPickupCodePolicy 校验 config.PickupCode 并解析字符集
+func applyPickupCodePolicy() error {
+	policy := config.PickupCode
+	switch policy.Mode {
+	case "chars":
+		if policy.Length < 4 || policy.Length > 16 {
+			return fmt.Errorf("pickupCode.length 需在 4 到 16 之间，当前为 %d", policy.Length)
+		}
+		alphabet, ok := pickupCodeAlphabets[policy.Alphabet]
+		if !ok {
+			alphabet = policy.Alphabet
+			if !regexp.MustCompile(`^[0-9A-Za-z]{2,}$`).MatchString(alphabet) {
+				return fmt.Errorf("pickupCode.alphabet 只能是 alnum、digits、unambiguous 或至少 2 个字母数字")
+			}
+		}
+		caseSensitive := alphabet != strings.ToUpper(alphabet) && alphabet != strings.ToLower(alphabet)
+		if !caseSensitive {
+			alphabet = strings.ToUpper(alphabet)
+		}
+		for i := range alphabet {
+			if strings.IndexByte(alphabet[i+1:], alphabet[i]) >= 0 {
+				return fmt.Errorf("pickupCode.alphabet 包含重复字符 %q", alphabet[i])
+			}
 		}
+		pickupAlphabet, pickupCaseSensitive = alphabet, caseSensitive
+	case "words":
+		if policy.Words < 1 || policy.Words > 4 {
+			return fmt.Errorf("pickupCode.words 需在 1 到 4 之间，当前为 %d", policy.Words)
+		}
+		if policy.Digits < 0 || policy.Digits > 4 {
+			return fmt.Errorf("pickupCode.digits 需在 0 到 4 之间，当前为 %d", policy.Digits)
+		}
+		if policy.Words == 1 && policy.Digits == 0 {
+			return fmt.Errorf("pickupCode 单词模式至少需要 2 个单词或带数字")
+		}
+	default:
+		return fmt.Errorf("未知的 pickupCode.mode: %s", policy.Mode)
 	}
+
+	log.Printf("[取件码] %s，共 %.3g 种组合", describePickupCodePolicy(), pickupCodeSpace())
+	return nil
 }
 
-func saveUploadedFileAtomicAndHash(src io.Reader, targetPath string) (int64, string, error) {
-	tmpPath := targetPath + ".tmp"
-	tmpFile, err := os.Create(tmpPath)
-	if err != nil {
-		return 0, "", err
+func describePickupCodePolicy() string {
+	policy := config.PickupCode
+	if policy.Mode == "words" {
+		return fmt.Sprintf("%d 个单词 + %d 位数字", policy.Words, policy.Digits)
 	}
+	return fmt.Sprintf("%d 位字符（字符集 %d 个）", policy.Length, len(pickupAlphabet))
+}
 
-	hasher := sha256.New()
-	written, copyErr := io.Copy(io.MultiWriter(tmpFile, hasher), src)
-	syncErr := tmpFile.Sync()
-	closeErr := tmpFile.Close()
+// pickupCodeSpace 返回当前策略下可能的取件码数量
+func pickupCodeSpace() float64 {
+	policy := config.PickupCode
+	if policy.Mode == "words" {
+		return math.Pow(float64(len(pickupAdjectives)), float64(policy.Words-1)) *
+			float64(len(pickupNouns)) * math.Pow(10, float64(policy.Digits))
+	}
+	return math.Pow(float64(len(pickupAlphabet)), float64(policy.Length))
+}
 
-	if copyErr != nil || syncErr != nil || closeErr != nil {
-		_ = os.Remove(tmpPath)
-		if copyErr != nil {
-			return 0, "", copyErr
+// randomIndex 均匀地返回 [0, n) 中的随机数
+func randomIndex(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		log.Fatalf("[取件码] 读取随机数失败: %v", err)
+	}
+	return int(v.Int64())
+}
+
+func generatePickupCode() string {
+	policy := config.PickupCode
+	if policy.Mode == "words" {
+		parts := make([]string, 0, policy.Words+1)
+		for i := 1; i < policy.Words; i++ {
+			parts = append(parts, pickupAdjectives[randomIndex(len(pickupAdjectives))])
 		}
-		if syncErr != nil {
-			return 0, "", syncErr
+		parts = append(parts, pickupNouns[randomIndex(len(pickupNouns))])
+		if policy.Digits > 0 {
+			digits := make([]byte, policy.Digits)
+			for i := range digits {
+				digits[i] = '0' + byte(randomIndex(10))
+			}
+			parts = append(parts, string(digits))
 		}
-		return 0, "", closeErr
+		return strings.Join(parts, "-")
 	}
 
-	if err := os.Rename(tmpPath, targetPath); err != nil {
-		_ = os.Remove(tmpPath)
-		return 0, "", err
+	b := make([]byte, policy.Length)
+	for i := range b {
+		b[i] = pickupAlphabet[randomIndex(len(pickupAlphabet))]
 	}
-
-	fileHash := hex.EncodeToString(hasher.Sum(nil))
-	return written, fileHash, nil
+	return string(b)
 }
 
-func computeFileSHA256(filePath string) (string, error) {
-	f, err := os.Open(filePath)
-	if err != nil {
-		return "", err
+// normalizePickupCode 把用户输入的取件码转换为规范形式：单词码转小写并用 - 连接，
+// 字符码在字符集不区分大小写时转大写
+func normalizePickupCode(code string) string {
+	code = strings.TrimSpace(code)
+	if strings.ContainsAny(code, "-_ ") {
+		parts := strings.FieldsFunc(strings.ToLower(code), func(r rune) bool {
+			return r == '-' || r == '_' || r == ' '
+		})
+		return strings.Join(parts, "-")
 	}
-	defer f.Close()
-
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
+	if !pickupCaseSensitive {
+		return strings.ToUpper(code)
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
+	return code
 }
 
-func generateToken() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+// publicPickupCodePolicy 是 /api/features 返回的取件码格式，接收页据此调整输入框
+func publicPickupCodePolicy() map[string]interface{} {
+	policy := config.PickupCode
+	return map[string]interface{}{
+		"mode":          policy.Mode,
+		"length":        policy.Length,
+		"alphabet":      pickupAlphabet,
+		"caseSensitive": pickupCaseSensitive,
+		"words":         policy.Words,
+		"digits":        policy.Digits,
+	}
 }
 
-func hashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
-	return hex.EncodeToString(hash[:])
+// ==================== 取件码查找限制 ====================
+// 按来源 IP 和所在网段统计查找不存在的取件码的次数，达到上限后锁定该来源，
+// 锁定时长按次数指数增长。锁定只针对来源，不会让合法的取件码被他人锁死。
+
+// CodeLimit 是一个 IP 或网段的取件码查找失败记录
+type CodeLimit struct {
+	Key         string    `json:"key"`
+	Subnet      bool      `json:"subnet"`
+	Failures    int       `json:"failures"` // 本轮（上次锁定之后）的失败次数
+	Lockouts    int       `json:"lockouts"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil"`
 }
 
-func formatBytes(bytes int64) string {
-	if bytes == 0 {
-		return "0 B"
+// quietSince 返回最近一次失败或锁定结束的时间，记录从这之后开始计算过期
+func (l *CodeLimit) quietSince() time.Time {
+	if l.LockedUntil.After(l.LastFailure) {
+		return l.LockedUntil
 	}
-	sizes := []string{"B", "KB", "MB", "GB", "TB"}
-	i := int(math.Log(float64(bytes)) / math.Log(1024))
-	return fmt.Sprintf("%.2f %s", float64(bytes)/math.Pow(1024, float64(i)), sizes[i])
+	return l.LastFailure
 }
 
-func normalizeTodayLocked() {
-	today := time.Now().Format("2006-01-02")
-	if config.Stats.TodayDate != today {
-		config.Stats.TodayDate = today
-		config.Stats.TodayTransfers = 0
+// clientIP 返回请求来源 IP，trustProxy 开启时优先取 X-Forwarded-For 的第一个地址
+func clientIP(r *http.Request) string {
+	if config.Security.TrustProxy {
+		first, _, _ := strings.Cut(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := net.ParseIP(strings.TrimSpace(first)); ip != nil {
+			return ip.String()
+		}
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
 	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
-func recordTransfer() {
-	statsMu.Lock()
-	normalizeTodayLocked()
-	config.Stats.TotalTransfers++
-	config.Stats.TodayTransfers++
-	statsMu.Unlock()
-	saveConfig()
-}
-
-func getStatsSnapshot() AdminStats {
-	statsMu.Lock()
-	normalizeTodayLocked()
-	snapshot := config.Stats
-	statsMu.Unlock()
-	return snapshot
+// clientSubnet 返回 IP 所在的 /24（IPv4）或 /64（IPv6）网段
+func clientSubnet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	mask := net.CIDRMask(64, 128)
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, mask = v4, net.CIDRMask(24, 32)
+	}
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
 }
 
-func cleanPath(path string) string {
-	// 移除 .html 后缀
-	path = strings.TrimSuffix(path, ".html")
-	// 确保以 / 开头
-	if !strings.HasPrefix(path, "/") {
-		path = "/" + path
+func lockoutDuration(lockouts int) time.Duration {
+	d := time.Duration(config.Security.LockoutSeconds) * time.Second
+	limit := time.Duration(config.Security.MaxLockoutSeconds) * time.Second
+	for i := 1; i < lockouts && d < limit; i++ {
+		d *= 2
 	}
-	return path
+	if d > limit {
+		d = limit
+	}
+	return d
 }
 
-// ==================== HTTP 处理器 ====================
-// 注意：API 路由使用 ServeMux 自动匹配，无需在此处理
-// Go 1.22+ 会进行最长路径匹配，/api/features 会优先于 / 匹配
-func staticHandler(w http.ResponseWriter, r *http.Request) {
-	path := cleanPath(r.URL.Path)
+// codeLockout 返回 IP 或其网段的剩余锁定时间，未锁定时为 0
+func codeLockout(ip string) time.Duration {
+	now := time.Now()
+	codeLimitsMu.Lock()
+	defer codeLimitsMu.Unlock()
 
-	// 根路径
-	if path == "/" {
-		http.ServeFile(w, r, "./public/index.html")
-		return
+	var remaining time.Duration
+	for _, key := range []string{ip, clientSubnet(ip)} {
+		if limit, ok := codeLimits[key]; ok && limit.LockedUntil.After(now) {
+			remaining = max(remaining, limit.LockedUntil.Sub(now))
+		}
 	}
+	return remaining
+}
 
-	// 静态文件 - 先尝试直接路径，再尝试 .html 后缀
-	filePath := "./public" + path
+// recordCodeFailure 记录一次查找失败，IP 或网段达到上限时锁定
+func recordCodeFailure(ip string) {
+	now := time.Now()
+	window := time.Duration(config.Security.AttemptWindowMinutes) * time.Minute
+	codeLimitsMu.Lock()
+	defer codeLimitsMu.Unlock()
 
-	// 检查直接路径（目录）
-	if strings.HasSuffix(path, "/") {
-		if _, err := os.Stat(filePath); err == nil {
-			http.ServeFile(w, r, filePath+"index.html")
+	record := func(key string, subnet bool, maxFailures int) {
+		if key == "" {
 			return
 		}
-	}
+		limit, ok := codeLimits[key]
+		if !ok || now.Sub(limit.quietSince()) > window {
+			limit = &CodeLimit{Key: key, Subnet: subnet}
+			codeLimits[key] = limit
+		}
+		limit.Failures++
+		limit.LastFailure = now
+		if limit.Failures < maxFailures {
+			return
+		}
+		limit.Failures = 0
+		limit.Lockouts++
+		duration := lockoutDuration(limit.Lockouts)
+		limit.LockedUntil = now.Add(duration)
+		log.Printf("[安全] %s 取件码查找失败过多，锁定 %v（第 %d 次）", key, duration, limit.Lockouts)
+	}
+	record(ip, false, config.Security.MaxCodeAttempts)
+	record(clientSubnet(ip), true, config.Security.SubnetMaxCodeAttempts)
+}
 
-	// 检查直接路径（文件）
-	if _, err := os.Stat(filePath); err == nil {
-		http.ServeFile(w, r, filePath)
-		return
+func pruneCodeLimits(now time.Time) {
+	window := time.Duration(config.Security.AttemptWindowMinutes) * time.Minute
+	codeLimitsMu.Lock()
+	defer codeLimitsMu.Unlock()
+	for key, limit := range codeLimits {
+		if now.Sub(limit.quietSince()) > window {
+			delete(codeLimits, key)
+		}
 	}
+}
 
-	// 尝试添加 .html 后缀
-	htmlPath := filePath + ".html"
-	if _, err := os.Stat(htmlPath); err == nil {
-		http.ServeFile(w, r, htmlPath)
-		return
-	}
+func lockoutMessage(remaining time.Duration) string {
+	return fmt.Sprintf("尝试次数过多，请 %d 秒后再试", int(math.Ceil(remaining.Seconds())))
+}
 
-	// 自定义 404 页面
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusNotFound)
-	notFoundPage, err := os.ReadFile("./public/404.html")
-	if err != nil {
-		w.Write([]byte("404 page not found"))
-		return
+// rejectLockedClient 来源被锁定时返回 429 并返回 true
+func rejectLockedClient(w http.ResponseWriter, r *http.Request) bool {
+	remaining := codeLockout(codeLimitKey(r))
+	if remaining <= 0 {
+		return false
 	}
-	w.Write(notFoundPage)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+	http.Error(w, fmt.Sprintf(`{"success":false,"message":"%s"}`, lockoutMessage(remaining)), http.StatusTooManyRequests)
+	return true
 }
 
-// ==================== API 处理器 ====================
+// ==================== 下载密码 ====================
+// 上传时可以为文件设置下载密码，服务器只保存 argon2id 哈希。设置了密码的文件，查询接口
+// 只返回需要密码；下载时在 X-Download-Password 头中提供密码，或先通过 POST /api/unlock/<取件码>
+// 换取短期访问令牌，以 ?access=<令牌> 附加在地址上（浏览器直接下载时无法附加请求头）。
+// 密码错误计入取件码查找限制。
 
-// 上传文件
-func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
-	if !config.Features.ServerStorage {
-		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
-		return
-	}
+const maxDownloadPasswordLen = 128
 
-	if err := r.ParseMultipartForm(maxFileSize); err != nil {
-		http.Error(w, `{"success":false,"message":"文件过大"}`, http.StatusBadRequest)
-		return
+// argon2id 参数，取 OWASP 推荐配置；验证时使用哈希中记录的参数，调整后旧哈希仍然有效
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024 // KiB
+	argon2Threads = 1
+	argon2KeyLen  = 32
+)
+
+// passwordHashSlots 限制同时进行的哈希计算，避免大量请求耗尽内存
+var passwordHashSlots = make(chan struct{}, 4)
+
+// hashPasswordArgon2 返回 PHC 格式的哈希：$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func hashPasswordArgon2(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
 	}
+	passwordHashSlots <- struct{}{}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	<-passwordHashSlots
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
 
-	file, header, err := r.FormFile("file")
+func verifyPasswordArgon2(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	if memory == 0 || memory > 1024*1024 || iterations == 0 || threads == 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
 	if err != nil {
-		http.Error(w, `{"success":false,"message":"无法读取文件"}`, http.StatusBadRequest)
-		return
+		return false
 	}
-	defer file.Close()
-
-	// 检查存储空间（优先按声明大小预判）
-	usedSpace := getUsedStorage()
-	declaredSize := header.Size
-	if config.StorageConfig.MaxStorageSize > 0 {
-		if declaredSize > 0 && usedSpace+declaredSize > config.StorageConfig.MaxStorageSize {
-			http.Error(w, `{"success":false,"message":"存储空间不足"}`, http.StatusForbidden)
-			return
-		}
-		if usedSpace >= config.StorageConfig.MaxStorageSize {
-			http.Error(w, `{"success":false,"message":"存储空间已满"}`, http.StatusForbidden)
-			return
-		}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
 	}
 
-	// 生成唯一文件名和取件码
-	uniqueName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), sanitizeFilename(header.Filename))
-	pickupCode := generateUniquePickupCode()
+	passwordHashSlots <- struct{}{}
+	actual := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	<-passwordHashSlots
+	return subtle.ConstantTimeCompare(actual, key) == 1
+}
 
-	// 临时写入 + 原子重命名 + 计算哈希
-	filePath := filepath.Join(uploadDir, uniqueName)
-	written, fileHash, err := saveUploadedFileAtomicAndHash(file, filePath)
-	if err != nil {
-		http.Error(w, `{"success":false,"message":"写入文件失败"}`, http.StatusInternalServerError)
-		return
+// hashDownloadPassword 计算上传时提供的下载密码的哈希，password 为空时返回空字符串
+func hashDownloadPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
 	}
-
-	if config.StorageConfig.MaxStorageSize > 0 && usedSpace+written > config.StorageConfig.MaxStorageSize {
-		_ = os.Remove(filePath)
-		http.Error(w, `{"success":false,"message":"存储空间不足"}`, http.StatusForbidden)
-		return
+	if len(password) > maxDownloadPasswordLen {
+		return "", fmt.Errorf("download password too long")
 	}
+	return hashPasswordArgon2(password)
+}
 
-	// 计算删除时间
-	deleteTime := time.Now().Add(time.Duration(config.StorageConfig.FileRetentionHours) * time.Hour)
-	deleteMode := "timer"
-	if config.StorageConfig.NeverDelete {
-		deleteTime = time.Time{}
-		deleteMode = "never"
-	} else if config.StorageConfig.DeleteOnDownload {
-		deleteMode = "download"
-	}
+// DownloadGrant 是验证密码后发放的访问令牌，绑定到具体的文件，取件码被重用后自动失效
+type DownloadGrant struct {
+	File      *FileSession
+	ExpiresAt time.Time
+}
 
-	// 保存会话
-	now := time.Now()
-	storedFilesMu.Lock()
-	storedFiles[pickupCode] = &FileSession{
-		PickupCode:   pickupCode,
-		FileName:     uniqueName,
-		OriginalName: header.Filename,
-		Size:         written,
-		FileHash:     fileHash,
-		UploadTime:   now,
-		DeleteTime:   deleteTime,
-		DeleteMode:   deleteMode,
-	}
-	saveStorageIndex()
-	storedFilesMu.Unlock()
-	recordTransfer()
+const downloadGrantTTL = time.Hour
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":          true,
-		"pickupCode":       pickupCode,
-		"fileName":         header.Filename,
-		"size":             written,
-		"fileHash":         fileHash,
-		"deleteMode":       deleteMode,
-		"neverDelete":      config.StorageConfig.NeverDelete,
-		"deleteOnDownload": config.StorageConfig.DeleteOnDownload,
-		"retentionHours":   config.StorageConfig.FileRetentionHours,
-	})
+var (
+	downloadGrants   = make(map[string]*DownloadGrant) // 访问令牌 -> 授权
+	downloadGrantsMu sync.Mutex
+)
+
+func grantDownload(file *FileSession) string {
+	token := generateToken()
+	downloadGrantsMu.Lock()
+	downloadGrants[token] = &DownloadGrant{File: file, ExpiresAt: time.Now().Add(downloadGrantTTL)}
+	downloadGrantsMu.Unlock()
+	return token
 }
 
-// 分块上传接口
-func handleChunkUpload(w http.ResponseWriter, r *http.Request) {
-	if !config.Features.ServerStorage {
-		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
-		return
+func hasDownloadGrant(token string, file *FileSession) bool {
+	if token == "" {
+		return false
 	}
+	downloadGrantsMu.Lock()
+	defer downloadGrantsMu.Unlock()
+	grant, ok := downloadGrants[token]
+	return ok && grant.File == file && time.Now().Before(grant.ExpiresAt)
+}
 
-	if err := r.ParseMultipartForm(10 * 1024 * 1024); err != nil { // 10MB max per chunk
-		http.Error(w, `{"success":false,"message":"块过大"}`, http.StatusBadRequest)
-		return
+func pruneDownloadGrants(now time.Time) {
+	downloadGrantsMu.Lock()
+	defer downloadGrantsMu.Unlock()
+	for token, grant := range downloadGrants {
+		if now.After(grant.ExpiresAt) {
+			delete(downloadGrants, token)
+		}
 	}
+}
 
-	fileID := r.FormValue("fileID")
-	chunkIndexStr := r.FormValue("chunkIndex")
-	totalChunksStr := r.FormValue("totalChunks")
+// isDownloadUnlocked 判断请求是否带有该文件的有效访问令牌，不校验密码头
+func isDownloadUnlocked(r *http.Request, file *FileSession) bool {
+	return file.PasswordHash == "" || hasDownloadGrant(r.URL.Query().Get("access"), file)
+}
 
-	if fileID == "" || chunkIndexStr == "" || totalChunksStr == "" {
-		http.Error(w, `{"success":false,"message":"参数缺失"}`, http.StatusBadRequest)
-		return
+// authorizeDownload 检查受密码保护的文件的访问权限，未通过时写入错误响应并返回 false
+func authorizeDownload(w http.ResponseWriter, r *http.Request, file *FileSession) bool {
+	if isDownloadUnlocked(r, file) {
+		return true
 	}
-
-	chunkIndex, err := strconv.Atoi(chunkIndexStr)
-	if err != nil {
-		http.Error(w, `{"success":false,"message":"块索引无效"}`, http.StatusBadRequest)
-		return
+	password := r.Header.Get("X-Download-Password")
+	if password == "" {
+		http.Error(w, `{"success":false,"message":"需要下载密码","passwordRequired":true}`, http.StatusUnauthorized)
+		return false
+	}
+	if !verifyPasswordArgon2(password, file.PasswordHash) {
+		recordCodeFailure(codeLimitKey(r))
+		http.Error(w, `{"success":false,"message":"下载密码错误","passwordRequired":true}`, http.StatusForbidden)
+		return false
 	}
+	return true
+}
 
-	totalChunks, err := strconv.Atoi(totalChunksStr)
-	if err != nil {
-		http.Error(w, `{"success":false,"message":"总块数无效"}`, http.StatusBadRequest)
+// 验证下载密码并发放访问令牌
+func unlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
 		return
 	}
-
-	file, _, err := r.FormFile("chunk")
-	if err != nil {
-		http.Error(w, `{"success":false,"message":"无法读取块"}`, http.StatusBadRequest)
+	code := normalizePickupCode(filepath.Base(r.URL.Path))
+	if rejectLockedClient(w, r) {
 		return
 	}
-	defer file.Close()
 
-	// 创建临时目录
-	chunkDir := filepath.Join(uploadDir, "chunks", fileID)
-	if err := os.MkdirAll(chunkDir, 0755); err != nil {
-		http.Error(w, `{"success":false,"message":"创建临时目录失败"}`, http.StatusInternalServerError)
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
 		return
 	}
 
-	// 保存块
-	chunkPath := filepath.Join(chunkDir, fmt.Sprintf("%d", chunkIndex))
-	chunkFile, err := os.Create(chunkPath)
-	if err != nil {
-		http.Error(w, `{"success":false,"message":"创建块文件失败"}`, http.StatusInternalServerError)
+	storedFilesMu.RLock()
+	file, exists := storedFiles[code]
+	storedFilesMu.RUnlock()
+	if !exists {
+		recordCodeFailure(codeLimitKey(r))
+		http.Error(w, `{"success":false,"message":"取件码无效或文件已过期"}`, http.StatusNotFound)
 		return
 	}
-	defer chunkFile.Close()
-
-	if _, err := io.Copy(chunkFile, file); err != nil {
-		http.Error(w, `{"success":false,"message":"写入块失败"}`, http.StatusInternalServerError)
+	if file.PasswordHash != "" && !verifyPasswordArgon2(req.Password, file.PasswordHash) {
+		recordCodeFailure(codeLimitKey(r))
+		http.Error(w, `{"success":false,"message":"下载密码错误"}`, http.StatusForbidden)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":     true,
-		"chunkIndex":  chunkIndex,
-		"totalChunks": totalChunks,
+		"accessToken": grantDownload(file),
+		"expiresIn":   int(downloadGrantTTL.Seconds()),
 	})
 }
 
-// 合并分块接口
-func handleMergeChunks(w http.ResponseWriter, r *http.Request) {
-	if !config.Features.ServerStorage {
-		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
-		return
-	}
+// ==================== 下载次数 ====================
+// 只有完整下载才计入 DownloadCount：不带 Range 的请求需要把整个文件发送完毕，
+// 分块 Range 下载则按下载者累计已发送的区间，覆盖整个文件时计一次。
+// 达到 MaxDownloads 后文件被删除；删除模式为 download 的文件相当于上限为 1。
 
-	var req struct {
-		FileID      string `json:"fileID"`
-		TotalChunks int    `json:"totalChunks"`
-		FileName    string `json:"fileName"`
-		FileSize    int64  `json:"fileSize"`
-	}
+const (
+	maxDownloadLimit     = 10000
+	downloadProgressIdle = time.Hour
+)
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
-		return
-	}
+// DownloadProgress 是一个下载者对某个文件已收到的字节区间（左闭右开，互不相邻）
+type DownloadProgress struct {
+	File      *FileSession
+	Ranges    [][2]int64
+	UpdatedAt time.Time
+}
 
-	chunkDir := filepath.Join(uploadDir, "chunks", req.FileID)
+var (
+	downloadProgress   = make(map[string]*DownloadProgress)
+	downloadProgressMu sync.Mutex
+)
 
-	// 检查所有块是否存在
-	for i := 0; i < req.TotalChunks; i++ {
-		chunkPath := filepath.Join(chunkDir, fmt.Sprintf("%d", i))
-		if _, err := os.Stat(chunkPath); os.IsNotExist(err) {
-			http.Error(w, fmt.Sprintf(`{"success":false,"message":"块 %d 缺失"}`, i), http.StatusBadRequest)
-			return
-		}
+func validateMaxDownloads(n int) error {
+	if n < 0 || n > maxDownloadLimit {
+		return fmt.Errorf("下载次数上限应在 0-%d 之间", maxDownloadLimit)
 	}
+	return nil
+}
 
-	// 生成唯一文件名
-	uniqueName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), sanitizeFilename(req.FileName))
-	filePath := filepath.Join(uploadDir, uniqueName)
-
-	// 创建最终文件
-	finalFile, err := os.Create(filePath + ".tmp")
+// parseMaxDownloads 解析上传时指定的下载次数上限，空字符串或 0 表示不限制
+func parseMaxDownloads(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		http.Error(w, `{"success":false,"message":"创建文件失败"}`, http.StatusInternalServerError)
-		return
+		return 0, err
 	}
+	return n, validateMaxDownloads(n)
+}
 
-	hasher := sha256.New()
-	writer := io.MultiWriter(finalFile, hasher)
-
-	// 按顺序合并所有块
-	for i := 0; i < req.TotalChunks; i++ {
-		chunkPath := filepath.Join(chunkDir, fmt.Sprintf("%d", i))
-		chunkFile, err := os.Open(chunkPath)
-		if err != nil {
-			finalFile.Close()
-			os.Remove(filePath + ".tmp")
-			http.Error(w, fmt.Sprintf(`{"success":false,"message":"读取块 %d 失败"}`, i), http.StatusInternalServerError)
-			return
-		}
+// downloadClientKey 区分同一文件的不同下载者：浏览器分块下载时带 X-Download-ID，其余按来源 IP
+func downloadClientKey(r *http.Request, code string) string {
+	id := r.Header.Get("X-Download-ID")
+	if id == "" || len(id) > 64 {
+		id = clientIP(r)
+	}
+	return code + "|" + id
+}
 
-		if _, err := io.Copy(writer, chunkFile); err != nil {
-			chunkFile.Close()
-			finalFile.Close()
-			os.Remove(filePath + ".tmp")
-			http.Error(w, fmt.Sprintf(`{"success":false,"message":"合并块 %d 失败"}`, i), http.StatusInternalServerError)
-			return
+// add 合并新收到的区间 [start, end)，返回是否已覆盖整个文件 [0, size)
+func (p *DownloadProgress) add(start, end, size int64) bool {
+	merged := make([][2]int64, 0, len(p.Ranges)+1)
+	current := [2]int64{start, end}
+	for _, rg := range p.Ranges {
+		if rg[1] < current[0] || rg[0] > current[1] {
+			merged = append(merged, rg)
+			continue
 		}
-		chunkFile.Close()
+		current[0] = min(current[0], rg[0])
+		current[1] = max(current[1], rg[1])
 	}
+	p.Ranges = append(merged, current)
+	return len(p.Ranges) == 1 && p.Ranges[0][0] <= 0 && p.Ranges[0][1] >= size
+}
 
-	finalFile.Sync()
-	finalFile.Close()
+// recordRangeDownload 记录一个已完整发送的 Range 响应 [start, end]，累计覆盖整个文件时计一次下载并返回 true
+func recordRangeDownload(r *http.Request, file *FileSession, start, end, size int64) bool {
+	key := downloadClientKey(r, file.PickupCode)
+	downloadProgressMu.Lock()
+	progress, ok := downloadProgress[key]
+	if !ok || progress.File != file {
+		progress = &DownloadProgress{File: file}
+		downloadProgress[key] = progress
+	}
+	progress.UpdatedAt = time.Now()
+	complete := progress.add(start, end+1, size)
+	if complete {
+		delete(downloadProgress, key)
+	}
+	downloadProgressMu.Unlock()
 
-	// 原子重命名
-	if err := os.Rename(filePath+".tmp", filePath); err != nil {
-		os.Remove(filePath + ".tmp")
-		http.Error(w, `{"success":false,"message":"重命名文件失败"}`, http.StatusInternalServerError)
-		return
+	if complete {
+		completeDownload(r, file)
 	}
+	return complete
+}
 
-	// 计算哈希
-	fileHash := hex.EncodeToString(hasher.Sum(nil))
+// completeDownload 计入一次完整下载并写入审计日志，达到次数上限时删除文件
+func completeDownload(r *http.Request, file *FileSession) {
+	storedFilesMu.Lock()
+	if storedFiles[file.PickupCode] != file {
+		storedFilesMu.Unlock()
+		return // 文件已被删除
+	}
 
-	// 删除临时块目录
-	os.RemoveAll(chunkDir)
+	file.DownloadCount++
+	count := file.DownloadCount
+	limit := file.MaxDownloads
+	if file.DeleteMode == "download" {
+		limit = 1
+	}
+	reachedLimit := limit > 0 && count >= limit
+	var orphaned []string
+	if reachedLimit {
+		log.Printf("[文件] %s 已完整下载 %d 次，达到上限", file.PickupCode, count)
+		orphaned = deleteStoredFile(file.PickupCode)
+	} else {
+		saveStorageIndex()
+	}
+	storedFilesMu.Unlock()
+	deleteBlobs(orphaned)
 
-	// 计算删除时间
-	deleteTime := time.Now().Add(time.Duration(config.StorageConfig.FileRetentionHours) * time.Hour)
-	deleteMode := "timer"
-	if config.StorageConfig.NeverDelete {
-		deleteTime = time.Time{}
-		deleteMode = "never"
-	} else if config.StorageConfig.DeleteOnDownload {
-		deleteMode = "download"
+	// 审计日志不在持有 storedFilesMu 时写入，避免日志读写阻塞文件操作
+	auditLog(r, requestActor(r), "file.download", file.PickupCode, auditSuccess, fmt.Sprintf("第 %d 次", count))
+	if reachedLimit {
+		auditLog(r, auditActorSystem, "file.delete", file.PickupCode, auditSuccess, "达到下载次数上限")
 	}
+}
 
-	// 保存会话
-	now := time.Now()
-	storedFilesMu.Lock()
-	storedFiles[req.FileID] = &FileSession{
-		PickupCode:   req.FileID,
-		FileName:     uniqueName,
-		OriginalName: req.FileName,
-		Size:         req.FileSize,
-		FileHash:     fileHash,
-		UploadTime:   now,
-		DeleteTime:   deleteTime,
-		DeleteMode:   deleteMode,
+// pruneDownloadProgress 清理长时间没有继续的分块下载记录
+func pruneDownloadProgress(now time.Time) {
+	downloadProgressMu.Lock()
+	defer downloadProgressMu.Unlock()
+	for key, progress := range downloadProgress {
+		if now.Sub(progress.UpdatedAt) > downloadProgressIdle {
+			delete(downloadProgress, key)
+		}
 	}
-	saveStorageIndex()
-	storedFilesMu.Unlock()
-	recordTransfer()
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":    true,
-		"pickupCode": req.FileID,
-		"fileName":   req.FileName,
-		"size":       req.FileSize,
-		"fileHash":   fileHash,
-		"deleteMode": deleteMode,
-	})
+// ==================== 签名下载链接 ====================
+// 签名链接形如 /api/signed-download/<ID>?expires=<unix>&ip=<IP>&once=1&sig=<HMAC>，
+// 只包含随机 ID，不暴露取件码。签名覆盖 ID、过期时间、绑定 IP 与一次性标记，防止篡改；
+// 链接记录与存储索引一起持久化，可单独撤销，文件删除时一并失效。
+// 更换 linkSecret 会使所有已发出的链接失效。
+
+// SignedLink 是一条已发出的签名下载链接，由 storedFilesMu 保护
+type SignedLink struct {
+	ID         string    `json:"id"`
+	PickupCode string    `json:"pickupCode"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	IP         string    `json:"ip,omitempty"` // 只允许该客户端 IP 使用，为空表示不限
+	SingleUse  bool      `json:"singleUse,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+
+	inUse bool // 一次性链接正在下载，受 storedFilesMu 保护
 }
 
-func sanitizeFilename(name string) string {
-	// 移除危险字符
-	reg := regexp.MustCompile(`[^\w\-\.]`)
-	return reg.ReplaceAllString(name, "_")
+var (
+	signedLinks = make(map[string]*SignedLink) // 链接 ID -> 链接
+	linkSecret  []byte
+)
+
+// loadLinkSecret 读取签名密钥，未配置时生成一个并写入配置文件，保证重启后已发出的链接仍然有效
+func loadLinkSecret() error {
+	raw := os.Getenv("FILE_ROCKET_LINK_SECRET")
+	if raw == "" {
+		raw = config.Security.LinkSecret
+	}
+	if raw == "" {
+		config.Security.LinkSecret = generateToken()
+		saveConfig()
+		raw = config.Security.LinkSecret
+		log.Println("[签名链接] 已生成新的签名密钥")
+	}
+	secret, err := hex.DecodeString(strings.TrimSpace(raw))
+	if err != nil || len(secret) < 16 {
+		return errors.New("linkSecret 必须是至少 32 位的十六进制字符串")
+	}
+	linkSecret = secret
+	return nil
 }
 
-// 获取存储使用量
-func getUsedStorage() int64 {
-	var total int64
-	storedFilesMu.RLock()
-	defer storedFilesMu.RUnlock()
+// signLink 计算链接参数的 HMAC-SHA256 签名
+func signLink(id string, expires int64, ip string, once bool) string {
+	mac := hmac.New(sha256.New, linkSecret)
+	fmt.Fprintf(mac, "%s\n%d\n%s\n%t", id, expires, ip, once)
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	for _, file := range storedFiles {
-		filePath := filepath.Join(uploadDir, file.FileName)
-		if info, err := os.Stat(filePath); err == nil {
-			total += info.Size()
+// signedLinkURL 返回链接的相对地址
+func signedLinkURL(link *SignedLink) string {
+	query := url.Values{}
+	expires := link.ExpiresAt.Unix()
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	if link.IP != "" {
+		query.Set("ip", link.IP)
+	}
+	if link.SingleUse {
+		query.Set("once", "1")
+	}
+	query.Set("sig", signLink(link.ID, expires, link.IP, link.SingleUse))
+	return "/api/signed-download/" + link.ID + "?" + query.Encode()
+}
+
+func pruneSignedLinksLocked(now time.Time) {
+	pruned := false
+	for id, link := range signedLinks {
+		if now.After(link.ExpiresAt) {
+			delete(signedLinks, id)
+			pruned = true
 		}
 	}
-	return total
+	if pruned {
+		saveStorageIndex()
+	}
 }
 
-// 下载存储的文件（支持 Range 请求）
-func downloadStoredHandler(w http.ResponseWriter, r *http.Request) {
+// 生成（POST /api/signed-links）与撤销（DELETE /api/signed-links/<ID>）签名链接，
+// 两者都需要提供取件码，受密码保护的文件还需要下载密码或访问令牌
+func signedLinksHandler(w http.ResponseWriter, r *http.Request) {
 	if !config.Features.ServerStorage {
 		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
 		return
 	}
-
-	code := filepath.Base(r.URL.Path)
-	codeAttemptsMu.Lock()
-	attempts := codeAttempts[code]
-	if attempts >= config.Security.MaxCodeAttempts {
-		codeAttemptsMu.Unlock()
-		http.Error(w, `{"success":false,"message":"取件码已锁定"}`, http.StatusForbidden)
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectLockedClient(w, r) {
 		return
 	}
-	codeAttemptsMu.Unlock()
 
-	storedFilesMu.RLock()
-	file, exists := storedFiles[code]
-	if !exists {
-		codeAttemptsMu.Lock()
-		codeAttempts[code]++
-		codeAttemptsMu.Unlock()
-		storedFilesMu.RUnlock()
-		http.Error(w, `{"success":false,"message":"取件码无效或文件已过期"}`, http.StatusNotFound)
+	var req struct {
+		PickupCode string `json:"pickupCode"`
+		ExpiresIn  int64  `json:"expiresIn"` // 有效期（秒），默认 24 小时
+		IP         string `json:"ip"`        // 可选，绑定的客户端 IP
+		SingleUse  bool   `json:"singleUse"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
 		return
 	}
-	storedFilesMu.RUnlock()
+	code := normalizePickupCode(req.PickupCode)
 
-	// 检查删除模式
-	if file.DeleteMode == "download" {
-		defer func() {
-			storedFilesMu.Lock()
-			deleteStoredFile(code)
-			storedFilesMu.Unlock()
-		}()
+	storedFilesMu.RLock()
+	file, exists := storedFiles[code]
+	storedFilesMu.RUnlock()
+	if !exists {
+		recordCodeFailure(codeLimitKey(r))
+		http.Error(w, `{"success":false,"message":"取件码无效或文件已过期"}`, http.StatusNotFound)
+		return
+	}
+	if !authorizeDownload(w, r, file) {
+		return
 	}
 
-	filePath := filepath.Join(uploadDir, file.FileName)
-
-	// 打开文件
-	f, err := os.Open(filePath)
-	if err != nil {
-		http.Error(w, `{"success":false,"message":"文件不存在"}`, http.StatusNotFound)
+	if r.Method == http.MethodDelete {
+		id := strings.TrimPrefix(r.URL.Path, "/api/signed-links/")
+		storedFilesMu.Lock()
+		link, ok := signedLinks[id]
+		if ok && link.PickupCode == code {
+			delete(signedLinks, id)
+			saveStorageIndex()
+		}
+		storedFilesMu.Unlock()
+		if !ok || link.PickupCode != code {
+			http.Error(w, `{"success":false,"message":"链接不存在"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("[签名链接] 已撤销: %s (%s)", id, code)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
 		return
 	}
-	defer f.Close()
 
-	// 获取文件信息
-	fileInfo, err := f.Stat()
-	if err != nil {
-		http.Error(w, `{"success":false,"message":"获取文件信息失败"}`, http.StatusInternalServerError)
+	if req.ExpiresIn == 0 {
+		req.ExpiresIn = 24 * 3600
+	}
+	if req.ExpiresIn < 0 || req.ExpiresIn > int64(config.Security.MaxLinkHours)*3600 {
+		http.Error(w, fmt.Sprintf(`{"success":false,"message":"有效期最长 %d 小时"}`, config.Security.MaxLinkHours), http.StatusBadRequest)
 		return
 	}
-	fileSize := fileInfo.Size()
+	if req.IP != "" {
+		ip := net.ParseIP(strings.TrimSpace(req.IP))
+		if ip == nil {
+			http.Error(w, `{"success":false,"message":"IP 地址无效"}`, http.StatusBadRequest)
+			return
+		}
+		req.IP = ip.String()
+	}
 
-	// 设置基本头
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, file.OriginalName))
-	w.Header().Set("Accept-Ranges", "bytes")
-	if file.FileHash != "" {
-		w.Header().Set("X-File-SHA256", file.FileHash)
+	now := time.Now()
+	link := &SignedLink{
+		ID:         generateToken()[:24],
+		PickupCode: code,
+		ExpiresAt:  now.Add(time.Duration(req.ExpiresIn) * time.Second).Truncate(time.Second),
+		IP:         req.IP,
+		SingleUse:  req.SingleUse,
+		CreatedAt:  now,
+	}
+	if !file.DeleteTime.IsZero() && link.ExpiresAt.After(file.DeleteTime) {
+		link.ExpiresAt = file.DeleteTime.Truncate(time.Second) // 链接不会比文件活得更久
 	}
 
-	// 检查 Range 请求
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader == "" {
-		// 没有 Range，返回整个文件
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileSize))
-		w.Header().Set("Content-Type", "application/octet-stream")
-		io.Copy(w, f)
+	storedFilesMu.Lock()
+	if storedFiles[code] != file {
+		storedFilesMu.Unlock()
+		http.Error(w, `{"success":false,"message":"取件码无效或文件已过期"}`, http.StatusNotFound)
 		return
 	}
+	signedLinks[link.ID] = link
+	saveStorageIndex()
+	storedFilesMu.Unlock()
+	log.Printf("[签名链接] 已生成: %s -> %s，有效至 %s", link.ID, code, link.ExpiresAt.Format("2006-01-02 15:04:05"))
 
-	// 解析 Range header (格式: bytes=start-end)
-	ranges := strings.TrimPrefix(rangeHeader, "bytes=")
-	parts := strings.Split(ranges, "-")
-	if len(parts) != 2 {
-		http.Error(w, "Invalid Range header", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"id":        link.ID,
+		"url":       signedLinkURL(link),
+		"expiresAt": link.ExpiresAt.UnixMilli(),
+		"ip":        link.IP,
+		"singleUse": link.SingleUse,
+	})
+}
+
+// 通过签名链接下载（GET /api/signed-download/<ID>?...），无需取件码和下载密码
+func signedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Features.ServerStorage {
+		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
+		return
+	}
+	if rejectLockedClient(w, r) {
 		return
 	}
 
-	start, err := strconv.ParseInt(parts[0], 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid Range start", http.StatusBadRequest)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/signed-download/"), "/")
+	query := r.URL.Query()
+	expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+	ip, once := query.Get("ip"), query.Get("once") == "1"
+	expected := signLink(id, expires, ip, once)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(query.Get("sig")))) {
+		recordCodeFailure(codeLimitKey(r))
+		http.Error(w, `{"success":false,"message":"链接无效"}`, http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, `{"success":false,"message":"链接已过期"}`, http.StatusGone)
+		return
+	}
+	if ip != "" && clientIP(r) != ip {
+		http.Error(w, `{"success":false,"message":"链接不能在此网络中使用"}`, http.StatusForbidden)
 		return
 	}
 
-	var end int64
-	if parts[1] == "" {
-		end = fileSize - 1
-	} else {
-		end, err = strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			http.Error(w, "Invalid Range end", http.StatusBadRequest)
+	// 签名有效但记录已不存在，说明链接已撤销、已使用或文件已删除
+	storedFilesMu.Lock()
+	link, ok := signedLinks[id]
+	var file *FileSession
+	if ok {
+		file = storedFiles[link.PickupCode]
+	}
+	if !ok || file == nil || link.ExpiresAt.Unix() != expires {
+		storedFilesMu.Unlock()
+		http.Error(w, `{"success":false,"message":"链接已失效"}`, http.StatusGone)
+		return
+	}
+
+	// 一次性链接在完整下载后才作废，连接中断或读取失败时仍可重试；下载期间占用链接，
+	// 不能同时用同一链接下载两次。分段下载无法确认整个文件已送达，一次性链接不支持 Range
+	claimed := link.SingleUse && r.Method != http.MethodHead
+	if claimed {
+		if r.Header.Get("Range") != "" {
+			storedFilesMu.Unlock()
+			http.Error(w, `{"success":false,"message":"一次性链接不支持分段下载"}`, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if link.inUse {
+			storedFilesMu.Unlock()
+			http.Error(w, `{"success":false,"message":"链接正在被使用"}`, http.StatusConflict)
 			return
 		}
+		link.inUse = true
 	}
+	storedFilesMu.Unlock()
 
-	// 验证范围
-	if start < 0 || end >= fileSize || start > end {
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
-		http.Error(w, "Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+	completed := serveStoredFile(w, r, file, "", false)
+	if !claimed {
 		return
 	}
+	storedFilesMu.Lock()
+	link.inUse = false
+	if completed && signedLinks[id] == link {
+		delete(signedLinks, id)
+		saveStorageIndex()
+	}
+	storedFilesMu.Unlock()
+}
 
-	// 设置 Range 响应头
-	contentLength := end - start + 1
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", contentLength))
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusPartialContent)
+// ==================== API 密钥 ====================
+// 供脚本和自动化使用的长期密钥，通过 X-API-Key 或 Authorization: Bearer 头提供，服务器只保存 SHA-256。
+// 权限：upload 允许上传（可限制单文件大小和每日上传字节数）；download 使取件码查找限制按密钥而不是
+// 来源 IP 计算，适合共享出口 IP 的 CI；admin-read / admin-write 可代替管理员 token 调用管理接口，
+// 分别相当于 viewer 和 operator 角色（管理账户和密钥仍需要 owner 登录）。
 
-	// 定位到起始位置
-	if _, err := f.Seek(start, 0); err != nil {
-		log.Printf("[Range] Seek 失败: %v", err)
-		return
+const (
+	scopeUpload     = "upload"
+	scopeDownload   = "download"
+	scopeAdminRead  = "admin-read"
+	scopeAdminWrite = "admin-write"
+
+	apiKeyPrefix     = "frk_"
+	maxAPIKeyNameLen = 64
+)
+
+var apiKeyScopes = map[string]bool{scopeUpload: true, scopeDownload: true, scopeAdminRead: true, scopeAdminWrite: true}
+
+// APIKey 保存在 config.APIKeys 中，由 apiKeysMu 保护（saveConfig 会加读锁，持有写锁时不能调用）；
+// 用量字段（UsageDate、UsedBytes、LastUsedAt）在每次请求时更新，另由 apiKeyUsageMu 保护，
+// 加锁顺序为先 apiKeysMu 后 apiKeyUsageMu，只在内存中累计，由 apiKeyUsageFlushRoutine 定期写回配置文件。
+// 明文密钥形如 frk_<ID>_<密钥>，只在创建时返回一次
+type APIKey struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	KeyHash     string    `json:"keyHash"`
+	Scopes      []string  `json:"scopes"`
+	MaxFileSize int64     `json:"maxFileSize,omitempty"` // 单个文件上限（字节），0 表示只受全局限制
+	DailyBytes  int64     `json:"dailyBytes,omitempty"`  // 每日上传字节数上限，0 表示不限
+	UsageDate   string    `json:"usageDate,omitempty"`
+	UsedBytes   int64     `json:"usedBytes,omitempty"` // UsageDate 当天已上传的字节数
+	CreatedBy   string    `json:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastUsedAt  time.Time `json:"lastUsedAt,omitempty"`
+}
+
+var (
+	apiKeysMu        sync.RWMutex
+	apiKeyUsageMu    sync.Mutex
+	apiKeyUsageDirty bool // 用量有变化尚未写回配置文件，由 apiKeyUsageMu 保护
+)
+
+// apiKeyUsageFlushInterval 是用量写回配置文件的间隔，重启时最多丢失这段时间内的用量
+const apiKeyUsageFlushInterval = time.Minute
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
 	}
+	return false
+}
 
-	// 发送指定范围的数据
-	io.CopyN(w, f, contentLength)
+// usedToday 返回今天已上传的字节数，日期变化后归零；调用方需持有 apiKeyUsageMu
+func (k *APIKey) usedToday() int64 {
+	if k.UsageDate != time.Now().Format("2006-01-02") {
+		return 0
+	}
+	return k.UsedBytes
 }
 
-// ==================== 健康检查 ====================
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	activeSessionsMu.RLock()
-	storedFilesMu.RLock()
+// rawAPIKey 从请求头中取出 API 密钥，没有时返回空
+func rawAPIKey(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && strings.HasPrefix(token, apiKeyPrefix) {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":         "healthy",
-		"activeSessions": len(activeSessions),
-		"storedFiles":    len(storedFiles),
-		"uptime":         time.Since(startTime).Seconds(),
+// lookupAPIKey 校验明文密钥并返回副本，同时记录最近使用时间；无效时返回 nil
+func lookupAPIKey(raw string) *APIKey {
+	id, _, ok := strings.Cut(strings.TrimPrefix(raw, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(raw, apiKeyPrefix) {
+		return nil
+	}
+	keyHash := hashPassword(raw)
+
+	apiKeysMu.RLock()
+	defer apiKeysMu.RUnlock()
+	for _, key := range config.APIKeys {
+		if key.ID == id && subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(keyHash)) == 1 {
+			apiKeyUsageMu.Lock()
+			key.LastUsedAt = time.Now()
+			apiKeyUsageDirty = true
+			copied := *key
+			apiKeyUsageMu.Unlock()
+			return &copied
+		}
+	}
+	return nil
+}
+
+type apiKeyContextKey struct{}
+
+// resolvedAPIKey 是请求中 API 密钥的校验结果，key 为 nil 表示提供的密钥无效
+type resolvedAPIKey struct {
+	raw string
+	key *APIKey
+}
+
+// withAPIKey 在请求进入路由前校验一次 API 密钥，之后通过 requestAPIKey 取用，避免同一请求反复计算哈希
+func withAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if raw := rawAPIKey(r); raw != "" {
+			resolved := &resolvedAPIKey{raw: raw, key: lookupAPIKey(raw)}
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, resolved))
+		}
+		next.ServeHTTP(w, r)
 	})
+}
 
-	storedFilesMu.RUnlock()
-	activeSessionsMu.RUnlock()
+// requestAPIKey 返回请求提供的明文密钥（未提供时为空）和对应的密钥（无效时为 nil）
+func requestAPIKey(r *http.Request) (string, *APIKey) {
+	if resolved, ok := r.Context().Value(apiKeyContextKey{}).(*resolvedAPIKey); ok {
+		return resolved.raw, resolved.key
+	}
+	raw := rawAPIKey(r)
+	if raw == "" {
+		return "", nil
+	}
+	return raw, lookupAPIKey(raw)
 }
 
-// ==================== HTTP 流下载处理 ====================
+// uploadReservation 是授权时从密钥每日额度中预留的字节数。上传成功后用 commit 按实际字节数结算，
+// 否则由 release 退回；未使用密钥时为 nil，方法均可安全调用
+type uploadReservation struct {
+	keyID    string
+	limit    int64 // 密钥的每日额度，0 表示不限
+	reserved int64
+	received int64 // 经 reader 读取的字节数
+	done     bool
+}
 
-// downloadStreamHandler 处理 HTTP 流式下载
-// 当接收端不支持 File System Access API 时，通过 iframe 请求此端点进行流式下载
-func downloadStreamHandler(w http.ResponseWriter, r *http.Request) {
-	// 提取取件码
-	code := strings.TrimPrefix(r.URL.Path, "/api/download/")
-	if code == "" || code == "/api/download" {
-		http.Error(w, "取件码无效", http.StatusBadRequest)
+// uploadQuotaStep 是边读边预留时每次多预留的字节数，减少加锁次数，多出的部分在 commit 时退回
+const uploadQuotaStep = 1024 * 1024
+
+var errDailyQuotaExceeded = errors.New("超出 API 密钥每日上传额度")
+
+// adjustAPIKeyUsage 修改密钥今天的用量；limit 大于 0 时超出上限则不修改并返回 false
+func adjustAPIKeyUsage(keyID string, delta, limit int64) bool {
+	today := time.Now().Format("2006-01-02")
+	apiKeysMu.RLock()
+	defer apiKeysMu.RUnlock()
+	apiKeyUsageMu.Lock()
+	defer apiKeyUsageMu.Unlock()
+	for _, stored := range config.APIKeys {
+		if stored.ID != keyID {
+			continue
+		}
+		used := stored.usedToday()
+		if limit > 0 && delta > 0 && used+delta > limit {
+			return false
+		}
+		stored.UsageDate, stored.UsedBytes = today, max(used+delta, 0)
+		apiKeyUsageDirty = true
+		return true
+	}
+	return true // 密钥已被撤销，无需记账
+}
+
+// resize 在得知更准确的大小后（如解析表单之后）把预留改为 n 字节，超出每日额度时返回 false
+func (res *uploadReservation) resize(n int64) bool {
+	if res == nil || res.done || n == res.reserved {
+		return true
+	}
+	if !adjustAPIKeyUsage(res.keyID, n-res.reserved, res.limit) {
+		return false
+	}
+	res.reserved = n
+	return true
+}
+
+// commit 确认上传成功并退回多预留的额度。超出预留的部分必须事先用 resize 或 reader 预留，
+// 这里不再增加用量，否则长度未知的上传会绕过每日额度
+func (res *uploadReservation) commit(actual int64) {
+	if res == nil || res.done {
 		return
 	}
+	res.done = true
+	if actual < res.reserved {
+		adjustAPIKeyUsage(res.keyID, actual-res.reserved, 0)
+	}
+}
+
+// reader 返回边读边预留额度的 src，用于事先不知道长度的请求体（如分块传输编码）。
+// 同一预留记录的多个 reader 累计计数，读取总量超出每日额度时返回 errDailyQuotaExceeded
+func (res *uploadReservation) reader(src io.Reader) io.Reader {
+	if res == nil {
+		return src
+	}
+	return &quotaReader{src: src, res: res}
+}
 
-	// 查找会话
-	activeSessionsMu.RLock()
-	session, exists := activeSessions[code]
-	activeSessionsMu.RUnlock()
+type quotaReader struct {
+	src io.Reader
+	res *uploadReservation
+}
 
-	if !exists || session == nil {
-		http.Error(w, "链接已失效或会话不存在", http.StatusNotFound)
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.src.Read(p)
+	q.res.received += int64(n)
+	if q.res.received > q.res.reserved {
+		if !q.res.resize(q.res.received+uploadQuotaStep) && !q.res.resize(q.res.received) {
+			return 0, errDailyQuotaExceeded
+		}
+	}
+	return n, err
+}
+
+func (res *uploadReservation) release() {
+	if res == nil || res.done {
 		return
 	}
+	res.done = true
+	adjustAPIKeyUsage(res.keyID, -res.reserved, 0)
+}
 
-	// 设置下载头
-	filename := url.PathEscape(session.FileName)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s; filename*=UTF-8''%s", filename, filename))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	if session.Size > 0 {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", session.Size))
+// authorizeUploadKey 校验上传使用的 API 密钥。fileSize 为文件总大小（未知时为 0），incoming 为本次
+// 将写入的字节数，校验通过时立即从每日额度中预留，并发上传不会同时通过检查而超出额度。
+// 返回密钥（未提供时为 nil）和预留记录，未通过时返回 HTTP 状态码和错误信息
+func authorizeUploadKey(raw string, key *APIKey, fileSize, incoming int64) (*APIKey, *uploadReservation, int, string) {
+	if raw == "" {
+		if config.Security.RequireAPIKeyForUpload {
+			return nil, nil, http.StatusUnauthorized, "上传需要 API 密钥"
+		}
+		return nil, nil, 0, ""
 	}
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
 
-	// 检查是否支持 Flusher（用于流式传输）
-	if flusher, ok := w.(http.Flusher); ok {
-		session.DownloadFlusher = flusher
+	if key == nil {
+		return nil, nil, http.StatusUnauthorized, "API 密钥无效"
 	}
-	session.DownloadResponse = w
+	if !key.HasScope(scopeUpload) {
+		return nil, nil, http.StatusForbidden, "该 API 密钥没有上传权限"
+	}
+	if key.MaxFileSize > 0 && fileSize > key.MaxFileSize {
+		return nil, nil, http.StatusRequestEntityTooLarge, fmt.Sprintf("超过该 API 密钥的单文件上限 %s", formatBytes(key.MaxFileSize))
+	}
+	incoming = max(incoming, 0)
+	if !adjustAPIKeyUsage(key.ID, incoming, key.DailyBytes) {
+		return nil, nil, http.StatusTooManyRequests, dailyQuotaMessage(key)
+	}
+	return key, &uploadReservation{keyID: key.ID, limit: key.DailyBytes, reserved: incoming}, 0, ""
+}
 
-	log.Printf("[HTTP流] %s 开始流式下载，文件名: %s, 大小: %d", code, session.FileName, session.Size)
+func dailyQuotaMessage(key *APIKey) string {
+	return fmt.Sprintf("该 API 密钥今日上传额度（%s）已用完", formatBytes(key.DailyBytes))
+}
 
-	// 通知发送端开始传输
-	notifySenderForHTTPDownload(code)
+func writeDailyQuotaExceeded(w http.ResponseWriter, key *APIKey) {
+	http.Error(w, fmt.Sprintf(`{"success":false,"message":"%s"}`, dailyQuotaMessage(key)), http.StatusTooManyRequests)
+}
 
-	// 注意：数据将通过 WebSocket 接收后写入 w
-	// 这里不需要直接返回，连接保持打开直到客户端断开或传输完成
+// authorizeUpload 校验请求中的 API 密钥，未通过时写入错误并返回 false。调用方需在上传成功后
+// commit 预留记录，并用 defer release 在失败时退回额度
+func authorizeUpload(w http.ResponseWriter, r *http.Request, fileSize, incoming int64) (*APIKey, *uploadReservation, bool) {
+	raw, key := requestAPIKey(r)
+	key, reservation, status, message := authorizeUploadKey(raw, key, fileSize, incoming)
+	if status != 0 {
+		http.Error(w, fmt.Sprintf(`{"success":false,"message":"%s"}`, message), status)
+		return nil, nil, false
+	}
+	return key, reservation, true
 }
 
-var startTime time.Time
+// apiKeyMaxFileSize 返回流式上传时允许读取的最大字节数
+func apiKeyMaxFileSize(key *APIKey) int64 {
+	if key != nil && key.MaxFileSize > 0 && key.MaxFileSize < maxFileSize {
+		return key.MaxFileSize
+	}
+	return maxFileSize
+}
 
-// ==================== 主函数 ====================
-func main() {
-	startTime = time.Now()
+// apiKeyUsageFlushRoutine 定期把内存中的密钥用量写回配置文件
+func apiKeyUsageFlushRoutine() {
+	ticker := time.NewTicker(apiKeyUsageFlushInterval)
+	defer ticker.Stop()
 
-	// 命令行参数
-	for i := 1; i < len(os.Args); i++ {
-		if os.Args[i] == "--reset" || os.Args[i] == "-r" {
-			resetConfig()
-			return
+	for range ticker.C {
+		apiKeyUsageMu.Lock()
+		dirty := apiKeyUsageDirty
+		apiKeyUsageMu.Unlock()
+		if dirty {
+			saveConfig()
 		}
 	}
+}
 
-	// 路由
-	http.HandleFunc("/", staticHandler)
-	http.HandleFunc("/upload", staticHandler)
-	http.HandleFunc("/receive", staticHandler)
-	http.HandleFunc("/admin", staticHandler)
+// codeLimitKey 返回取件码查找限制的计数对象：带 download 权限的 API 密钥按密钥计数，否则按来源 IP
+func codeLimitKey(r *http.Request) string {
+	if _, key := requestAPIKey(r); key != nil && key.HasScope(scopeDownload) {
+		return "api-key:" + key.ID
+	}
+	return clientIP(r)
+}
 
-	// API
-	http.HandleFunc("/api/upload-file", uploadFileHandler)
-	http.HandleFunc("/api/upload-chunk", handleChunkUpload)
-	http.HandleFunc("/api/merge-chunks", handleMergeChunks)
-	http.HandleFunc("/api/download-stored/", downloadStoredHandler)
-	http.HandleFunc("/api/download/", downloadStreamHandler) // HTTP 流下载
-	http.HandleFunc("/api/features", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":       true,
-			"features":      config.Features,
-			"storageConfig": config.StorageConfig,
-			"theme":         config.Theme,
-		})
-	})
-	http.HandleFunc("/api/stored-file/", func(w http.ResponseWriter, r *http.Request) {
-		code := filepath.Base(r.URL.Path)
-		storedFilesMu.RLock()
-		file, exists := storedFiles[code]
-		if !exists {
-			storedFilesMu.RUnlock()
-			http.Error(w, `{"success":false,"message":"取件码无效或文件已过期"}`, http.StatusNotFound)
-			return
-		}
-		storedFilesMu.RUnlock()
+// apiKeyAdminUser 把带管理权限的 API 密钥映射为虚拟账户：admin-write 为 operator，admin-read 为 viewer
+func apiKeyAdminUser(r *http.Request) *AdminUser {
+	_, key := requestAPIKey(r)
+	if key == nil {
+		return nil
+	}
+	role := ""
+	if key.HasScope(scopeAdminWrite) {
+		role = roleOperator
+	} else if key.HasScope(scopeAdminRead) {
+		role = roleViewer
+	}
+	if role == "" {
+		return nil
+	}
+	return &AdminUser{Username: "api-key:" + key.Name, Role: role}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":    true,
-			"pickupCode": code,
-			"fileName":   file.OriginalName,
-			"size":       file.Size,
-			"fileHash":   file.FileHash,
-			"deleteMode": file.DeleteMode,
-		})
-	})
-	http.HandleFunc("/api/pickup-code/", func(w http.ResponseWriter, r *http.Request) {
-		code := filepath.Base(r.URL.Path)
-		if code == "" || code == "pickup-code" {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"message": "取件码不能为空",
-			})
-			return
-		}
+// apiKeyInfo 是返回给管理后台的密钥信息，不包含哈希
+func apiKeyInfo(key *APIKey) map[string]interface{} {
+	apiKeyUsageMu.Lock()
+	defer apiKeyUsageMu.Unlock()
+	info := map[string]interface{}{
+		"id":          key.ID,
+		"name":        key.Name,
+		"scopes":      key.Scopes,
+		"maxFileSize": key.MaxFileSize,
+		"dailyBytes":  key.DailyBytes,
+		"usedToday":   key.usedToday(),
+		"createdBy":   key.CreatedBy,
+		"createdAt":   key.CreatedAt.UnixMilli(),
+	}
+	if !key.LastUsedAt.IsZero() {
+		info["lastUsedAt"] = key.LastUsedAt.UnixMilli()
+	}
+	return info
+}
 
-		activeSessionsMu.RLock()
-		session, sessionExists := activeSessions[code]
-		activeSessionsMu.RUnlock()
-		if sessionExists {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success":    true,
-				"exists":     true,
-				"pickupCode": code,
-				"mode":       session.Mode,
-				"fileName":   session.FileName,
-				"size":       session.Size,
-			})
-			return
-		}
+// ==================== 审计日志 ====================
+// 管理操作和存储文件生命周期事件以 JSON Lines 追加写入 audit.log，每行一个事件：谁（actor）、
+// 何时、来源 IP、动作、取件码和结果。文件超过 auditLogMaxMB 后轮转为 audit.log.1、audit.log.2……
+// 最多保留 auditLogBackups 个。管理后台通过 GET /api/admin/audit 分页、筛选查看。
 
-		storedFilesMu.RLock()
-		file, fileExists := storedFiles[code]
-		storedFilesMu.RUnlock()
-		if fileExists {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success":    true,
-				"exists":     true,
-				"pickupCode": code,
-				"mode":       "storage",
-				"fileName":   file.OriginalName,
-				"size":       file.Size,
-				"fileHash":   file.FileHash,
-				"deleteMode": file.DeleteMode,
-			})
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+
+	auditActorSystem    = "system"    // 后台清理、下载次数达到上限等自动触发的事件
+	auditActorAnonymous = "anonymous" // 未使用 API 密钥的上传和下载
+
+	maxAuditPageSize = 500
+)
+
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	IP         string    `json:"ip,omitempty"`
+	Action     string    `json:"action"`
+	PickupCode string    `json:"pickupCode,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+	auditSize int64
+)
+
+// auditLog 追加一条审计事件，r 为 nil 表示没有对应的请求（如后台清理）；写入失败只记录到运行日志
+func auditLog(r *http.Request, actor, action, pickupCode, outcome, detail string) {
+	event := AuditEvent{
+		Time:       time.Now(),
+		Actor:      actor,
+		Action:     action,
+		PickupCode: pickupCode,
+		Outcome:    outcome,
+		Detail:     detail,
+	}
+	if r != nil {
+		event.IP = clientIP(r)
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[审计] 序列化失败: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := openAuditLogLocked(); err != nil {
+		log.Printf("[审计] 打开日志失败: %v", err)
+		return
+	}
+	limit := int64(config.Security.AuditLogMaxMB) * 1024 * 1024
+	if limit > 0 && auditSize > 0 && auditSize+int64(len(line)) > limit {
+		rotateAuditLogLocked()
+		if err := openAuditLogLocked(); err != nil {
+			log.Printf("[审计] 打开日志失败: %v", err)
 			return
 		}
+	}
+	n, err := auditFile.Write(line)
+	auditSize += int64(n)
+	if err != nil {
+		log.Printf("[审计] 写入失败: %v", err)
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":    true,
-			"exists":     false,
-			"pickupCode": code,
-			"mode":       "",
-		})
-	})
+func openAuditLogLocked() error {
+	if auditFile != nil {
+		return nil
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	auditFile, auditSize = f, info.Size()
+	return nil
+}
 
-	// 健康检查
-	http.HandleFunc("/health", healthHandler)
+// rotateAuditLogLocked 把当前日志依次后移为 .1、.2……，超出保留数量的最旧文件被删除
+func rotateAuditLogLocked() {
+	if auditFile != nil {
+		auditFile.Close()
+		auditFile = nil
+	}
+	backups := config.Security.AuditLogBackups
+	if backups <= 0 {
+		os.Remove(auditLogPath)
+		auditSize = 0
+		return
+	}
+	os.Remove(fmt.Sprintf("%s.%d", auditLogPath, backups))
+	for i := backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", auditLogPath, i), fmt.Sprintf("%s.%d", auditLogPath, i+1))
+	}
+	if err := os.Rename(auditLogPath, auditLogPath+".1"); err != nil && !os.IsNotExist(err) {
+		log.Printf("[审计] 轮转失败: %v", err)
+	}
+	auditSize = 0
+	log.Println("[审计] 日志已轮转")
+}
 
-	// 管理员 API
-	setupAdminRoutes()
+// requestActor 返回上传、下载请求的操作者：使用 API 密钥时为密钥名称，否则为匿名
+func requestActor(r *http.Request) string {
+	if _, key := requestAPIKey(r); key != nil {
+		return "api-key:" + key.Name
+	}
+	return auditActorAnonymous
+}
 
-	// WebSocket
-	http.HandleFunc("/ws", wsHandler)
+// AuditFilter 审计日志查询条件，空字段表示不限制
+type AuditFilter struct {
+	Action     string // 前缀匹配，如 file. 匹配所有文件事件
+	Actor      string
+	PickupCode string
+	Outcome    string
+	Since      time.Time
+	Until      time.Time
+}
 
-	// 静态文件目录
-	http.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(uploadDir))))
+func (f AuditFilter) match(event *AuditEvent) bool {
+	return (f.Action == "" || strings.HasPrefix(event.Action, f.Action)) &&
+		(f.Actor == "" || strings.EqualFold(event.Actor, f.Actor)) &&
+		(f.PickupCode == "" || event.PickupCode == f.PickupCode) &&
+		(f.Outcome == "" || event.Outcome == f.Outcome) &&
+		(f.Since.IsZero() || !event.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || event.Time.Before(f.Until))
+}
 
-	port := getEnvOrDefault("PORT", "3000")
-	log.Printf("🚀 File-Rocket 服务器启动成功!")
-	log.Printf("📍 访问地址: http://localhost:%s", port)
-	log.Printf("🔐 管理后台: 点击首页版权文字 4 次")
+// queryAuditLog 按条件查询审计事件（含已轮转的文件），按时间倒序返回第 page 页和匹配总数
+// auditSegment 是查询时打开的一个日志文件及当时的大小
+type auditSegment struct {
+	file *os.File
+	size int64
+}
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+// openAuditSegments 在 auditMu 下打开全部日志文件并记录大小，从最旧的轮转文件到当前文件排列。
+// 之后的读取不需要持锁：已打开的文件在轮转改名或删除后仍可读取，只读到记录的大小则不会读到之后追加的事件
+func openAuditSegments() ([]auditSegment, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	paths := []string{}
+	for i := config.Security.AuditLogBackups; i >= 1; i-- {
+		paths = append(paths, fmt.Sprintf("%s.%d", auditLogPath, i))
 	}
-}
+	paths = append(paths, auditLogPath)
 
-func getEnvOrDefault(key, defaultVal string) string {
-	if val := os.Getenv(key); val != "" {
-		return val
+	var segments []auditSegment
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			closeAuditSegments(segments)
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			closeAuditSegments(segments)
+			return nil, err
+		}
+		segments = append(segments, auditSegment{file: f, size: info.Size()})
 	}
-	return defaultVal
+	return segments, nil
 }
 
-func resetConfig() {
-	config := getDefaultConfig()
-	data, _ := json.MarshalIndent(config, "", "  ")
-	os.WriteFile(configPath, data, 0644)
-	log.Println("配置已重置为默认值")
+func closeAuditSegments(segments []auditSegment) {
+	for _, segment := range segments {
+		segment.file.Close()
+	}
 }
 
-// ==================== WebSocket 处理器 ====================
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func queryAuditLog(filter AuditFilter, page, pageSize int) ([]AuditEvent, int, error) {
+	segments, err := openAuditSegments()
 	if err != nil {
-		log.Printf("[WS] 建立连接失败: %v", err)
-		return
+		return nil, 0, err
+	}
+	defer closeAuditSegments(segments)
+
+	// 从最旧的轮转文件读到当前文件，保证事件按时间顺序
+	var matched []AuditEvent
+	for _, segment := range segments {
+		scanner := bufio.NewScanner(io.LimitReader(segment.file, segment.size))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event AuditEvent
+			if json.Unmarshal(scanner.Bytes(), &event) != nil {
+				continue
+			}
+			if filter.match(&event) {
+				matched = append(matched, event)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, 0, err
+		}
 	}
 
-	socketID := generateToken()[:8]
-	log.Printf("[WS] 新连接: %s", socketID)
-
-	client := &WSClient{
-		conn:     conn,
-		socketID: socketID,
-		send:     make(chan OutgoingMessage, 256),
+	total := len(matched)
+	end := total - (page-1)*pageSize
+	if end <= 0 {
+		return []AuditEvent{}, total, nil
+	}
+	start := max(end-pageSize, 0)
+	events := make([]AuditEvent, 0, end-start)
+	for i := end - 1; i >= start; i-- {
+		events = append(events, matched[i])
 	}
+	return events, total, nil
+}
 
-	wsClientsMu.Lock()
-	wsClients[socketID] = client
-	wsClientsMu.Unlock()
+// ==================== 内容策略 ====================
+// storageConfig.contentPolicy 按扩展名和文件开头字节检测出的 MIME 类型限制上传：
+// 普通上传、PUT、多文件包和 tus 在写盘前检查；分块上传在收到第 0 块时和合并前各检查一次；
+// 内存流式和 P2P 会话在 create-session 时按文件名、浏览器声明的类型和发送端提供的开头字节检查。
+// 启用策略后不接受端到端加密上传，因为服务器无法检查密文的真实类型。
+
+const contentSniffLen = 4096 // 检测类型时读取的开头字节数，足以覆盖 ZIP 容器中前几个条目的文件名
+
+// magicSignatures 是 http.DetectContentType 不认识的可执行文件和容器格式，按顺序匹配
+var magicSignatures = []struct {
+	prefix string
+	mime   string
+}{
+	{"MZ", "application/vnd.microsoft.portable-executable"},
+	{"\x7fELF", "application/x-elf"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xca\xfe\xba\xbe", "application/x-mach-binary"}, // Mach-O 通用二进制，Java class 文件开头相同
+	{"dex\n", "application/vnd.android.dex"},
+	{"#!", "text/x-shellscript"},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"}, // 旧版 Office 文档（doc/xls/ppt）和 msi
+}
 
-	go client.writePump()
-	go client.readPump()
+// zipSubtypes 按 ZIP 中出现的条目名区分基于 ZIP 的格式
+var zipSubtypes = []struct {
+	entry string
+	mime  string
+}{
+	{"AndroidManifest.xml", "application/vnd.android.package-archive"},
+	{"META-INF/MANIFEST.MF", "application/java-archive"},
+	{"word/", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	{"xl/", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+	{"ppt/", "application/vnd.openxmlformats-officedocument.presentationml.presentation"},
 }
 
-type WSClient struct {
-	conn            *websocket.Conn
-	socketID        string
-	send            chan OutgoingMessage
-	UploadingFileID string // 跟踪正在进行的分块上传，用于断开时清理
+// PolicyViolation 表示上传的文件违反了内容策略
+type PolicyViolation struct {
+	Reason string
 }
 
-type OutgoingMessage struct {
-	MessageType int
-	Data        []byte
+func (e *PolicyViolation) Error() string {
+	return "文件类型不允许上传：" + e.Reason
 }
 
-func (c *WSClient) readPump() {
-	defer func() {
-		log.Printf("[WS] 断开连接: %s", c.socketID)
-		wsClientsMu.Lock()
-		delete(wsClients, c.socketID)
-		wsClientsMu.Unlock()
-		c.conn.Close()
-		cleanupSession(c.socketID)
+func contentPolicyActive() bool {
+	policy := config.StorageConfig.ContentPolicy
+	return len(policy.AllowedExtensions) > 0 || len(policy.DeniedExtensions) > 0 ||
+		len(policy.AllowedMIMETypes) > 0 || len(policy.DeniedMIMETypes) > 0
+}
 
-		// 清理未完成的分块上传
-		if c.UploadingFileID != "" {
-			chunkDir := filepath.Join(uploadDir, "chunks", c.UploadingFileID)
-			if _, err := os.Stat(chunkDir); err == nil {
-				os.RemoveAll(chunkDir)
-				log.Printf("[清理] 删除未完成的分块上传: %s", c.UploadingFileID)
+// detectContentType 根据开头字节检测 MIME 类型（不含参数）
+func detectContentType(head []byte) string {
+	if len(head) > contentSniffLen {
+		head = head[:contentSniffLen]
+	}
+	for _, sig := range magicSignatures {
+		if bytes.HasPrefix(head, []byte(sig.prefix)) {
+			return sig.mime
+		}
+	}
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) && len(head) >= 30 {
+		// OpenDocument 的第一个条目是未压缩的 mimetype 文件，内容即 MIME 类型
+		nameLen := int(binary.LittleEndian.Uint16(head[26:28]))
+		extraLen := int(binary.LittleEndian.Uint16(head[28:30]))
+		dataLen := int(binary.LittleEndian.Uint32(head[18:22]))
+		if string(head[30:min(30+nameLen, len(head))]) == "mimetype" {
+			dataStart := 30 + nameLen + extraLen
+			if dataLen > 0 && dataLen < 100 && dataStart+dataLen <= len(head) {
+				if mimeType := string(head[dataStart : dataStart+dataLen]); strings.HasPrefix(mimeType, "application/") {
+					return mimeType
+				}
 			}
 		}
-	}()
-
-	c.conn.SetReadLimit(maxFileSize)
-	c.conn.SetReadDeadline(time.Now().Add(time.Duration(config.Security.SessionTimeout) * time.Millisecond))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(time.Duration(config.Security.SessionTimeout) * time.Millisecond))
-		return nil
-	})
-
-	for {
-		messageType, message, err := c.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("[WS] 读取错误: %v", err)
+		for _, subtype := range zipSubtypes {
+			if bytes.Contains(head, []byte(subtype.entry)) {
+				return subtype.mime
 			}
-			break
 		}
+		return "application/zip"
+	}
+	mimeType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return strings.TrimSpace(mimeType)
+}
 
-		if messageType == websocket.BinaryMessage {
-			c.handleBinaryChunk(message)
+// sniffStream 读取 src 开头的字节用于类型检测，返回的 reader 仍能从头读出全部内容；
+// 读取错误留给后续读取时返回
+func sniffStream(src io.Reader) (io.Reader, []byte) {
+	reader := bufio.NewReaderSize(src, contentSniffLen)
+	head, _ := reader.Peek(contentSniffLen)
+	return reader, head
+}
+
+// readFileHead 读取本地暂存文件（明文）开头的字节
+func readFileHead(localPath string) ([]byte, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, contentSniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+func matchesExtension(name string, extensions []string) bool {
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
 			continue
 		}
-		if messageType != websocket.TextMessage {
-			continue
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
 		}
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
 
-		var wsMsg WSMessage
-		if err := json.Unmarshal(message, &wsMsg); err != nil {
-			log.Printf("[WS] 消息解析错误: %v", err)
-			continue
+func matchesMIMEType(mimeType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+		} else if pattern == mimeType {
+			return true
 		}
+	}
+	return false
+}
 
-		c.handleMessage(wsMsg)
+// checkContentPolicy 检查文件名和检测出的 MIME 类型，name 或 mimeType 为空时跳过对应检查
+func checkContentPolicy(name, mimeType string) error {
+	policy := config.StorageConfig.ContentPolicy
+	if name != "" {
+		// Windows 会忽略文件名末尾的点和空格，evil.exe. 与 evil.exe 等价
+		lower := strings.TrimRight(strings.ToLower(name), ". ")
+		if matchesExtension(lower, policy.DeniedExtensions) {
+			return &PolicyViolation{Reason: fmt.Sprintf("扩展名被禁止（%s）", name)}
+		}
+		if len(policy.AllowedExtensions) > 0 && !matchesExtension(lower, policy.AllowedExtensions) {
+			return &PolicyViolation{Reason: fmt.Sprintf("只允许 %s（%s）", strings.Join(policy.AllowedExtensions, "、"), name)}
+		}
+	}
+	if mimeType != "" {
+		mimeType = strings.ToLower(mimeType)
+		if matchesMIMEType(mimeType, policy.DeniedMIMETypes) {
+			return &PolicyViolation{Reason: fmt.Sprintf("文件内容类型 %s 被禁止", mimeType)}
+		}
+		if len(policy.AllowedMIMETypes) > 0 && !matchesMIMEType(mimeType, policy.AllowedMIMETypes) {
+			return &PolicyViolation{Reason: fmt.Sprintf("文件内容类型 %s 不在允许列表中", mimeType)}
+		}
 	}
+	return nil
 }
 
-func (c *WSClient) writePump() {
-	ticker := time.NewTicker(60 * time.Second)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
+// checkUploadContent 检查文件名和开头字节，未启用策略时直接通过
+func checkUploadContent(name string, head []byte) error {
+	if !contentPolicyActive() {
+		return nil
+	}
+	return checkContentPolicy(name, detectContentType(head))
+}
 
-	for {
-		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+// writePolicyViolation 返回 415 和 CONTENT_POLICY 错误码，客户端据此停止重试
+func writePolicyViolation(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("[内容策略] 拒绝上传 (%s): %v", clientIP(r), err)
+	auditLog(r, requestActor(r), "file.create", "", auditFailure, err.Error())
+	message, _ := json.Marshal(err.Error())
+	http.Error(w, fmt.Sprintf(`{"success":false,"code":"CONTENT_POLICY","message":%s}`, message), http.StatusUnsupportedMediaType)
+}
 
-			if err := c.conn.WriteMessage(message.MessageType, message.Data); err != nil {
-				return
-			}
+// ==================== 恶意文件扫描 ====================
+// 文件写入存储之后、登记取件码之前由 publishStoredFile 交给扫描器检查。发现病毒的文件不发放取件码，
+// 记录进入隔离区（quarantinedFiles），只在管理后台的文件列表中可见，由管理员删除或随保留期过期清理。
+// 扫描器连接失败或超时时，scanner.failOpen 决定放行还是拒绝上传（默认拒绝）。
+// 端到端加密的文件服务器只有密文，无法扫描，直接发布。
 
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
-			}
-		}
+// Scanner 检查文件内容，发现病毒时返回病毒名称，无法完成扫描时返回错误
+type Scanner interface {
+	Scan(src io.Reader) (signature string, err error)
+}
+
+var (
+	fileScanner Scanner // 为 nil 表示未启用扫描
+
+	errScannerUnavailable = errors.New("文件安全扫描暂不可用，请稍后重试")
+)
+
+// InfectedError 表示文件未通过扫描，文件已被隔离
+type InfectedError struct {
+	Signature string
+}
+
+func (e *InfectedError) Error() string {
+	return "文件未通过安全扫描: " + e.Signature
+}
+
+func newScanner(cfg ScannerConfig) (Scanner, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "clamd":
+		return newClamdScanner(cfg.Address, time.Duration(cfg.TimeoutSeconds)*time.Second)
+	default:
+		return nil, fmt.Errorf("未知的扫描器: %s", cfg.Type)
 	}
 }
 
-func (c *WSClient) handleMessage(msg WSMessage) {
-	switch msg.Type {
-	case "create-session":
-		c.handleCreateSession(msg)
-	case "join-session":
-		c.handleJoinSession(msg)
-	case "receiver-ready":
-		c.handleReceiverReady(msg)
-	case "receiver-sink-ready":
-		c.handleReceiverSinkReady(msg)
-	case "receiver-fatal":
-		c.handleReceiverFatal(msg)
-	case "signal":
-		c.handleSignal(msg)
-	case "transfer-start":
-		c.handleTransferStart(msg)
-	case "chunk-meta":
-		c.handleChunkMeta(msg)
-	case "chunk-ack":
-		c.handleChunkAck(msg)
-	case "chunk-nack":
-		c.handleChunkNack(msg)
-	case "transfer-end":
-		c.handleTransferEnd(msg)
-	case "transfer-complete":
-		c.handleTransferComplete(msg)
-	case "verify-ok":
-		c.handleVerifyOk(msg)
-	case "verify-fail":
-		c.handleVerifyFail(msg)
-	case "transfer-chunk":
-		c.handleTransferChunk(msg)
-	case "cancel":
-		c.handleCancel(msg)
-	case "heartbeat":
-		c.handleHeartbeat()
-	case "p2p-nat-info":
-		c.handleP2PNATInfo(msg)
-	case "register-chunk-upload":
-		c.handleRegisterChunkUpload(msg)
-	case "chunk-upload-complete":
-		c.handleChunkUploadComplete(msg)
+// allStoredFilesLocked 返回存储文件和隔离文件，用于需要遍历全部 blob 引用的场景
+func allStoredFilesLocked() []*FileSession {
+	files := make([]*FileSession, 0, len(storedFiles)+len(quarantinedFiles))
+	for _, file := range storedFiles {
+		if file != nil {
+			files = append(files, file)
+		}
 	}
+	for _, file := range quarantinedFiles {
+		files = append(files, file)
+	}
+	return files
 }
 
-func (c *WSClient) handleCreateSession(msg WSMessage) {
-	payload := msg.Payload.(map[string]interface{})
-	fileName := payload["fileName"].(string)
-	fileSize := int64(payload["fileSize"].(float64))
-	mode := payload["mode"].(string)
-
-	if !isModeEnabled(mode) {
-		c.sendError("此传输模式已禁用")
-		return
+// scanStoredFile 扫描已写入存储后端的文件（读取解密后的明文），多文件包逐个扫描，
+// 返回的病毒名称带上包内路径
+func scanStoredFile(file *FileSession) (string, error) {
+	if fileScanner == nil || file.E2E {
+		return "", nil
 	}
 
-	pickupCode := generatePickupCode()
-
-	// 确保取件码唯一
-	for {
-		activeSessionsMu.RLock()
-		_, exists := activeSessions[pickupCode]
-		activeSessionsMu.RUnlock()
-		if !exists {
-			break
+	type scanTarget struct {
+		label     string
+		name      string
+		encrypted bool
+		size      int64
+	}
+	var targets []scanTarget
+	if file.IsBundle() {
+		for _, entry := range file.Files {
+			targets = append(targets, scanTarget{entry.Name, entry.FileName, entry.Encrypted, entry.Size})
 		}
-		pickupCode = generatePickupCode()
+	} else {
+		targets = append(targets, scanTarget{"", file.FileName, file.Encrypted, file.Size})
 	}
 
-	// 创建传输通道
-	transferChanMu.Lock()
-	fileTransferChannels[pickupCode] = make(chan []byte, 1024)
-	transferChanMu.Unlock()
-
-	now := time.Now()
-	session := &ActiveSession{
-		SocketID:         c.socketID,
-		PickupCode:       pickupCode,
-		Mode:             mode,
-		FileName:         fileName,
-		Size:             fileSize,
-		CreatedAt:        now,
-		LastActiveAt:     now,
-		IsSender:         true,
-		ExpectedFileHash: "",
-		PendingChunkMeta: make(map[int]map[string]interface{}),
+	for _, target := range targets {
+		if target.size == 0 {
+			continue
+		}
+		src, err := openStoredRange(target.name, target.encrypted, target.size, 0, target.size)
+		if err != nil {
+			return "", err
+		}
+		signature, err := fileScanner.Scan(src)
+		src.Close()
+		if err != nil {
+			return "", err
+		}
+		if signature != "" {
+			if target.label != "" {
+				signature = target.label + ": " + signature
+			}
+			return signature, nil
+		}
 	}
+	return "", nil
+}
 
-	activeSessionsMu.Lock()
-	activeSessions[pickupCode] = session
-	activeSessionsMu.Unlock()
-	recordTransfer()
-
-	c.sendJSON(WSMessage{
-		Type: "session-created",
-		Payload: map[string]interface{}{
-			"pickupCode": pickupCode,
-			"mode":       mode,
-		},
-	})
-
-	log.Printf("[WS] 会话创建: %s (%s) - %s", pickupCode, mode, formatBytes(fileSize))
+// clamdScanner 通过 clamd 的 INSTREAM 命令扫描，文件内容以带长度前缀的数据块发送，
+// 超过 clamd 的 StreamMaxLength 时 clamd 返回错误，按扫描失败处理
+type clamdScanner struct {
+	network string // "tcp" 或 "unix"
+	address string
+	timeout time.Duration
 }
 
-func (c *WSClient) handleJoinSession(msg WSMessage) {
-	payload := msg.Payload.(map[string]interface{})
-	pickupCode := payload["pickupCode"].(string)
-	mode := payload["mode"].(string)
-	capabilities, _ := payload["capabilities"].(map[string]interface{}) // 提取接收端能力
+const clamdChunkSize = 64 * 1024
 
-	codeAttemptsMu.Lock()
-	if codeAttempts[pickupCode] >= config.Security.MaxCodeAttempts {
-		codeAttemptsMu.Unlock()
-		c.sendError("取件码已锁定")
-		return
+func newClamdScanner(address string, timeout time.Duration) (*clamdScanner, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok || addr == "" || (network != "tcp" && network != "unix") {
+		return nil, fmt.Errorf("clamd 地址应为 tcp://主机:端口 或 unix:///套接字路径，当前为 %q", address)
 	}
-	codeAttemptsMu.Unlock()
+	return &clamdScanner{network: network, address: addr, timeout: timeout}, nil
+}
 
-	activeSessionsMu.RLock()
-	session, exists := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
+func (s *clamdScanner) Scan(src io.Reader) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
 
-	if !exists {
-		if !isModeEnabled(mode) {
-			c.sendError("此传输模式已禁用")
-			return
+	// 每次读写前延长期限，大文件只要持续有进展就不会超时
+	send := func(data []byte) error {
+		conn.SetDeadline(time.Now().Add(s.timeout))
+		_, err := conn.Write(data)
+		return err
+	}
+	if err := send([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(src, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if err := send(buf[:4+n]); err != nil {
+				// clamd 拒绝继续接收时会先写回原因再断开
+				if reply, replyErr := s.readReply(conn); replyErr == nil {
+					return "", fmt.Errorf("clamd: %s", reply)
+				}
+				return "", err
+			}
 		}
-
-		storedFilesMu.RLock()
-		file, fileExists := storedFiles[pickupCode]
-		storedFilesMu.RUnlock()
-
-		if !fileExists {
-			codeAttemptsMu.Lock()
-			codeAttempts[pickupCode]++
-			codeAttemptsMu.Unlock()
-			c.sendError("取件码无效")
-			return
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
 		}
-
-		// 服务器存储模式
-		c.sendJSON(WSMessage{
-			Type: "storage-mode",
-			Payload: map[string]interface{}{
-				"pickupCode": pickupCode,
-				"fileName":   file.OriginalName,
-				"size":       file.Size,
-			},
-		})
-		log.Printf("[WS] 存储模式连接: %s", pickupCode)
-		return
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	if err := send([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
 	}
 
-	// 更新会话中的接收者 / 模式回退
-	activeSessionsMu.Lock()
-	if session.ReceiverSocketID == "" {
-		session.ReceiverSocketID = c.socketID
+	reply, err := s.readReply(conn)
+	if err != nil {
+		return "", err
 	}
-	if session.Mode != "" && mode == "memory" && session.Mode == "p2p" {
-		log.Printf("[WS] P2P 会话回退到 memory: %s", pickupCode)
-		session.Mode = "memory"
+	// 回复形如 "stream: OK"、"stream: Eicar-Signature FOUND" 或 "INSTREAM size limit exceeded. ERROR"
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
 	}
-	effectiveMode := session.Mode
-	activeSessionsMu.Unlock()
-
-	// 发送会话信息给接收方
-	c.sendJSON(WSMessage{
-		Type: "session-joined",
-		Payload: map[string]interface{}{
-			"pickupCode": pickupCode,
-			"fileName":   session.FileName,
-			"size":       session.Size,
-			"mode":       effectiveMode,
-		},
-	})
-
-	// 通知发送方
-	sendToSocket(session.SocketID, WSMessage{
-		Type: "receiver-connected",
-		Payload: map[string]interface{}{
-			"capabilities": capabilities,
-		},
-	})
-
-	log.Printf("[WS] 加入会话: %s", pickupCode)
 }
 
-func (c *WSClient) handleReceiverReady(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		return
+// readReply 读取 clamd 以 \0 结尾的回复（z 前缀命令）
+func (s *clamdScanner) readReply(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
 	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
 
-	activeSessionsMu.RLock()
-	session := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-	if session == nil || session.ReceiverSocketID != c.socketID {
-		return
+// ==================== 来源校验 ====================
+// 浏览器跨站发起的 WebSocket 连接和 POST/PUT/DELETE 请求会带上 Origin 头。/ws 升级和 /api/admin/*
+// 的写操作只接受与请求同源（Origin 的协议和主机与访问地址一致）或在 security.allowedOrigins 中的来源，
+// 防止管理员访问的其他网页借用其登录状态。没有 Origin 头的请求（curl、脚本等非浏览器客户端）不受影响。
+
+// normalizeOrigin 把来源规范为小写的 scheme://host[:port]，省略默认端口；无法解析时返回空
+func normalizeOrigin(origin string) string {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
 	}
+	return strings.ToLower(u.Scheme + "://" + stripDefaultPort(u.Host, u.Scheme))
+}
 
-	sendToSocket(session.SocketID, WSMessage{Type: "receiver-ready"})
+func stripDefaultPort(host, scheme string) string {
+	if (scheme == "http" && strings.HasSuffix(host, ":80")) || (scheme == "https" && strings.HasSuffix(host, ":443")) {
+		return host[:strings.LastIndex(host, ":")]
+	}
+	return host
 }
 
-func (c *WSClient) handleReceiverSinkReady(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
+// originAllowed 判断请求的 Origin 是否可信；没有 Origin 头时视为非浏览器请求放行
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
 	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		return
+	normalized := normalizeOrigin(origin)
+	if normalized == "" {
+		return false
 	}
 
-	activeSessionsMu.RLock()
-	session := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-	if session == nil || session.ReceiverSocketID != c.socketID {
-		return
+	// 默认只允许同源：Origin 的协议和主机都要与访问地址一致，
+	// 反向代理后为 X-Forwarded-Proto 和 X-Forwarded-Host 给出的地址
+	for _, requestOrigin := range requestOrigins(r) {
+		if normalizeOrigin(requestOrigin) == normalized {
+			return true
+		}
 	}
 
-	sendToSocket(session.SocketID, WSMessage{
-		Type:    "receiver-sink-ready",
-		Payload: payload,
-	})
+	for _, allowed := range config.Security.AllowedOrigins {
+		if allowed == "*" || normalizeOrigin(allowed) == normalized {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *WSClient) handleReceiverFatal(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		return
+// requestOrigins 返回请求自身的来源：直接访问的协议与 Host，
+// 开启 trustProxy 时还包括代理转发的 X-Forwarded-Proto 与 X-Forwarded-Host（缺少其一时沿用直接访问的值）
+func requestOrigins(r *http.Request) []string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	origins := []string{scheme + "://" + r.Host}
+	if config.Security.TrustProxy {
+		forwardedScheme, forwardedHost := scheme, r.Host
+		if proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ","); strings.TrimSpace(proto) != "" {
+			forwardedScheme = strings.ToLower(strings.TrimSpace(proto))
+		}
+		if host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ","); strings.TrimSpace(host) != "" {
+			forwardedHost = strings.TrimSpace(host)
+		}
+		origins = append(origins, forwardedScheme+"://"+forwardedHost)
 	}
+	return origins
+}
 
-	activeSessionsMu.RLock()
-	session := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-	if session == nil || session.ReceiverSocketID != c.socketID {
-		return
+// rejectDisallowedOrigin 来源不可信时返回 403 并返回 true
+func rejectDisallowedOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if originAllowed(r) {
+		return false
 	}
+	origin := r.Header.Get("Origin")
+	log.Printf("[安全] 拒绝来自 %s 的跨站请求 %s %s (%s)", origin, r.Method, r.URL.Path, clientIP(r))
+	message, _ := json.Marshal(fmt.Sprintf("来源 %s 不在允许列表中，请通过本站地址访问，或在 security.allowedOrigins 中添加该来源", origin))
+	http.Error(w, fmt.Sprintf(`{"success":false,"message":%s}`, message), http.StatusForbidden)
+	return true
+}
 
-	sendToSocket(session.SocketID, WSMessage{
-		Type:    "receiver-fatal",
-		Payload: payload,
+// adminOriginGuard 对 /api/admin/* 的写操作校验来源，查询请求（GET/HEAD/OPTIONS）不受影响
+func adminOriginGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				if rejectDisallowedOrigin(w, r) {
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
-func (c *WSClient) handleSignal(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		return
-	}
+// ==================== 工具函数 ====================
 
-	activeSessionsMu.RLock()
-	session := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-	if session == nil {
-		return
-	}
+// 取件码从生成到登记进 storedFiles 或 activeSessions 之间（保存、归并、扫描可能需要很久）
+// 记在 reservedPickupCodes 中，不会再分配给其它上传；登记或放弃后由 releasePickupCode 移除。
+// 取件码空间较小时（如 4 位数字）重复的概率不可忽略，不预留会让后登记的文件覆盖先登记的
+var (
+	pickupCodeMu        sync.Mutex
+	reservedPickupCodes = make(map[string]bool)
+)
 
-	if c.socketID == session.SocketID && session.ReceiverSocketID != "" {
-		sendToSocket(session.ReceiverSocketID, WSMessage{
-			Type:    "signal",
-			Payload: payload,
-		})
-		return
-	}
+// generateUniquePickupCode 生成未被使用的取件码并预留，调用方登记后需调用 releasePickupCode
+func generateUniquePickupCode() string {
+	pickupCodeMu.Lock()
+	defer pickupCodeMu.Unlock()
+	for {
+		code := generatePickupCode()
+		if reservedPickupCodes[code] {
+			continue
+		}
+		storedFilesMu.RLock()
+		_, inStored := storedFiles[code]
+		if _, quarantined := quarantinedFiles[code]; quarantined {
+			inStored = true
+		}
+		storedFilesMu.RUnlock()
 
-	if c.socketID == session.ReceiverSocketID && session.SocketID != "" {
-		sendToSocket(session.SocketID, WSMessage{
-			Type:    "signal",
-			Payload: payload,
-		})
+		activeSessionsMu.RLock()
+		_, inActive := activeSessions[code]
+		activeSessionsMu.RUnlock()
+
+		if !inStored && !inActive {
+			reservedPickupCodes[code] = true
+			return code
+		}
 	}
 }
 
-func (c *WSClient) handleP2PNATInfo(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		return
+func releasePickupCode(code string) {
+	pickupCodeMu.Lock()
+	delete(reservedPickupCodes, code)
+	pickupCodeMu.Unlock()
+}
+
+var errHashMismatch = errors.New("sha256 mismatch")
+
+// saveUploadedFileAtomicAndHash 保存最终存储的文件，开启静态加密时写入密文，返回明文大小与明文哈希
+func saveUploadedFileAtomicAndHash(src io.Reader, targetPath string) (int64, string, error) {
+	return saveFileAtomic(src, targetPath, "", atRestEncrypt)
+}
+
+// saveUploadedFileAtomicAndVerify 保存分块上传的临时块（明文），expectedHash 非空且不一致时丢弃临时文件并返回 errHashMismatch
+func saveUploadedFileAtomicAndVerify(src io.Reader, targetPath string, expectedHash string) (int64, string, error) {
+	return saveFileAtomic(src, targetPath, expectedHash, false)
+}
+
+// saveFileAtomic 临时写入 + 原子重命名，同时计算明文 SHA-256
+func saveFileAtomic(src io.Reader, targetPath string, expectedHash string, encrypt bool) (int64, string, error) {
+	tmpPath := targetPath + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, "", err
 	}
-	natType, _ := payload["natType"].(map[string]interface{})
-	role, _ := payload["role"].(string)
-	if natType == nil || role == "" {
-		return
+
+	var dst io.Writer = tmpFile
+	var enc *encryptingWriter
+	if encrypt {
+		if enc, err = newEncryptingWriter(tmpFile); err != nil {
+			tmpFile.Close()
+			_ = os.Remove(tmpPath)
+			return 0, "", err
+		}
+		dst = enc
 	}
 
-	activeSessionsMu.Lock()
-	session := activeSessions[pickupCode]
-	if session == nil {
-		activeSessionsMu.Unlock()
-		return
+	hasher := sha256.New()
+	written, copyErr := io.Copy(io.MultiWriter(dst, hasher), src)
+	if copyErr == nil && enc != nil {
+		copyErr = enc.Close()
 	}
+	syncErr := tmpFile.Sync()
+	closeErr := tmpFile.Close()
 
-	if role == "sender" && c.socketID == session.SocketID {
-		session.SenderNAT = natType
-		receiverSocketID := session.ReceiverSocketID
-		activeSessionsMu.Unlock()
-		if receiverSocketID != "" {
-			sendToSocket(receiverSocketID, WSMessage{
-				Type: "p2p-nat-info",
-				Payload: map[string]interface{}{
-					"pickupCode": pickupCode,
-					"natType":    natType,
-					"role":       "sender",
-				},
-			})
-		}
-	} else if role == "receiver" && c.socketID == session.ReceiverSocketID {
-		session.ReceiverNAT = natType
-		senderSocketID := session.SocketID
-		senderNAT := session.SenderNAT
-		activeSessionsMu.Unlock()
-		if senderSocketID != "" {
-			sendToSocket(senderSocketID, WSMessage{
-				Type: "p2p-nat-info",
-				Payload: map[string]interface{}{
-					"pickupCode": pickupCode,
-					"natType":    natType,
-					"role":       "receiver",
-				},
-			})
+	if copyErr != nil || syncErr != nil || closeErr != nil {
+		_ = os.Remove(tmpPath)
+		if copyErr != nil {
+			return 0, "", copyErr
 		}
-		// 补发发送端 NAT 信息给接收端（解决时序竞争）
-		if senderNAT != nil {
-			sendToSocket(c.socketID, WSMessage{
-				Type: "p2p-nat-info",
-				Payload: map[string]interface{}{
-					"pickupCode": pickupCode,
-					"natType":    senderNAT,
-					"role":       "sender",
-				},
-			})
+		if syncErr != nil {
+			return 0, "", syncErr
 		}
-	} else {
-		activeSessionsMu.Unlock()
+		return 0, "", closeErr
 	}
-}
 
-func (c *WSClient) handleRegisterChunkUpload(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-	fileID, _ := payload["fileID"].(string)
-	if fileID == "" {
-		return
+	fileHash := hex.EncodeToString(hasher.Sum(nil))
+	if expectedHash != "" && expectedHash != fileHash {
+		_ = os.Remove(tmpPath)
+		return written, fileHash, errHashMismatch
 	}
 
-	c.UploadingFileID = fileID
-	log.Printf("[分块上传] 注册上传会话: %s -> %s", c.socketID, fileID)
+	if err := os.Rename(tmpPath, targetPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return 0, "", err
+	}
 
-	c.sendJSON(WSMessage{
-		Type: "chunk-upload-registered",
-		Payload: map[string]interface{}{
-			"fileID": fileID,
-		},
-	})
+	return written, fileHash, nil
 }
 
-func (c *WSClient) handleChunkUploadComplete(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
+func computeStoredSHA256(name string) (string, error) {
+	f, err := storageBackend.Get(name)
+	if err != nil {
+		return "", err
 	}
-	fileID, _ := payload["fileID"].(string)
+	defer f.Close()
 
-	if c.UploadingFileID == fileID || fileID == "" {
-		log.Printf("[分块上传] 上传完成，清除跟踪: %s -> %s", c.socketID, c.UploadingFileID)
-		c.UploadingFileID = ""
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func (c *WSClient) getSessionBySocketID(socketID string) (string, *ActiveSession, bool) {
-	activeSessionsMu.RLock()
-	defer activeSessionsMu.RUnlock()
-	for code, session := range activeSessions {
-		if session == nil {
-			continue
-		}
-		if session.SocketID == socketID || session.ReceiverSocketID == socketID {
-			return code, session, true
-		}
+func isSHA256Hex(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
 	}
-	return "", nil, false
+	_, err := hex.DecodeString(s)
+	return err == nil
 }
 
-func (c *WSClient) getSessionBySenderSocket() (string, *ActiveSession) {
-	activeSessionsMu.RLock()
-	defer activeSessionsMu.RUnlock()
-	for code, session := range activeSessions {
-		if session != nil && session.SocketID == c.socketID {
-			return code, session
-		}
-	}
-	return "", nil
+func generateToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-func (c *WSClient) handleTransferStart(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		pickupCode, _ = c.getSessionBySenderSocket()
-	}
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
 
-	activeSessionsMu.Lock()
-	session := activeSessions[pickupCode]
-	if session == nil || session.SocketID != c.socketID || session.ReceiverSocketID == "" {
-		activeSessionsMu.Unlock()
-		return
+func formatBytes(bytes int64) string {
+	if bytes == 0 {
+		return "0 B"
 	}
-	if fileHash, ok := payload["fileHash"].(string); ok {
-		session.ExpectedFileHash = strings.ToLower(strings.TrimSpace(fileHash))
+	sizes := []string{"B", "KB", "MB", "GB", "TB"}
+	i := int(math.Log(float64(bytes)) / math.Log(1024))
+	return fmt.Sprintf("%.2f %s", float64(bytes)/math.Pow(1024, float64(i)), sizes[i])
+}
+
+func normalizeTodayLocked() {
+	today := time.Now().Format("2006-01-02")
+	if config.Stats.TodayDate != today {
+		config.Stats.TodayDate = today
+		config.Stats.TodayTransfers = 0
 	}
-	receiverSocketID := session.ReceiverSocketID
-	activeSessionsMu.Unlock()
+}
 
-	sendToSocket(receiverSocketID, msg)
+func recordTransfer() {
+	statsMu.Lock()
+	normalizeTodayLocked()
+	config.Stats.TotalTransfers++
+	config.Stats.TodayTransfers++
+	statsMu.Unlock()
+	saveConfig()
 }
 
-func (c *WSClient) handleChunkMeta(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		pickupCode, _ = c.getSessionBySenderSocket()
+func getStatsSnapshot() AdminStats {
+	statsMu.Lock()
+	normalizeTodayLocked()
+	snapshot := config.Stats
+	statsMu.Unlock()
+	return snapshot
+}
+
+func cleanPath(path string) string {
+	// 移除 .html 后缀
+	path = strings.TrimSuffix(path, ".html")
+	// 确保以 / 开头
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
 	}
+	return path
+}
 
-	activeSessionsMu.Lock()
-	session := activeSessions[pickupCode]
-	if session == nil || session.SocketID != c.socketID || session.ReceiverSocketID == "" {
-		activeSessionsMu.Unlock()
-		return
+// checkUploadDirPrivate 拒绝把上传目录放在 public 目录内。blob 按内容哈希命名，位置可以预测，
+// 放在静态目录中会绕过下载接口的全部校验直接被下载
+func checkUploadDirPrivate(dir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
 	}
-	if session.PendingChunkMeta == nil {
-		session.PendingChunkMeta = make(map[int]map[string]interface{})
+	absPublic, err := filepath.Abs("./public")
+	if err != nil {
+		return err
 	}
-	chunkIndexFloat, ok := payload["chunkIndex"].(float64)
-	if !ok {
-		activeSessionsMu.Unlock()
-		return
+	rel, err := filepath.Rel(absPublic, absDir)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("上传目录 %s 位于 public 目录内，会被当作静态文件公开，请改用其他目录", dir)
 	}
-	chunkIndex := int(chunkIndexFloat)
-	session.PendingChunkMeta[chunkIndex] = payload
-	receiverSocketID := session.ReceiverSocketID
-	activeSessionsMu.Unlock()
-
-	sendToSocket(receiverSocketID, msg)
+	return nil
 }
 
-func (c *WSClient) handleChunkAck(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
+// ==================== HTTP 处理器 ====================
+// 注意：API 路由使用 ServeMux 自动匹配，无需在此处理
+// Go 1.22+ 会进行最长路径匹配，/api/features 会优先于 / 匹配
+func staticHandler(w http.ResponseWriter, r *http.Request) {
+	path := cleanPath(r.URL.Path)
+
+	// 根路径
+	if path == "/" {
+		http.ServeFile(w, r, "./public/index.html")
 		return
 	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		pickupCode, session, exists := c.getSessionBySocketID(c.socketID)
-		if !exists || session == nil {
+
+	// 静态文件 - 先尝试直接路径，再尝试 .html 后缀
+	filePath := "./public" + path
+
+	// 检查直接路径（目录）
+	if strings.HasSuffix(path, "/") {
+		if _, err := os.Stat(filePath); err == nil {
+			http.ServeFile(w, r, filePath+"index.html")
 			return
 		}
-		_ = pickupCode
 	}
 
-	activeSessionsMu.Lock()
-	session := activeSessions[pickupCode]
-	if session == nil || session.ReceiverSocketID != c.socketID || session.SocketID == "" {
-		activeSessionsMu.Unlock()
+	// 检查直接路径（文件）
+	if _, err := os.Stat(filePath); err == nil {
+		http.ServeFile(w, r, filePath)
 		return
 	}
-	chunkIndexFloat, hasChunkIndex := payload["chunkIndex"].(float64)
-	if hasChunkIndex && session.PendingChunkMeta != nil {
-		delete(session.PendingChunkMeta, int(chunkIndexFloat))
-	}
-	senderSocketID := session.SocketID
-	receiverSocketID := session.ReceiverSocketID
-	shouldFlushEnd := session.PendingTransferEnd && len(session.PendingChunkMeta) == 0
-	endPayload := session.TransferEndPayload
-	if shouldFlushEnd {
-		session.PendingTransferEnd = false
-		session.TransferEndPayload = nil
+
+	// 尝试添加 .html 后缀
+	htmlPath := filePath + ".html"
+	if _, err := os.Stat(htmlPath); err == nil {
+		http.ServeFile(w, r, htmlPath)
+		return
 	}
-	activeSessionsMu.Unlock()
 
-	sendToSocket(senderSocketID, msg)
-	if shouldFlushEnd {
-		sendToSocket(receiverSocketID, WSMessage{Type: "transfer-end", Payload: endPayload})
+	// 自定义 404 页面
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	notFoundPage, err := os.ReadFile("./public/404.html")
+	if err != nil {
+		w.Write([]byte("404 page not found"))
+		return
 	}
+	w.Write(notFoundPage)
 }
 
-func (c *WSClient) handleChunkNack(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
+// ==================== API 处理器 ====================
+
+// multipartOverhead 是表单上传中文件以外的部分（分隔符、其他字段）允许的大小
+const multipartOverhead int64 = 64 * 1024
+
+// 上传文件
+func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Features.ServerStorage {
+		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
 		return
 	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		pickupCode, session, exists := c.getSessionBySocketID(c.socketID)
-		if !exists || session == nil {
-			return
-		}
-		_ = pickupCode
+
+	// 解析表单会把请求体写入临时文件，先按 Content-Length 校验 API 密钥、单文件上限并预留额度，
+	// 无权上传的请求不必读取请求体。Content-Length 含表单开销，扣除后作为文件大小的估计，
+	// 实际大小在解析后再检查一次
+	declared := max(r.ContentLength-multipartOverhead, 0)
+	apiKey, reservation, ok := authorizeUpload(w, r, declared, declared)
+	if !ok {
+		return
 	}
+	defer reservation.release()
+	r.Body = http.MaxBytesReader(w, r.Body, apiKeyMaxFileSize(apiKey)+multipartOverhead)
 
-	activeSessionsMu.RLock()
-	session := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-	if session == nil || session.ReceiverSocketID != c.socketID || session.SocketID == "" {
+	if err := r.ParseMultipartForm(maxFileSize); err != nil {
+		http.Error(w, `{"success":false,"message":"文件过大"}`, http.StatusBadRequest)
 		return
 	}
 
-	sendToSocket(session.SocketID, WSMessage{
-		Type:    "chunk-nack",
-		Payload: payload,
-	})
-}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"无法读取文件"}`, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
 
-func (c *WSClient) handleTransferEnd(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
+	if header.Size > apiKeyMaxFileSize(apiKey) {
+		http.Error(w, `{"success":false,"message":"文件过大"}`, http.StatusRequestEntityTooLarge)
 		return
 	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		pickupCode, _ = c.getSessionBySenderSocket()
+	if !reservation.resize(header.Size) {
+		writeDailyQuotaExceeded(w, apiKey)
+		return
 	}
 
-	activeSessionsMu.Lock()
-	session := activeSessions[pickupCode]
-	if session == nil {
-		activeSessionsMu.Unlock()
+	passwordHash, err := hashDownloadPassword(r.FormValue("password"))
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"下载密码无效"}`, http.StatusBadRequest)
 		return
 	}
-
-	// 检查是否是 HTTP 流下载模式
-	isHTTPStream := session.DownloadResponse != nil
-
-	// 如果是 HTTP 流模式且没有接收端，结束传输
-	if isHTTPStream && session.ReceiverSocketID == "" {
-		// 关闭 HTTP 响应
-		if h, ok := session.DownloadResponse.(http.Hijacker); ok {
-			h.Hijack()
-		}
-		session.DownloadResponse = nil
-		session.DownloadFlusher = nil
-		log.Printf("[HTTP流] %s 传输完成，关闭连接", pickupCode)
-		activeSessionsMu.Unlock()
+	maxDownloads, err := parseMaxDownloads(r.FormValue("maxDownloads"))
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"下载次数上限无效"}`, http.StatusBadRequest)
 		return
 	}
 
-	if session.SocketID != c.socketID || session.ReceiverSocketID == "" {
-		activeSessionsMu.Unlock()
+	// 检查存储空间（优先按声明大小预判）
+	usedSpace := getUsedStorage()
+	if msg := storageQuotaError(usedSpace, header.Size); msg != "" {
+		http.Error(w, fmt.Sprintf(`{"success":false,"message":"%s"}`, msg), http.StatusForbidden)
 		return
 	}
-	receiverSocketID := session.ReceiverSocketID
-	pendingCount := len(session.PendingChunkMeta)
-	if pendingCount > 0 {
-		session.PendingTransferEnd = true
-		session.TransferEndPayload = payload
-	}
-	activeSessionsMu.Unlock()
 
-	if pendingCount > 0 {
-		log.Printf("[WS] transfer-end 延迟转发，仍有 %d 个分块未ACK: %s", pendingCount, pickupCode)
+	src, head := sniffStream(file)
+	if err := checkUploadContent(header.Filename, head); err != nil {
+		writePolicyViolation(w, r, err)
 		return
 	}
 
-	sendToSocket(receiverSocketID, msg)
-}
+	// 生成唯一文件名
+	uniqueName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), sanitizeFilename(header.Filename))
 
-func (c *WSClient) handleTransferChunk(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
+	// 临时写入 + 原子重命名 + 计算哈希
+	filePath := filepath.Join(uploadDir, uniqueName)
+	written, fileHash, err := saveUploadedFileAtomicAndHash(src, filePath)
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"写入文件失败"}`, http.StatusInternalServerError)
 		return
 	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
-		pickupCode, _ = c.getSessionBySenderSocket()
+
+	if exceedsStorageQuota(usedSpace, written, fileHash) {
+		_ = os.Remove(filePath)
+		http.Error(w, `{"success":false,"message":"存储空间不足"}`, http.StatusForbidden)
+		return
 	}
 
-	activeSessionsMu.RLock()
-	session := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-	if session == nil || session.SocketID != c.socketID || session.ReceiverSocketID == "" {
+	// 保存会话
+	stored := newStoredFileSession(generateUniquePickupCode(), uniqueName, header.Filename, written, fileHash)
+	stored.PasswordHash = passwordHash
+	stored.MaxDownloads = maxDownloads
+	if err := publishStoredFile(stored); err != nil {
+		writePublishError(w, r, stored, err)
 		return
 	}
+	auditLog(r, requestActor(r), "file.create", stored.PickupCode, auditSuccess, stored.OriginalName)
+	reservation.commit(written)
 
-	sendToSocket(session.ReceiverSocketID, msg)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(storedFileUploadResponse(stored))
 }
 
-func (c *WSClient) handleTransferComplete(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
+// 流式上传（PUT /api/upload/<文件名>），请求体直接写盘，便于 curl -T 和 CI 脚本使用
+func putUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Features.ServerStorage {
+		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
 		return
 	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
+
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
 		return
 	}
 
-	activeSessionsMu.RLock()
-	session := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-	if session == nil {
+	originalName, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/upload/"))
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"文件名无效"}`, http.StatusBadRequest)
 		return
 	}
-
-	if c.socketID == session.ReceiverSocketID {
-		sendToSocket(session.SocketID, WSMessage{Type: "transfer-complete"})
+	originalName = filepath.Base(strings.ReplaceAll(originalName, "\\", "/"))
+	if originalName == "" || originalName == "." || originalName == "/" {
+		http.Error(w, `{"success":false,"message":"文件名不能为空"}`, http.StatusBadRequest)
+		return
 	}
-}
 
-func (c *WSClient) handleVerifyOk(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
+	// 按 Content-Length 预判大小和存储空间，避免接收完才拒绝
+	if r.ContentLength > maxFileSize {
+		http.Error(w, `{"success":false,"message":"文件过大"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+	apiKey, reservation, ok := authorizeUpload(w, r, r.ContentLength, r.ContentLength)
 	if !ok {
 		return
 	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
+	defer reservation.release()
+	usedSpace := getUsedStorage()
+	if msg := storageQuotaError(usedSpace, r.ContentLength); msg != "" {
+		http.Error(w, fmt.Sprintf(`{"success":false,"message":"%s"}`, msg), http.StatusForbidden)
 		return
 	}
-	actualHash := strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", payload["actualHash"])))
-
-	activeSessionsMu.RLock()
-	session := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-	if session == nil || c.socketID != session.ReceiverSocketID {
+	passwordHash, err := hashDownloadPassword(r.Header.Get("X-Download-Password"))
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"下载密码无效"}`, http.StatusBadRequest)
+		return
+	}
+	maxDownloads, err := parseMaxDownloads(r.Header.Get("X-Max-Downloads"))
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"下载次数上限无效"}`, http.StatusBadRequest)
 		return
 	}
 
-	expectedHash := strings.ToLower(strings.TrimSpace(session.ExpectedFileHash))
-	if expectedHash != "" && actualHash != "" && expectedHash != actualHash {
-		sendToSocket(session.SocketID, WSMessage{
-			Type: "verify-fail",
-			Payload: map[string]interface{}{
-				"pickupCode": pickupCode,
-				"reason":     fmt.Sprintf("接收端校验值与发送端期望不一致: expected=%s actual=%s", expectedHash, actualHash),
-			},
-		})
+	// Content-Length 未知时（分块传输编码）预留为 0，读取过程中按实际字节数预留额度
+	body, head := sniffStream(reservation.reader(http.MaxBytesReader(w, r.Body, apiKeyMaxFileSize(apiKey))))
+	if err := checkUploadContent(originalName, head); err != nil {
+		writePolicyViolation(w, r, err)
 		return
 	}
 
-	sendToSocket(session.SocketID, WSMessage{
-		Type: "verify-ok",
-		Payload: map[string]interface{}{
-			"pickupCode": pickupCode,
-			"actualHash": actualHash,
-		},
-	})
-}
+	uniqueName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), sanitizeFilename(originalName))
+	filePath := filepath.Join(uploadDir, uniqueName)
+	written, fileHash, err := saveUploadedFileAtomicAndHash(body, filePath)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, `{"success":false,"message":"文件过大"}`, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errDailyQuotaExceeded) {
+			writeDailyQuotaExceeded(w, apiKey)
+			return
+		}
+		http.Error(w, `{"success":false,"message":"写入文件失败"}`, http.StatusInternalServerError)
+		return
+	}
 
-func (c *WSClient) handleVerifyFail(msg WSMessage) {
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
+	if r.ContentLength >= 0 && written != r.ContentLength {
+		_ = os.Remove(filePath)
+		http.Error(w, `{"success":false,"message":"文件不完整"}`, http.StatusBadRequest)
 		return
 	}
-	pickupCode, _ := payload["pickupCode"].(string)
-	if pickupCode == "" {
+	if exceedsStorageQuota(usedSpace, written, fileHash) {
+		_ = os.Remove(filePath)
+		http.Error(w, `{"success":false,"message":"存储空间不足"}`, http.StatusForbidden)
 		return
 	}
 
-	activeSessionsMu.RLock()
-	session := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-	if session == nil || c.socketID != session.ReceiverSocketID {
+	stored := newStoredFileSession(generateUniquePickupCode(), uniqueName, originalName, written, fileHash)
+	stored.PasswordHash = passwordHash
+	stored.MaxDownloads = maxDownloads
+	if err := publishStoredFile(stored); err != nil {
+		writePublishError(w, r, stored, err)
 		return
 	}
+	auditLog(r, requestActor(r), "file.create", stored.PickupCode, auditSuccess, stored.OriginalName)
+	reservation.commit(written)
+	log.Printf("[上传] 流式上传完成: %s (%s) - %s", stored.PickupCode, originalName, formatBytes(written))
 
-	sendToSocket(session.SocketID, WSMessage{
-		Type:    "verify-fail",
-		Payload: payload,
-	})
+	w.Header().Set("X-Pickup-Code", stored.PickupCode)
+	w.Header().Set("X-File-SHA256", fileHash)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(storedFileUploadResponse(stored))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, stored.PickupCode)
 }
 
-func (c *WSClient) handleBinaryChunk(data []byte) {
-	pickupCode, session := c.getSessionBySenderSocket()
-	if session == nil || pickupCode == "" {
-		return
+// wantsJSON 判断客户端是否要求 JSON 响应（脚本默认返回纯文本取件码）
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
 	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
 
-	// 检查是否是 HTTP 流下载模式
-	if session.DownloadResponse != nil && !session.PendingTransferEnd {
-		// HTTP 流模式：写入 HTTP 响应
-		_, err := session.DownloadResponse.Write(data)
-		if err != nil {
-			log.Printf("[HTTP流] %s 写入数据失败: %v", pickupCode, err)
-			return
-		}
-		// 立即刷新，让浏览器边传边下载
-		if session.DownloadFlusher != nil {
-			session.DownloadFlusher.Flush()
-		}
-		return
+// storageQuotaError 检查存储空间，declaredSize 未知时传入 -1 或 0，空字符串表示通过
+func storageQuotaError(usedSpace, declaredSize int64) string {
+	if config.StorageConfig.MaxStorageSize <= 0 {
+		return ""
+	}
+	if declaredSize > 0 && usedSpace+declaredSize > config.StorageConfig.MaxStorageSize {
+		return "存储空间不足"
+	}
+	if usedSpace >= config.StorageConfig.MaxStorageSize {
+		return "存储空间已满"
 	}
+	return ""
+}
 
-	// 普通模式：转发给接收端
-	if session.ReceiverSocketID == "" {
-		return
+// exceedsStorageQuota 判断写入后是否超出存储上限，已存在相同内容的文件不占用额外空间
+func exceedsStorageQuota(usedSpace, written int64, fileHash string) bool {
+	if config.StorageConfig.MaxStorageSize <= 0 || hasStoredBlob(fileHash) {
+		return false
 	}
+	return usedSpace+written > config.StorageConfig.MaxStorageSize
+}
 
-	wsClientsMu.RLock()
-	receiver, exists := wsClients[session.ReceiverSocketID]
-	wsClientsMu.RUnlock()
-	if !exists || receiver == nil {
-		return
+// newStoredFileSession 按当前存储配置生成文件记录（删除时间与删除模式）
+func newStoredFileSession(pickupCode, fileName, originalName string, size int64, fileHash string) *FileSession {
+	now := time.Now()
+	deleteTime := now.Add(time.Duration(config.StorageConfig.FileRetentionHours) * time.Hour)
+	deleteMode := "timer"
+	if config.StorageConfig.NeverDelete {
+		deleteTime = time.Time{}
+		deleteMode = "never"
+	} else if config.StorageConfig.DeleteOnDownload {
+		deleteMode = "download"
 	}
 
-	receiver.sendBinary(data)
+	return &FileSession{
+		PickupCode:   pickupCode,
+		FileName:     fileName,
+		OriginalName: originalName,
+		Size:         size,
+		FileHash:     fileHash,
+		UploadTime:   now,
+		DeleteTime:   deleteTime,
+		DeleteMode:   deleteMode,
+		Encrypted:    fileName != "" && atRestEncrypt,
+	}
 }
 
-func (c *WSClient) handleCancel(msg WSMessage) {
-	payload := msg.Payload.(map[string]interface{})
-	pickupCode := payload["pickupCode"].(string)
+// publishStoredFile 把暂存文件交给存储后端，登记并持久化索引，之后取件码即可使用
+// 文件会按 SHA-256 归并到内容寻址的 blob，相同内容只保留一份；失败时暂存文件已被删除
+// 启用扫描时先扫描存储后的文件：未通过的文件进入隔离区并返回 *InfectedError，
+// 扫描器不可用且未开启 failOpen 时释放文件并返回 errScannerUnavailable。无论成败都会解除取件码的预留
+func publishStoredFile(file *FileSession) error {
+	defer releasePickupCode(file.PickupCode)
+	if err := adoptBlobs(file); err != nil {
+		return err
+	}
 
-	cleanupSession(pickupCode)
+	signature, err := scanStoredFile(file)
+	if err != nil {
+		log.Printf("[扫描] %s 扫描失败: %v", file.PickupCode, err)
+		if !config.Scanner.FailOpen {
+			storedFilesMu.Lock()
+			orphaned := releaseFileBlobsLocked(file)
+			storedFilesMu.Unlock()
+			deleteBlobs(orphaned)
+			return errScannerUnavailable
+		}
+		log.Printf("[扫描] failOpen 已开启，%s 未经扫描直接发布", file.PickupCode)
+	}
 
-	sendToSocketID, _ := payload["socketID"].(string)
-	if sendToSocketID != "" {
-		sendToSocket(sendToSocketID, WSMessage{Type: "transfer-cancelled"})
+	storedFilesMu.Lock()
+	if signature != "" {
+		file.InfectedWith = signature
+		quarantinedFiles[file.PickupCode] = file
+	} else {
+		storedFiles[file.PickupCode] = file
 	}
-}
+	storageLogicalSize += file.Size
+	saveStorageIndex()
+	storedFilesMu.Unlock()
 
-func (c *WSClient) sendJSON(msg WSMessage) {
-	data, _ := json.Marshal(msg)
-	select {
-	case c.send <- OutgoingMessage{MessageType: websocket.TextMessage, Data: data}:
-	default:
-		log.Printf("[WS] 发送队列满: %s", c.socketID)
+	if signature != "" {
+		log.Printf("[扫描] %s (%s) 发现 %s，已隔离", file.PickupCode, file.OriginalName, signature)
+		return &InfectedError{Signature: signature}
 	}
+	recordTransfer()
+	return nil
 }
 
-func (c *WSClient) sendBinary(data []byte) {
-	select {
-	case c.send <- OutgoingMessage{MessageType: websocket.BinaryMessage, Data: data}:
-	default:
-		log.Printf("[WS] 二进制发送队列满: %s", c.socketID)
-	}
+// publishFailed 记录发布失败并返回给客户端的状态码和提示
+func publishFailed(r *http.Request, file *FileSession, err error) (int, string) {
+	var infected *InfectedError
+	status, message := http.StatusInternalServerError, "保存文件失败"
+	switch {
+	case errors.As(err, &infected):
+		status, message = http.StatusUnprocessableEntity, err.Error()
+	case errors.Is(err, errScannerUnavailable):
+		status, message = http.StatusServiceUnavailable, err.Error()
+	}
+	auditLog(r, requestActor(r), "file.create", file.PickupCode, auditFailure, err.Error())
+	return status, message
 }
 
-func (c *WSClient) sendError(message string) {
-	c.sendJSON(WSMessage{
-		Type:    "error",
-		Payload: message,
-	})
+// writePublishError 以 JSON 返回 publishStoredFile 的错误
+func writePublishError(w http.ResponseWriter, r *http.Request, file *FileSession, err error) {
+	status, message := publishFailed(r, file, err)
+	encoded, _ := json.Marshal(message)
+	http.Error(w, fmt.Sprintf(`{"success":false,"message":%s}`, encoded), status)
 }
 
-func sendToSocket(socketID string, msg WSMessage) {
-	wsClientsMu.RLock()
-	client, exists := wsClients[socketID]
-	wsClientsMu.RUnlock()
-	if !exists || client == nil {
-		return
+func storedFileUploadResponse(file *FileSession) map[string]interface{} {
+	return map[string]interface{}{
+		"success":          true,
+		"pickupCode":       file.PickupCode,
+		"fileName":         file.OriginalName,
+		"size":             file.Size,
+		"fileHash":         file.FileHash,
+		"deleteMode":       file.DeleteMode,
+		"maxDownloads":     file.MaxDownloads,
+		"downloadCount":    file.DownloadCount,
+		"neverDelete":      config.StorageConfig.NeverDelete,
+		"deleteOnDownload": config.StorageConfig.DeleteOnDownload,
+		"retentionHours":   config.StorageConfig.FileRetentionHours,
 	}
-	client.sendJSON(msg)
 }
 
-// notifySenderForHTTPDownload 通知发送端开始通过 HTTP 流发送数据
-func notifySenderForHTTPDownload(pickupCode string) {
-	activeSessionsMu.RLock()
-	session, exists := activeSessions[pickupCode]
-	activeSessionsMu.RUnlock()
-
-	if !exists || session == nil {
-		log.Printf("[HTTP流] %s 会话不存在", pickupCode)
+// 分块上传接口
+func handleChunkUpload(w http.ResponseWriter, r *http.Request) {
+	if !config.Features.ServerStorage {
+		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
 		return
 	}
 
-	// 通知发送端开始传输，数据将通过 WebSocket 发送到服务器，然后写入 HTTP 响应
-	if session.SocketID != "" {
-		sendToSocket(session.SocketID, WSMessage{
-			Type: "start-transfer",
-			Payload: map[string]interface{}{
-				"pickupCode": pickupCode,
-				"dataPlane":  "http-stream", // 标记为 HTTP 流模式
-			},
-		})
-		log.Printf("[HTTP流] %s 已通知发送端开始传输", pickupCode)
+	// 解析表单前先校验 API 密钥并按 Content-Length 预留每日额度，单个块不会超过单文件上限
+	declared := max(r.ContentLength-multipartOverhead, 0)
+	apiKey, reservation, ok := authorizeUpload(w, r, 0, declared)
+	if !ok {
+		return
 	}
-}
+	defer reservation.release()
+	r.Body = http.MaxBytesReader(w, r.Body, apiKeyMaxFileSize(apiKey)+multipartOverhead)
 
-func cleanupSession(socketID string) {
-	activeSessionsMu.Lock()
-	defer activeSessionsMu.Unlock()
+	if err := r.ParseMultipartForm(10 * 1024 * 1024); err != nil { // 10MB max per chunk
+		http.Error(w, `{"success":false,"message":"块过大"}`, http.StatusBadRequest)
+		return
+	}
 
-	for code, session := range activeSessions {
-		if session.SocketID == socketID || session.ReceiverSocketID == socketID {
-			role := "sender"
-			if session.ReceiverSocketID == socketID {
-				role = "receiver"
-			}
+	fileID := r.FormValue("fileID")
+	chunkIndexStr := r.FormValue("chunkIndex")
+	totalChunksStr := r.FormValue("totalChunks")
 
-			delete(activeSessions, code)
-			log.Printf("[WS] 清理会话: %s (由 %s 断开)", code, role)
+	if fileID == "" || chunkIndexStr == "" || totalChunksStr == "" {
+		http.Error(w, `{"success":false,"message":"参数缺失"}`, http.StatusBadRequest)
+		return
+	}
 
-			transferChanMu.Lock()
-			delete(fileTransferChannels, code)
-			transferChanMu.Unlock()
-			break
-		}
+	if !isValidFileID(fileID) {
+		http.Error(w, `{"success":false,"message":"文件 ID 无效"}`, http.StatusBadRequest)
+		return
 	}
-}
 
-func (c *WSClient) handleHeartbeat() {
-	// 重置 WebSocket 读超时，防止 Pong 丢失导致连接断开
-	c.conn.SetReadDeadline(time.Now().Add(time.Duration(config.Security.SessionTimeout) * time.Millisecond))
+	chunkIndex, err := strconv.Atoi(chunkIndexStr)
+	if err != nil || chunkIndex < 0 {
+		http.Error(w, `{"success":false,"message":"块索引无效"}`, http.StatusBadRequest)
+		return
+	}
 
-	activeSessionsMu.Lock()
-	defer activeSessionsMu.Unlock()
+	totalChunks, err := strconv.Atoi(totalChunksStr)
+	if err != nil || totalChunks <= 0 || chunkIndex >= totalChunks {
+		http.Error(w, `{"success":false,"message":"总块数无效"}`, http.StatusBadRequest)
+		return
+	}
 
-	for _, session := range activeSessions {
-		if session.SocketID == c.socketID {
-			session.LastActiveAt = time.Now()
-			break
-		}
+	// 客户端提供的块摘要（可选），写入时校验，不一致则只需重传该块
+	expectedHash := strings.ToLower(strings.TrimSpace(r.FormValue("chunkHash")))
+	if expectedHash == "" {
+		expectedHash = strings.ToLower(strings.TrimSpace(r.Header.Get("X-Chunk-SHA256")))
+	}
+	if expectedHash != "" && !isSHA256Hex(expectedHash) {
+		http.Error(w, `{"success":false,"message":"块校验值格式无效"}`, http.StatusBadRequest)
+		return
 	}
-}
 
-func isModeEnabled(mode string) bool {
-	switch mode {
-	case "memory":
-		return config.Features.MemoryStreaming
-	case "storage":
-		return config.Features.ServerStorage
-	case "p2p":
-		return config.Features.P2PDirect
+	file, header, err := r.FormFile("chunk")
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"无法读取块"}`, http.StatusBadRequest)
+		return
 	}
-	return false
-}
+	defer file.Close()
 
-// ==================== 管理员路由 ====================
-func setupAdminRoutes() {
-	// 登录
-	http.HandleFunc("/api/admin/login", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Password string `json:"password"`
+	// 第 0 块包含文件开头，提前检查内容策略，避免整个文件传完才在合并时被拒绝；
+	// fileName 可选，合并时还会再检查一次
+	var src io.Reader = file
+	if chunkIndex == 0 && contentPolicyActive() {
+		if r.FormValue("e2e") != "" {
+			writePolicyViolation(w, r, &PolicyViolation{Reason: "已启用文件类型限制，不支持端到端加密上传"})
+			return
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+		var head []byte
+		src, head = sniffStream(file)
+		if err := checkUploadContent(r.FormValue("fileName"), head); err != nil {
+			writePolicyViolation(w, r, err)
 			return
 		}
+	}
 
-		// 简单密码验证（生产环境应使用 bcrypt）
-		if req.Password != config.AdminPassword && hashPassword(req.Password) != config.AdminPasswordHash {
-			http.Error(w, `{"success":false,"message":"密码错误"}`, http.StatusUnauthorized)
+	if !reservation.resize(header.Size) {
+		writeDailyQuotaExceeded(w, apiKey)
+		return
+	}
+
+	// 第 0 块按声明的文件总大小（fileSize，未提供时按块数和块大小估计）检查单文件上限，
+	// 超出时不必等所有块上传完才在合并时拒绝
+	if chunkIndex == 0 {
+		fileSize, _ := strconv.ParseInt(r.FormValue("fileSize"), 10, 64)
+		if fileSize <= 0 {
+			fileSize = int64(totalChunks-1) * header.Size
+		}
+		if limit := apiKeyMaxFileSize(apiKey); fileSize > limit {
+			message, _ := json.Marshal(fmt.Sprintf("文件大小超过上限 %s", formatBytes(limit)))
+			http.Error(w, fmt.Sprintf(`{"success":false,"message":%s}`, message), http.StatusRequestEntityTooLarge)
 			return
 		}
+	}
+
+	// 创建临时目录
+	chunkDir := chunkUploadDir(fileID)
+	if err := os.MkdirAll(chunkDir, 0755); err != nil {
+		http.Error(w, `{"success":false,"message":"创建临时目录失败"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// 保存块（临时写入 + 原子重命名，断线时不会留下半个块）
+	chunkPath := filepath.Join(chunkDir, strconv.Itoa(chunkIndex))
+	written, chunkHash, err := saveUploadedFileAtomicAndVerify(src, chunkPath, expectedHash)
+	if errors.Is(err, errHashMismatch) {
+		log.Printf("[分块上传] 块校验失败 %s/%d: expected=%s actual=%s", fileID, chunkIndex, expectedHash, chunkHash)
+		writeChunkHashMismatch(w, chunkIndex, expectedHash, chunkHash)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"写入块失败"}`, http.StatusInternalServerError)
+		return
+	}
+
+	reservation.commit(written)
+
+	chunk := ChunkInfo{Index: chunkIndex, Size: written, Hash: chunkHash, Verified: expectedHash != ""}
+	if err := recordChunk(fileID, totalChunks, chunk); err != nil {
+		log.Printf("[分块上传] 写入清单失败 %s/%d: %v", fileID, chunkIndex, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"chunkIndex":  chunkIndex,
+		"totalChunks": totalChunks,
+		"size":        written,
+		"hash":        chunkHash,
+		"verified":    chunk.Verified,
+	})
+}
+
+// writeChunkHashMismatch 返回独立的错误码，客户端据此只重传对应的块
+func writeChunkHashMismatch(w http.ResponseWriter, chunkIndex int, expectedHash, actualHash string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      false,
+		"code":         "CHUNK_HASH_MISMATCH",
+		"message":      fmt.Sprintf("块 %d 校验失败，请重传", chunkIndex),
+		"chunkIndex":   chunkIndex,
+		"expectedHash": expectedHash,
+		"actualHash":   actualHash,
+	})
+}
+
+// 查询分块上传进度（断点续传）
+func uploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Features.ServerStorage {
+		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
+		return
+	}
+
+	fileID := strings.TrimPrefix(r.URL.Path, "/api/upload-status/")
+	if !isValidFileID(fileID) {
+		http.Error(w, `{"success":false,"message":"文件 ID 无效"}`, http.StatusBadRequest)
+		return
+	}
+
+	chunkManifestsMu.Lock()
+	manifest := loadChunkManifestLocked(fileID)
+	if manifest == nil {
+		chunkManifestsMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"exists":  false,
+			"fileID":  fileID,
+		})
+		return
+	}
+
+	chunks := make([]ChunkInfo, 0, len(manifest.Chunks))
+	var receivedBytes int64
+	for _, chunk := range manifest.Chunks {
+		chunks = append(chunks, chunk)
+		receivedBytes += chunk.Size
+	}
+	totalChunks := manifest.TotalChunks
+	expiresAt := manifest.UpdatedAt.Add(chunkGracePeriod())
+	chunkManifestsMu.Unlock()
+
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Index < chunks[j].Index })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"exists":         true,
+		"fileID":         fileID,
+		"totalChunks":    totalChunks,
+		"receivedChunks": len(chunks),
+		"receivedBytes":  receivedBytes,
+		"chunks":         chunks,
+		"expiresAt":      expiresAt.UnixMilli(),
+	})
+}
+
+// 合并分块接口
+func handleMergeChunks(w http.ResponseWriter, r *http.Request) {
+	if !config.Features.ServerStorage {
+		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		FileID      string `json:"fileID"`
+		TotalChunks int    `json:"totalChunks"`
+		FileName    string `json:"fileName"`
+		FileSize    int64  `json:"fileSize"`
+		FileHash    string `json:"fileHash"` // 可选，整文件 SHA-256
+		// 端到端加密上传：块内容已在浏览器加密，fileName 不可信也不使用，
+		// 原始文件名和大小只存在于 encryptedMeta 中
+		E2E           bool   `json:"e2e"`
+		EncryptedMeta string `json:"encryptedMeta"`
+		Password      string `json:"password"`     // 可选，下载密码
+		MaxDownloads  int    `json:"maxDownloads"` // 可选，完整下载次数上限
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+		return
+	}
+	if !isValidFileID(req.FileID) {
+		http.Error(w, `{"success":false,"message":"文件 ID 无效"}`, http.StatusBadRequest)
+		return
+	}
+
+	chunkDir := chunkUploadDir(req.FileID)
+
+	if req.TotalChunks <= 0 {
+		http.Error(w, `{"success":false,"message":"总块数无效"}`, http.StatusBadRequest)
+		return
+	}
+	req.FileHash = strings.ToLower(strings.TrimSpace(req.FileHash))
+	if req.E2E {
+		if !isValidEncryptedMeta(req.EncryptedMeta) {
+			http.Error(w, `{"success":false,"message":"加密元数据无效"}`, http.StatusBadRequest)
+			return
+		}
+		req.FileName = e2eStoredName(req.FileID)
+	} else {
+		req.EncryptedMeta = ""
+	}
+	passwordHash, err := hashDownloadPassword(req.Password)
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"下载密码无效"}`, http.StatusBadRequest)
+		return
+	}
+	if err := validateMaxDownloads(req.MaxDownloads); err != nil {
+		http.Error(w, `{"success":false,"message":"下载次数上限无效"}`, http.StatusBadRequest)
+		return
+	}
+
+	// 检查所有块都已落盘并记录在清单中
+	chunks := snapshotChunkManifest(req.FileID)
+	allVerified := true
+	var chunksSize int64
+	for i := 0; i < req.TotalChunks; i++ {
+		chunk, ok := chunks[i]
+		if !ok {
+			http.Error(w, fmt.Sprintf(`{"success":false,"message":"块 %d 缺失"}`, i), http.StatusBadRequest)
+			return
+		}
+		allVerified = allVerified && chunk.Verified
+		chunksSize += chunk.Size
+	}
+
+	// 块已在上传时计入每日额度，合并时只检查单文件上限
+	if _, _, ok := authorizeUpload(w, r, chunksSize, 0); !ok {
+		return
+	}
+
+	// 第 0 块可能是在启用策略之前上传的，合并前按完整文件名和开头字节再检查一次
+	if contentPolicyActive() {
+		if req.E2E {
+			writePolicyViolation(w, r, &PolicyViolation{Reason: "已启用文件类型限制，不支持端到端加密上传"})
+			return
+		}
+		head, err := readFileHead(filepath.Join(chunkDir, "0"))
+		if err != nil {
+			http.Error(w, `{"success":false,"message":"读取块 0 失败"}`, http.StatusInternalServerError)
+			return
+		}
+		if err := checkUploadContent(req.FileName, head); err != nil {
+			writePolicyViolation(w, r, err)
+			return
+		}
+	}
+
+	// 生成唯一文件名
+	uniqueName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), sanitizeFilename(req.FileName))
+	filePath := filepath.Join(uploadDir, uniqueName)
+
+	// 创建最终文件
+	finalFile, err := os.Create(filePath + ".tmp")
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"创建文件失败"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// 开启静态加密时合并结果直接写成密文，哈希按明文计算
+	var dst io.Writer = finalFile
+	var enc *encryptingWriter
+	if atRestEncrypt {
+		if enc, err = newEncryptingWriter(finalFile); err != nil {
+			finalFile.Close()
+			os.Remove(filePath + ".tmp")
+			http.Error(w, `{"success":false,"message":"创建文件失败"}`, http.StatusInternalServerError)
+			return
+		}
+		dst = enc
+	}
+
+	hasher := sha256.New()
+	writer := io.MultiWriter(dst, hasher)
+	var written int64
+
+	// 按顺序合并所有块，同时核对清单中记录的块摘要，无需合并后再读一遍
+	for i := 0; i < req.TotalChunks; i++ {
+		chunkPath := filepath.Join(chunkDir, strconv.Itoa(i))
+		chunkFile, err := os.Open(chunkPath)
+		if err != nil {
+			finalFile.Close()
+			os.Remove(filePath + ".tmp")
+			http.Error(w, fmt.Sprintf(`{"success":false,"message":"读取块 %d 失败"}`, i), http.StatusInternalServerError)
+			return
+		}
+
+		chunkHasher := sha256.New()
+		n, err := io.Copy(io.MultiWriter(writer, chunkHasher), chunkFile)
+		chunkFile.Close()
+		if err != nil {
+			finalFile.Close()
+			os.Remove(filePath + ".tmp")
+			http.Error(w, fmt.Sprintf(`{"success":false,"message":"合并块 %d 失败"}`, i), http.StatusInternalServerError)
+			return
+		}
+		written += n
+
+		if actualHash := hex.EncodeToString(chunkHasher.Sum(nil)); n != chunks[i].Size || actualHash != chunks[i].Hash {
+			finalFile.Close()
+			os.Remove(filePath + ".tmp")
+			forgetChunk(req.FileID, i)
+			log.Printf("[合并] 块 %s/%d 与清单不一致，已丢弃等待重传", req.FileID, i)
+			writeChunkHashMismatch(w, i, chunks[i].Hash, actualHash)
+			return
+		}
+	}
+
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			finalFile.Close()
+			os.Remove(filePath + ".tmp")
+			http.Error(w, `{"success":false,"message":"写入文件失败"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	finalFile.Sync()
+	finalFile.Close()
+
+	fileHash := hex.EncodeToString(hasher.Sum(nil))
+
+	if req.FileSize > 0 && written != req.FileSize {
+		os.Remove(filePath + ".tmp")
+		http.Error(w, `{"success":false,"message":"合并后文件大小不一致"}`, http.StatusBadRequest)
+		return
+	}
+	if req.FileHash != "" && req.FileHash != fileHash {
+		os.Remove(filePath + ".tmp")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":      false,
+			"code":         "FILE_HASH_MISMATCH",
+			"message":      "合并后文件校验失败",
+			"expectedHash": req.FileHash,
+			"actualHash":   fileHash,
+		})
+		return
+	}
+
+	// 原子重命名
+	if err := os.Rename(filePath+".tmp", filePath); err != nil {
+		os.Remove(filePath + ".tmp")
+		http.Error(w, `{"success":false,"message":"重命名文件失败"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// 删除临时块目录
+	removeChunkUpload(req.FileID)
+
+	if exceedsStorageQuota(getUsedStorage(), written, fileHash) {
+		_ = os.Remove(filePath)
+		http.Error(w, `{"success":false,"message":"存储空间不足"}`, http.StatusForbidden)
+		return
+	}
+
+	// 保存会话
+	stored := newStoredFileSession(generateUniquePickupCode(), uniqueName, req.FileName, written, fileHash)
+	stored.E2E = req.E2E
+	stored.EncryptedMeta = req.EncryptedMeta
+	stored.PasswordHash = passwordHash
+	stored.MaxDownloads = req.MaxDownloads
+	if stored.E2E {
+		stored.OriginalName = e2eStoredName(stored.PickupCode)
+	}
+	if err := publishStoredFile(stored); err != nil {
+		writePublishError(w, r, stored, err)
+		return
+	}
+	auditLog(r, requestActor(r), "file.create", stored.PickupCode, auditSuccess, stored.OriginalName)
+
+	response := storedFileUploadResponse(stored)
+	response["chunksVerified"] = allVerified
+	response["e2e"] = stored.E2E
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ==================== 分块上传清单 ====================
+
+// ChunkManifest 记录某个分块上传已落盘的块，断线重连后客户端据此跳过已上传的块
+type ChunkManifest struct {
+	FileID      string
+	TotalChunks int
+	Chunks      map[int]ChunkInfo
+	UpdatedAt   time.Time
+}
+
+type ChunkInfo struct {
+	Index    int    `json:"index"`
+	Size     int64  `json:"size"`
+	Hash     string `json:"hash"`
+	Verified bool   `json:"verified"` // 客户端提供了摘要且与写入内容一致
+}
+
+// chunkManifestEntry 是清单日志中的一行，同一块多次上传时以最后一行为准
+type chunkManifestEntry struct {
+	ChunkInfo
+	TotalChunks int `json:"totalChunks"`
+}
+
+const chunkManifestFile = "manifest.log"
+
+var fileIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func isValidFileID(fileID string) bool {
+	return fileIDPattern.MatchString(fileID)
+}
+
+func chunkUploadDir(fileID string) string {
+	return filepath.Join(uploadDir, "chunks", fileID)
+}
+
+func chunkGracePeriod() time.Duration {
+	minutes := config.StorageConfig.ChunkGraceMinutes
+	if minutes <= 0 {
+		minutes = 30
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// loadChunkManifestLocked 返回上传清单，内存中没有时从磁盘日志恢复（服务重启后续传）
+// 调用方需持有 chunkManifestsMu；上传目录不存在时返回 nil
+func loadChunkManifestLocked(fileID string) *ChunkManifest {
+	if manifest, ok := chunkManifests[fileID]; ok {
+		return manifest
+	}
+
+	chunkDir := chunkUploadDir(fileID)
+	dirInfo, err := os.Stat(chunkDir)
+	if err != nil || !dirInfo.IsDir() {
+		return nil
+	}
+
+	manifest := &ChunkManifest{
+		FileID:    fileID,
+		Chunks:    make(map[int]ChunkInfo),
+		UpdatedAt: dirInfo.ModTime(),
+	}
+
+	data, err := os.ReadFile(filepath.Join(chunkDir, chunkManifestFile))
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "" {
+				continue
+			}
+			var entry chunkManifestEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				// 崩溃时最后一行可能不完整，忽略即可，对应块会被重新上传
+				continue
+			}
+			// 只信任磁盘上仍然存在且大小一致的块
+			info, err := os.Stat(filepath.Join(chunkDir, strconv.Itoa(entry.Index)))
+			if err != nil || info.Size() != entry.Size {
+				continue
+			}
+			manifest.TotalChunks = entry.TotalChunks
+			manifest.Chunks[entry.Index] = entry.ChunkInfo
+		}
+	}
+
+	chunkManifests[fileID] = manifest
+	return manifest
+}
+
+// recordChunk 把已落盘的块追加到清单日志
+func recordChunk(fileID string, totalChunks int, chunk ChunkInfo) error {
+	chunkManifestsMu.Lock()
+	defer chunkManifestsMu.Unlock()
+
+	manifest := loadChunkManifestLocked(fileID)
+	if manifest == nil {
+		manifest = &ChunkManifest{FileID: fileID, Chunks: make(map[int]ChunkInfo)}
+		chunkManifests[fileID] = manifest
+	}
+	manifest.TotalChunks = totalChunks
+	manifest.Chunks[chunk.Index] = chunk
+	manifest.UpdatedAt = time.Now()
+
+	line, err := json.Marshal(chunkManifestEntry{ChunkInfo: chunk, TotalChunks: totalChunks})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(chunkUploadDir(fileID), chunkManifestFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// snapshotChunkManifest 返回清单中已记录块的副本，上传不存在时返回 nil
+func snapshotChunkManifest(fileID string) map[int]ChunkInfo {
+	chunkManifestsMu.Lock()
+	defer chunkManifestsMu.Unlock()
+
+	manifest := loadChunkManifestLocked(fileID)
+	if manifest == nil {
+		return nil
+	}
+	chunks := make(map[int]ChunkInfo, len(manifest.Chunks))
+	for index, chunk := range manifest.Chunks {
+		chunks[index] = chunk
+	}
+	return chunks
+}
+
+// forgetChunk 从清单中移除损坏的块并删除块文件，客户端重新查询进度后会重传它
+func forgetChunk(fileID string, chunkIndex int) {
+	chunkManifestsMu.Lock()
+	defer chunkManifestsMu.Unlock()
+
+	if manifest, ok := chunkManifests[fileID]; ok {
+		delete(manifest.Chunks, chunkIndex)
+	}
+	os.Remove(filepath.Join(chunkUploadDir(fileID), strconv.Itoa(chunkIndex)))
+}
+
+func removeChunkUpload(fileID string) {
+	chunkManifestsMu.Lock()
+	delete(chunkManifests, fileID)
+	os.RemoveAll(chunkUploadDir(fileID))
+	chunkManifestsMu.Unlock()
+}
+
+// cleanupStaleChunkUploads 清理超过宽限期没有新块写入的分块目录
+func cleanupStaleChunkUploads(now time.Time) {
+	entries, err := os.ReadDir(filepath.Join(uploadDir, "chunks"))
+	if err != nil {
+		return
+	}
+
+	grace := chunkGracePeriod()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		fileID := entry.Name()
+
+		chunkManifestsMu.Lock()
+		var lastActive time.Time
+		if manifest, ok := chunkManifests[fileID]; ok {
+			lastActive = manifest.UpdatedAt
+		} else if info, err := entry.Info(); err == nil {
+			lastActive = info.ModTime()
+		}
+		stale := now.Sub(lastActive) > grace
+		if stale {
+			delete(chunkManifests, fileID)
+			os.RemoveAll(chunkUploadDir(fileID))
+		}
+		chunkManifestsMu.Unlock()
+
+		if stale {
+			log.Printf("[清理] 删除超时未完成的分块上传: %s", fileID)
+		}
+	}
+}
+
+func sanitizeFilename(name string) string {
+	// 移除危险字符
+	reg := regexp.MustCompile(`[^\w\-\.]`)
+	return reg.ReplaceAllString(name, "_")
+}
+
+// 获取存储使用量（实际占用的存储空间，去重后的 blob 只计一次）
+func getUsedStorage() int64 {
+	_, physical := getStorageUsage()
+	return physical
+}
+
+// getStorageUsage 返回逻辑用量（所有取件码的文件大小之和）与物理用量（存储实际占用），
+// 两者在登记和删除文件时增量维护，不访问存储
+func getStorageUsage() (int64, int64) {
+	storedFilesMu.RLock()
+	defer storedFilesMu.RUnlock()
+	return storageLogicalSize, storagePhysicalSize
+}
+
+// ==================== 存储后端 ====================
+// 已完成上传的文件（blob）通过 StorageBackend 读写，可以放在本地目录或 S3 兼容的对象存储。
+// 分块上传的临时块、tus 暂存数据和写入中的 .tmp 文件需要追加与重命名，始终留在本地 uploadDir，
+// 上传完成后再交给后端保存。对象名是以 / 分隔的相对路径，例如 blobs/ab/<sha256>。
+
+// StorageObject 是后端中的一个对象
+type StorageObject struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// StorageBackend 是已存储文件的读写接口，对象不存在时返回的错误满足 errors.Is(err, os.ErrNotExist)
+type StorageBackend interface {
+	Put(name string, src io.Reader, size int64) error
+	Get(name string) (io.ReadCloser, error)
+	GetRange(name string, offset, length int64) (io.ReadCloser, error)
+	Delete(name string) error
+	Stat(name string) (StorageObject, error)
+	List(prefix string) ([]StorageObject, error)
+}
+
+// fileImporter 由能直接接管本地暂存文件的后端实现，本地后端用重命名代替复制
+type fileImporter interface {
+	Import(name, localPath string) error
+}
+
+var storageBackend StorageBackend
+
+func newStorageBackend(cfg StorageConfig) (StorageBackend, error) {
+	switch cfg.Backend {
+	case "", "local":
+		return &localStorage{root: uploadDir}, nil
+	case "s3":
+		return newS3Storage(cfg.S3)
+	default:
+		return nil, fmt.Errorf("未知的存储后端: %s", cfg.Backend)
+	}
+}
+
+// storeLocalFile 把本地暂存文件保存为后端对象 name，成功后暂存文件不再存在
+func storeLocalFile(name, localPath string) error {
+	if importer, ok := storageBackend.(fileImporter); ok {
+		return importer.Import(name, localPath)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = storageBackend.Put(name, f, info.Size())
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+// ---------- 本地文件系统 ----------
+
+type localStorage struct {
+	root string
+}
+
+func (l *localStorage) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l *localStorage) Put(name string, src io.Reader, size int64) error {
+	target := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmpPath := target + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, target)
+}
+
+func (l *localStorage) Import(name, localPath string) error {
+	target := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(localPath, target)
+}
+
+func (l *localStorage) Get(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *localStorage) GetRange(name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{io.LimitReader(f, length), f}, nil
+}
+
+func (l *localStorage) Delete(name string) error {
+	target := l.path(name)
+	if err := os.Remove(target); err != nil {
+		return err
+	}
+	// 顺带移除空的 blobs/xx 目录，非空时 Remove 会失败，忽略即可
+	if strings.HasPrefix(filepath.ToSlash(name), "blobs/") {
+		os.Remove(filepath.Dir(target))
+	}
+	return nil
+}
+
+func (l *localStorage) Stat(name string) (StorageObject, error) {
+	info, err := os.Stat(l.path(name))
+	if err != nil {
+		return StorageObject{}, err
+	}
+	return StorageObject{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List 列出已存储的文件，跳过同在 uploadDir 中的分块、tus 暂存目录和 .tmp 文件
+func (l *localStorage) List(prefix string) ([]StorageObject, error) {
+	var objects []StorageObject
+	err := filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, relErr := filepath.Rel(l.root, p)
+		if relErr != nil {
+			return relErr
+		}
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if name == "chunks" || name == "tus" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(name, ".tmp") || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, StorageObject{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+// ---------- S3 兼容对象存储 ----------
+// 只依赖标准库，使用 AWS Signature V4 签名，适用于 AWS S3、MinIO、Cloudflare R2 等。
+// 请求体不参与签名（UNSIGNED-PAYLOAD），大文件按 s3PartSize 分片上传。
+
+const (
+	s3PartSize           = 64 * 1024 * 1024
+	s3MultipartThreshold = s3PartSize
+
+	s3DialTimeout           = 10 * time.Second
+	s3ResponseHeaderTimeout = 60 * time.Second
+)
+
+type s3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+func newS3Storage(cfg S3Config) (*s3Storage, error) {
+	accessKey, secretKey := cfg.AccessKeyID, cfg.SecretAccessKey
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if cfg.Bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, errors.New("S3 存储需要配置 bucket、accessKeyId 和 secretAccessKey")
+	}
+
+	endpoint := cfg.Endpoint
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("S3 endpoint 无效: %s", endpoint)
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Storage{
+		endpoint:  u,
+		region:    region,
+		bucket:    cfg.Bucket,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		pathStyle: cfg.PathStyle,
+		// 不设整体超时，下载大文件时响应体会持续读取很久；
+		// 连接、TLS 握手和等待响应头各有上限，端点无响应时请求失败而不是一直挂起
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   s3DialTimeout,
+				ResponseHeaderTimeout: s3ResponseHeaderTimeout,
+				IdleConnTimeout:       90 * time.Second,
+				MaxIdleConnsPerHost:   16,
+			},
+		},
+	}, nil
+}
+
+func (s *s3Storage) key(name string) string {
+	return s.prefix + filepath.ToSlash(name)
+}
+
+func (s *s3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = ""
+	}
+	u.Path += "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do 发送签名后的请求，非 2xx 响应转换为错误，404 对应 os.ErrNotExist
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, values := range header {
+		req.Header[k] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("S3 %s %s: %w", method, key, os.ErrNotExist)
+	}
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&s3Err)
+	return nil, fmt.Errorf("S3 %s %s: %s %s %s", method, key, resp.Status, s3Err.Code, s3Err.Message)
+}
+
+// sign 按 AWS Signature Version 4 为请求添加 Authorization 头
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:UNSIGNED-PAYLOAD\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape 按 SigV4 规则编码：只保留 RFC 3986 非保留字符
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (s *s3Storage) Put(name string, src io.Reader, size int64) error {
+	if size > s3MultipartThreshold {
+		return s.putMultipart(s.key(name), src, size)
+	}
+	resp, err := s.do(http.MethodPut, s.key(name), nil, nil, src, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putMultipart 分片上传，src 实现 io.ReaderAt（本地文件）时直接按区间读取，否则逐片缓冲到内存
+func (s *s3Storage) putMultipart(key string, src io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	if err != nil || initiate.UploadID == "" {
+		return fmt.Errorf("S3 创建分片上传失败: %v", err)
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []completedPart
+	abort := func(cause error) error {
+		if resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiate.UploadID}}, nil, nil, 0); err == nil {
+			resp.Body.Close()
+		}
+		return cause
+	}
+
+	readerAt, _ := src.(io.ReaderAt)
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+s3PartSize, number+1 {
+		partSize := size - offset
+		if partSize > s3PartSize {
+			partSize = s3PartSize
+		}
+		var body io.Reader
+		if readerAt != nil {
+			body = io.NewSectionReader(readerAt, offset, partSize)
+		} else {
+			buf := make([]byte, partSize)
+			if _, err := io.ReadFull(src, buf); err != nil {
+				return abort(err)
+			}
+			body = bytes.NewReader(buf)
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiate.UploadID}}
+		resp, err := s.do(http.MethodPut, key, query, nil, body, partSize)
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	}
+
+	payload, _ := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	resp, err = s.do(http.MethodPost, key, url.Values{"uploadId": {initiate.UploadID}}, nil, bytes.NewReader(payload), int64(len(payload)))
+	if err != nil {
+		return abort(err)
+	}
+	// CompleteMultipartUpload 出错时可能仍返回 200，错误信息在响应体中
+	var complete struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&complete)
+	resp.Body.Close()
+	if err == nil && complete.XMLName.Local == "Error" {
+		return abort(fmt.Errorf("S3 完成分片上传失败: %s %s", complete.Code, complete.Message))
+	}
+	return nil
+}
+
+func (s *s3Storage) Get(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) GetRange(name string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := s.do(http.MethodGet, s.key(name), nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		// 服务端忽略了 Range，自行跳过前面的数据
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return readCloser{io.LimitReader(resp.Body, length), resp.Body}, nil
+}
+
+// Delete 删除对象，S3 对不存在的对象同样返回成功
+func (s *s3Storage) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Stat(name string) (StorageObject, error) {
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StorageObject{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3Storage) List(prefix string) ([]StorageObject, error) {
+	var objects []StorageObject
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range result.Contents {
+			objects = append(objects, StorageObject{
+				Name:    strings.TrimPrefix(item.Key, s.prefix),
+				Size:    item.Size,
+				ModTime: item.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// ==================== 内容寻址去重 ====================
+// 新存储的文件以 blobs/<sha256> 命名，多个取件码引用同一份数据时只保留一个 blob，
+// blobRefs 记录每个 blob 的引用数，最后一个引用删除时才删除文件。
+// 旧版本的 <时间戳>_<文件名> 文件保持原名，同样参与引用计数与按哈希查找。
+
+// BlobRef 是某个存储文件（FileSession.FileName）的引用信息
+type BlobRef struct {
+	Hash      string
+	Refs      int
+	Encrypted bool
+	Size      int64 // 在存储中占用的大小，加密文件包含加密开销
+}
+
+var (
+	blobRefs   = make(map[string]*BlobRef) // FileName -> 引用信息，受 storedFilesMu 保护
+	blobByHash = make(map[string]string)   // SHA-256 -> FileName，受 storedFilesMu 保护
+
+	storageLogicalSize  int64 // 所有取件码的文件大小之和，受 storedFilesMu 保护
+	storagePhysicalSize int64 // 所有 blob 在存储中的大小之和，受 storedFilesMu 保护
+)
+
+func blobName(fileHash string) string {
+	return path.Join("blobs", fileHash[:2], fileHash)
+}
+
+// rebuildBlobIndexLocked 根据存储索引重建引用计数和存储用量，调用方需持有 storedFilesMu。
+// blob 大小由记录的文件大小推算，与存储中的实际大小不符时由 reconcileStorageUsage 修正
+func rebuildBlobIndexLocked() {
+	blobRefs = make(map[string]*BlobRef)
+	blobByHash = make(map[string]string)
+	storageLogicalSize, storagePhysicalSize = 0, 0
+	for _, file := range allStoredFilesLocked() {
+		storageLogicalSize += file.Size
+		if file.IsBundle() {
+			for _, entry := range file.Files {
+				retainBlobLocked(entry.FileName, entry.FileHash, entry.Encrypted, storedObjectSize(entry.Size, entry.Encrypted))
+			}
+			continue
+		}
+		retainBlobLocked(file.FileName, file.FileHash, file.Encrypted, storedObjectSize(file.Size, file.Encrypted))
+	}
+}
+
+// storedObjectSize 返回明文大小为 plainSize 的文件在存储中占用的大小
+func storedObjectSize(plainSize int64, encrypted bool) int64 {
+	if encrypted {
+		return encryptedSize(plainSize)
+	}
+	return plainSize
+}
+
+// retainBlobLocked 增加引用，blob 首次登记时把 size 计入物理用量
+func retainBlobLocked(name, fileHash string, encrypted bool, size int64) {
+	ref, ok := blobRefs[name]
+	if !ok {
+		ref = &BlobRef{Hash: fileHash, Encrypted: encrypted, Size: size}
+		blobRefs[name] = ref
+		storagePhysicalSize += size
+	}
+	ref.Refs++
+	if fileHash != "" {
+		if _, exists := blobByHash[fileHash]; !exists {
+			blobByHash[fileHash] = name
+		}
+	}
+}
+
+// releaseBlobLocked 减少引用，返回引用是否已归零。
+// 归零的 blob 只从索引中移除，调用方释放 storedFilesMu 后再用 deleteBlobs 删除文件
+func releaseBlobLocked(name string) bool {
+	ref, ok := blobRefs[name]
+	if ok {
+		ref.Refs--
+		if ref.Refs > 0 {
+			return false
+		}
+		delete(blobRefs, name)
+		storagePhysicalSize -= ref.Size
+		if ref.Hash != "" && blobByHash[ref.Hash] == name {
+			delete(blobByHash, ref.Hash)
+		}
+	}
+	return true
+}
+
+// blob 的存储读写不在 storedFilesMu 下进行，对象存储较慢时不会阻塞其它文件操作。
+// 同名 blob 的保存与删除由 lockBlob 串行化：删除前重新确认没有新的引用，
+// 避免删掉引用归零后又被重新上传的相同内容
+var (
+	blobLocksMu sync.Mutex
+	blobLocks   = make(map[string]*blobLock)
+)
+
+type blobLock struct {
+	mu      sync.Mutex
+	waiters int
+}
+
+// lockBlob 锁定名为 name 的 blob，返回解锁函数
+func lockBlob(name string) func() {
+	blobLocksMu.Lock()
+	lock, ok := blobLocks[name]
+	if !ok {
+		lock = &blobLock{}
+		blobLocks[name] = lock
+	}
+	lock.waiters++
+	blobLocksMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		blobLocksMu.Lock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(blobLocks, name)
+		}
+		blobLocksMu.Unlock()
+	}
+}
+
+// deleteBlobs 删除引用已归零的 blob 文件，调用方不能持有 storedFilesMu
+func deleteBlobs(names []string) {
+	for _, name := range names {
+		unlock := lockBlob(name)
+		storedFilesMu.RLock()
+		_, retained := blobRefs[name]
+		storedFilesMu.RUnlock()
+		if !retained {
+			if err := storageBackend.Delete(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("[去重] 删除 blob 失败 %s: %v", name, err)
+			}
+		}
+		unlock()
+	}
+}
+
+// releaseFileBlobsLocked 释放文件（多文件包则为其中每个文件）对 blob 的引用，
+// 返回引用已归零、需要在释放 storedFilesMu 后删除的 blob
+func releaseFileBlobsLocked(file *FileSession) []string {
+	var orphaned []string
+	if file.IsBundle() {
+		for _, entry := range file.Files {
+			if releaseBlobLocked(entry.FileName) {
+				orphaned = append(orphaned, entry.FileName)
+			}
+		}
+	} else if releaseBlobLocked(file.FileName) {
+		orphaned = append(orphaned, file.FileName)
+	}
+	return orphaned
+}
+
+// stagedBlob 指向 FileSession 或 BundleFile 中待归并的文件名与加密标记
+type stagedBlob struct {
+	name      *string
+	encrypted *bool
+	hash      string
+	size      int64 // 明文大小
+}
+
+// adoptBlobs 把暂存在 uploadDir 的文件（多文件包则为其中每个文件）交给存储后端，
+// 按内容寻址归并并登记引用。上传到对象存储可能较慢，期间不持有 storedFilesMu；
+// 任一文件失败时释放已登记的引用并删除剩余的暂存文件
+func adoptBlobs(file *FileSession) error {
+	var staged []stagedBlob
+	if file.IsBundle() {
+		for _, entry := range file.Files {
+			staged = append(staged, stagedBlob{&entry.FileName, &entry.Encrypted, entry.FileHash, entry.Size})
+		}
+	} else {
+		staged = append(staged, stagedBlob{&file.FileName, &file.Encrypted, file.FileHash, file.Size})
+	}
+
+	for i, blob := range staged {
+		if err := adoptBlob(blob, file.PickupCode); err != nil {
+			var orphaned []string
+			storedFilesMu.Lock()
+			for _, done := range staged[:i] {
+				if releaseBlobLocked(*done.name) {
+					orphaned = append(orphaned, *done.name)
+				}
+			}
+			storedFilesMu.Unlock()
+			deleteBlobs(orphaned)
+			for _, rest := range staged[i:] {
+				os.Remove(filepath.Join(uploadDir, *rest.name))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// adoptBlob 已有相同哈希的 blob 时丢弃暂存文件并引用已有 blob，
+// 否则把暂存文件保存为 blobs/<sha256>，并更新文件名及其是否加密
+func adoptBlob(blob stagedBlob, pickupCode string) error {
+	localPath := filepath.Join(uploadDir, *blob.name)
+
+	if isSHA256Hex(blob.hash) {
+		// 先登记引用再确认 blob 仍在存储中，确认期间它不会因引用归零而被删除
+		storedFilesMu.Lock()
+		existing, ok := blobByHash[blob.hash]
+		var encrypted bool
+		if ok {
+			ref := blobRefs[existing]
+			encrypted = ref.Encrypted
+			retainBlobLocked(existing, blob.hash, ref.Encrypted, ref.Size)
+		}
+		storedFilesMu.Unlock()
+
+		if ok {
+			if _, err := storageBackend.Stat(existing); err == nil {
+				os.Remove(localPath)
+				storedFilesMu.Lock()
+				*blob.name, *blob.encrypted = existing, encrypted
+				storedFilesMu.Unlock()
+				log.Printf("[去重] %s 与已有文件内容相同，复用 %s", pickupCode, existing)
+				return nil
+			}
+			// 已登记的 blob 在存储中丢失，撤销引用并用新上传的数据替换
+			storedFilesMu.Lock()
+			if blobByHash[blob.hash] == existing {
+				delete(blobByHash, blob.hash)
+			}
+			released := releaseBlobLocked(existing)
+			storedFilesMu.Unlock()
+			if released && existing != blobName(blob.hash) {
+				deleteBlobs([]string{existing})
+			}
+		}
+	}
+
+	target := *blob.name
+	if isSHA256Hex(blob.hash) {
+		target = blobName(blob.hash)
+	}
+	unlock := lockBlob(target)
+	defer unlock()
+	if err := storeLocalFile(target, localPath); err != nil {
+		log.Printf("[存储] 保存 %s 失败: %v", target, err)
+		return err
+	}
+
+	storedFilesMu.Lock()
+	*blob.name = target
+	retainBlobLocked(target, blob.hash, *blob.encrypted, storedObjectSize(blob.size, *blob.encrypted))
+	storedFilesMu.Unlock()
+	return nil
+}
+
+// StorageReconcile 是一次存储用量核对的结果，Drift 为核对后与核对前物理用量之差
+type StorageReconcile struct {
+	Time          time.Time `json:"time"`
+	DurationMs    int64     `json:"durationMs"`
+	Checked       int       `json:"checked"`
+	Tracked       int64     `json:"tracked"`
+	Actual        int64     `json:"actual"`
+	Drift         int64     `json:"drift"`
+	Missing       int       `json:"missing"`       // 已登记但在存储中找不到的 blob 数
+	Errors        int       `json:"errors"`        // 查询失败、本次未核对的 blob 数
+	Untracked     int       `json:"untracked"`     // 存储中没有被任何取件码引用的文件数
+	UntrackedSize int64     `json:"untrackedSize"` // 这些文件的总大小，不计入物理用量
+	StagingSize   int64     `json:"stagingSize"`   // 本地暂存（分块、tus 续传、临时文件）占用的大小
+}
+
+var (
+	lastReconcile   *StorageReconcile
+	lastReconcileMu sync.Mutex
+	reconcileMu     sync.Mutex // 同一时间只运行一次核对
+)
+
+// reconcileStorageUsage 列出存储中的全部文件，按实际大小修正已登记 blob 的用量，
+// 并单独统计没有被引用的文件和本地暂存占用的空间。
+// 列出期间不持有 storedFilesMu，期间被删除或重新登记的 blob 不做修正，核对开始后写入的文件不计为未引用
+func reconcileStorageUsage() StorageReconcile {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	started := time.Now()
+	storedFilesMu.RLock()
+	expected := make(map[string]int64, len(blobRefs))
+	for name, ref := range blobRefs {
+		expected[name] = ref.Size
+	}
+	storedFilesMu.RUnlock()
+
+	result := StorageReconcile{Time: started}
+	actual := make(map[string]int64, len(expected))
+	var missing []string
+	objects, err := storageBackend.List("")
+	if err != nil {
+		log.Printf("[存储] 用量核对：列出存储文件失败: %v", err)
+		result.Errors = len(expected)
+	} else {
+		listed := make(map[string]int64, len(objects))
+		for _, object := range objects {
+			listed[object.Name] = object.Size
+		}
+		for name := range expected {
+			size, ok := listed[name]
+			if !ok {
+				missing = append(missing, name)
+			}
+			actual[name] = size
+		}
+	}
+
+	storedFilesMu.Lock()
+	result.Tracked = storagePhysicalSize
+	for name, size := range actual {
+		if ref, ok := blobRefs[name]; ok && ref.Size == expected[name] {
+			storagePhysicalSize += size - ref.Size
+			ref.Size = size
+		}
+	}
+	result.Actual = storagePhysicalSize
+	for _, object := range objects {
+		if _, ok := blobRefs[object.Name]; !ok && object.ModTime.Before(started) {
+			result.Untracked++
+			result.UntrackedSize += object.Size
+		}
+	}
+	storedFilesMu.Unlock()
+
+	result.StagingSize = stagingUsage()
+	result.Checked = len(actual)
+	result.Drift = result.Actual - result.Tracked
+	result.Missing = len(missing)
+	result.DurationMs = time.Since(started).Milliseconds()
+
+	if result.Drift != 0 || result.Missing > 0 {
+		log.Printf("[存储] 用量核对：记录 %s，实际 %s，偏差 %+d 字节，缺失 %d 个文件",
+			formatBytes(result.Tracked), formatBytes(result.Actual), result.Drift, result.Missing)
+		for _, name := range missing {
+			log.Printf("[存储] 文件缺失: %s", name)
+		}
+	}
+	if result.Untracked > 0 {
+		log.Printf("[存储] 用量核对：%d 个文件未被任何取件码引用，共 %s", result.Untracked, formatBytes(result.UntrackedSize))
+	}
+
+	lastReconcileMu.Lock()
+	lastReconcile = &result
+	lastReconcileMu.Unlock()
+	return result
+}
+
+// stagingUsage 统计 uploadDir 中尚未交给存储后端的数据：分块、tus 续传和临时文件。
+// 使用对象存储时 uploadDir 只用于暂存，其中的文件全部计入
+func stagingUsage() int64 {
+	_, isLocal := storageBackend.(*localStorage)
+	var total int64
+	filepath.WalkDir(uploadDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(uploadDir, p)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if isLocal && !strings.HasPrefix(name, "chunks/") && !strings.HasPrefix(name, "tus/") && !strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func getLastReconcile() *StorageReconcile {
+	lastReconcileMu.Lock()
+	defer lastReconcileMu.Unlock()
+	return lastReconcile
+}
+
+// storageReconcileRoutine 启动时核对一次，之后每 reconcileMinutes 分钟核对一次
+func storageReconcileRoutine() {
+	for {
+		if config.StorageConfig.ReconcileMinutes > 0 {
+			reconcileStorageUsage()
+		}
+		interval := time.Duration(config.StorageConfig.ReconcileMinutes) * time.Minute
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		time.Sleep(interval)
+	}
+}
+
+// hasStoredBlob 判断是否已存储相同内容的文件
+func hasStoredBlob(fileHash string) bool {
+	if fileHash == "" {
+		return false
+	}
+	storedFilesMu.RLock()
+	defer storedFilesMu.RUnlock()
+	_, ok := blobByHash[fileHash]
+	return ok
+}
+
+// 下载存储的文件（支持 Range 请求）
+func downloadStoredHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Features.ServerStorage {
+		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
+		return
+	}
+
+	// 路径格式：/api/download-stored/<取件码>[/<多文件包内序号>]
+	code, entryIndex, hasEntry := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/download-stored/"), "/"), "/")
+	code = normalizePickupCode(code)
+	if rejectLockedClient(w, r) {
+		return
+	}
+
+	storedFilesMu.RLock()
+	file, exists := storedFiles[code]
+	if !exists {
+		storedFilesMu.RUnlock()
+		recordCodeFailure(codeLimitKey(r))
+		http.Error(w, `{"success":false,"message":"取件码无效或文件已过期"}`, http.StatusNotFound)
+		return
+	}
+	storedFilesMu.RUnlock()
+	if !authorizeDownload(w, r, file) {
+		return
+	}
+	serveStoredFile(w, r, file, entryIndex, hasEntry)
+}
+
+// serveStoredFile 发送存储的文件或多文件包中的一个文件，调用方已完成取件码与密码校验。
+// 整个文件（或整包 ZIP）送达并计入下载次数时返回 true
+func serveStoredFile(w http.ResponseWriter, r *http.Request, file *FileSession, entryIndex string, hasEntry bool) bool {
+	// 多文件包：单独下载其中一个文件时不计入下载次数，整包 ZIP 下载才算一次下载
+	fileName, originalName, fileHash := file.FileName, file.OriginalName, file.FileHash
+	recordedSize, encrypted := file.Size, file.Encrypted
+	if file.IsBundle() && hasEntry {
+		index, err := strconv.Atoi(entryIndex)
+		if err != nil || index < 0 || index >= len(file.Files) {
+			http.Error(w, `{"success":false,"message":"文件不存在"}`, http.StatusNotFound)
+			return false
+		}
+		entry := file.Files[index]
+		fileName, originalName, fileHash = entry.FileName, path.Base(entry.Name), entry.FileHash
+		recordedSize, encrypted = entry.Size, entry.Encrypted
+	} else if hasEntry {
+		http.Error(w, `{"success":false,"message":"文件不存在"}`, http.StatusNotFound)
+		return false
+	}
+
+	// 只有整个文件（或整包 ZIP）发送完毕才计入下载次数，HEAD 请求不计
+	countDownload := !hasEntry && r.Method != http.MethodHead
+
+	if file.IsBundle() && !hasEntry {
+		if serveBundleZip(w, file) && countDownload {
+			completeDownload(r, file)
+			return true
+		}
+		return false
+	}
+
+	// 获取文件信息（加密文件以明文大小对外）
+	fileSize, err := storedPlainSize(fileName, encrypted, recordedSize)
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"文件不存在"}`, http.StatusNotFound)
+		return false
+	}
+
+	// 设置基本头
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, originalName))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if fileHash != "" {
+		w.Header().Set("X-File-SHA256", fileHash)
+	}
+	if file.E2E {
+		// 返回的是浏览器加密后的密文，X-File-SHA256 也是密文的摘要
+		w.Header().Set("X-E2E-Encrypted", "1")
+	}
+
+	// 检查 Range 请求
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		// 没有 Range，返回整个文件
+		f, err := openStoredRange(fileName, encrypted, fileSize, 0, fileSize)
+		if err != nil {
+			http.Error(w, `{"success":false,"message":"文件不存在"}`, http.StatusNotFound)
+			return false
+		}
+		defer f.Close()
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileSize))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if n, err := io.Copy(w, f); err == nil && n == fileSize {
+			if countDownload {
+				completeDownload(r, file)
+				return true
+			} else if hasEntry && r.Method != http.MethodHead {
+				// 单独下载包内文件不计入下载次数，但同样记录
+				auditLog(r, requestActor(r), "file.download", file.PickupCode, auditSuccess, originalName)
+			}
+		}
+		return false
+	}
+
+	// 解析 Range header (格式: bytes=start-end)
+	ranges := strings.TrimPrefix(rangeHeader, "bytes=")
+	parts := strings.Split(ranges, "-")
+	if len(parts) != 2 {
+		http.Error(w, "Invalid Range header", http.StatusBadRequest)
+		return false
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Range start", http.StatusBadRequest)
+		return false
+	}
+
+	var end int64
+	if parts[1] == "" {
+		end = fileSize - 1
+	} else {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Range end", http.StatusBadRequest)
+			return false
+		}
+	}
+
+	// 验证范围
+	if start < 0 || end >= fileSize || start > end {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
+		http.Error(w, "Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return false
+	}
+
+	// 定位到起始位置（加密文件从所在的段开始解密）
+	contentLength := end - start + 1
+	f, err := openStoredRange(fileName, encrypted, fileSize, start, contentLength)
+	if err != nil {
+		log.Printf("[Range] 打开文件失败: %v", err)
+		http.Error(w, `{"success":false,"message":"读取文件失败"}`, http.StatusInternalServerError)
+		return false
+	}
+	defer f.Close()
+
+	// 设置 Range 响应头
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", contentLength))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusPartialContent)
+
+	// 发送指定范围的数据
+	if n, err := io.Copy(w, f); err == nil && n == contentLength && countDownload {
+		return recordRangeDownload(r, file, start, end, fileSize)
+	}
+	return false
+}
+
+// ==================== tus 断点续传协议 ====================
+// 实现 tus 1.0.0 核心协议及 creation / creation-with-upload / termination / checksum 扩展，
+// 供 Uppy、tus-js-client、tus-go-client 等现成上传器使用。上传完成后与其他上传方式一样
+// 登记到 storedFiles 并分配取件码，取件码通过 X-Pickup-Code 响应头返回。
+
+const tusVersion = "1.0.0"
+
+// TusUpload 是一个 tus 上传的状态，持久化到 uploadDir/tus/<id>.json 以便重启后续传
+type TusUpload struct {
+	ID         string            `json:"id"`
+	Length     int64             `json:"length"`
+	Offset     int64             `json:"offset"`
+	Metadata   map[string]string `json:"metadata"`
+	RawMeta    string            `json:"rawMetadata"`
+	HashState  []byte            `json:"hashState"` // 已接收数据的 SHA-256 中间状态
+	PickupCode string            `json:"pickupCode,omitempty"`
+	// 元数据中的 password 在创建时即转为哈希并从 Metadata、RawMeta 中移除
+	PasswordHash string    `json:"passwordHash,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+
+	mu sync.Mutex
+}
+
+var (
+	tusUploads   = make(map[string]*TusUpload)
+	tusUploadsMu sync.Mutex
+)
+
+func tusDir() string {
+	return filepath.Join(uploadDir, "tus")
+}
+
+func tusDataPath(id string) string {
+	return filepath.Join(tusDir(), id)
+}
+
+func tusInfoPath(id string) string {
+	return filepath.Join(tusDir(), id+".json")
+}
+
+// getTusUpload 返回上传状态，内存中没有时从磁盘恢复
+func getTusUpload(id string) *TusUpload {
+	if !isValidFileID(id) {
+		return nil
+	}
+
+	tusUploadsMu.Lock()
+	defer tusUploadsMu.Unlock()
+
+	if upload, ok := tusUploads[id]; ok {
+		return upload
+	}
+	data, err := os.ReadFile(tusInfoPath(id))
+	if err != nil {
+		return nil
+	}
+	var upload TusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		log.Printf("[tus] 状态文件损坏 %s: %v", id, err)
+		return nil
+	}
+	if upload.PickupCode == "" {
+		if err := upload.reconcileData(); err != nil {
+			log.Printf("[tus] 无法核对上传数据 %s: %v", id, err)
+			return nil
+		}
+	}
+	tusUploads[id] = &upload
+	return &upload
+}
+
+// reconcileData 在加载状态时让数据文件与记录的偏移一致（进程在 PATCH 中途崩溃时两者可能不同）。
+// 状态只在数据写入后保存，记录的偏移和哈希状态对应的数据一定已写入：数据文件更长时截断到偏移，
+// 多出的部分没有计入哈希，也可能未通过 Upload-Checksum 校验，客户端通过 HEAD 取得偏移后续传即可。
+// 数据文件缺失或更短（写入未落盘）时哈希状态无法回退，只能从头开始
+func (u *TusUpload) reconcileData() error {
+	info, err := os.Stat(tusDataPath(u.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && info.Size() == u.Offset {
+		return nil
+	}
+	if err == nil && info.Size() > u.Offset {
+		log.Printf("[tus] 数据比记录的偏移长，截断到 %d: %s", u.Offset, u.ID)
+		return os.Truncate(tusDataPath(u.ID), u.Offset)
+	}
+
+	log.Printf("[tus] 数据少于记录的偏移 %d，从头开始: %s", u.Offset, u.ID)
+	if err := os.WriteFile(tusDataPath(u.ID), nil, 0644); err != nil {
+		return err
+	}
+	u.HashState, _ = sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	u.Offset = 0
+	return u.saveLocked()
+}
+
+// saveLocked 持久化上传状态，调用方需持有 upload.mu
+func (u *TusUpload) saveLocked() error {
+	u.UpdatedAt = time.Now()
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmpPath := tusInfoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, tusInfoPath(u.ID))
+}
+
+func removeTusUpload(id string) {
+	tusUploadsMu.Lock()
+	delete(tusUploads, id)
+	tusUploadsMu.Unlock()
+	os.Remove(tusDataPath(id))
+	os.Remove(tusInfoPath(id))
+}
+
+// parseTusMetadata 解析 Upload-Metadata 头：逗号分隔的 "key base64(value)" 对
+// removeTusMetadataKey 从 Upload-Metadata 头中去掉指定的键，用于避免密码随 HEAD 响应返回
+func removeTusMetadataKey(header, key string) string {
+	var kept []string
+	for _, pair := range strings.Split(header, ",") {
+		if fields := strings.Fields(pair); len(fields) > 0 && fields[0] != key {
+			kept = append(kept, strings.TrimSpace(pair))
+		}
+	}
+	return strings.Join(kept, ",")
+}
+
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid metadata pair %q", pair)
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(decoded)
+		}
+		meta[fields[0]] = value
+	}
+	return meta, nil
+}
+
+// newTusChecksumHash 返回 Upload-Checksum 支持的算法
+func newTusChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+func tusError(w http.ResponseWriter, message string, status int) {
+	http.Error(w, fmt.Sprintf(`{"success":false,"message":"%s"}`, message), status)
+}
+
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !config.Features.ServerStorage {
+		tusError(w, "服务器存储功能已禁用", http.StatusForbidden)
+		return
+	}
+
+	// 不支持 PATCH、DELETE 的环境用 POST 加 X-HTTP-Method-Override 代替，其他方法不接受覆盖
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && r.Method == http.MethodPost {
+		method = override
+	}
+
+	if method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,creation-with-upload,termination,checksum")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxFileSize, 10))
+		w.Header().Set("Tus-Checksum-Algorithm", "sha1,md5,sha256")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		tusError(w, "不支持的 tus 协议版本", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tus"), "/")
+	if id == "" {
+		if method != http.MethodPost {
+			tusError(w, "方法不允许", http.StatusMethodNotAllowed)
+			return
+		}
+		handleTusCreate(w, r)
+		return
+	}
+
+	upload := getTusUpload(id)
+	if upload == nil {
+		tusError(w, "上传不存在或已过期", http.StatusNotFound)
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		upload.mu.Lock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if upload.RawMeta != "" {
+			w.Header().Set("Upload-Metadata", upload.RawMeta)
+		}
+		if upload.PickupCode != "" {
+			w.Header().Set("X-Pickup-Code", upload.PickupCode)
+		}
+		upload.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		handleTusPatch(w, r, upload)
+	case http.MethodDelete:
+		upload.mu.Lock()
+		removeTusUpload(upload.ID)
+		upload.mu.Unlock()
+		log.Printf("[tus] 上传已终止: %s", upload.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		tusError(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		tusError(w, "不支持延迟指定长度", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		tusError(w, "Upload-Length 无效", http.StatusBadRequest)
+		return
+	}
+	if length > maxFileSize {
+		tusError(w, "文件过大", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// tus 上传在创建时按声明长度校验并计入 API 密钥额度，后续 PATCH 凭上传地址续传
+	_, reservation, ok := authorizeUpload(w, r, length, length)
+	if !ok {
+		return
+	}
+	defer reservation.release()
+	if msg := storageQuotaError(getUsedStorage(), length); msg != "" {
+		tusError(w, msg, http.StatusForbidden)
+		return
+	}
+
+	rawMeta := r.Header.Get("Upload-Metadata")
+	meta, err := parseTusMetadata(rawMeta)
+	if err != nil {
+		tusError(w, "Upload-Metadata 无效", http.StatusBadRequest)
+		return
+	}
+	passwordHash, err := hashDownloadPassword(meta["password"])
+	if err != nil {
+		tusError(w, "下载密码无效", http.StatusBadRequest)
+		return
+	}
+	if _, err := parseMaxDownloads(meta["maxDownloads"]); err != nil {
+		tusError(w, "下载次数上限无效", http.StatusBadRequest)
+		return
+	}
+	// 创建时先按文件名检查，内容类型在上传完成后检查
+	if contentPolicyActive() {
+		if err := checkContentPolicy(tusFileName(meta), ""); err != nil {
+			auditLog(r, requestActor(r), "file.create", "", auditFailure, err.Error())
+			tusError(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	if _, ok := meta["password"]; ok {
+		delete(meta, "password")
+		rawMeta = removeTusMetadataKey(rawMeta, "password")
+	}
+
+	if err := os.MkdirAll(tusDir(), 0755); err != nil {
+		tusError(w, "创建临时目录失败", http.StatusInternalServerError)
+		return
+	}
+
+	id := generateToken()[:32]
+	f, err := os.Create(tusDataPath(id))
+	if err != nil {
+		tusError(w, "创建文件失败", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	hashState, _ := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	now := time.Now()
+	upload := &TusUpload{
+		ID:           id,
+		Length:       length,
+		Metadata:     meta,
+		RawMeta:      rawMeta,
+		HashState:    hashState,
+		PasswordHash: passwordHash,
+		CreatedAt:    now,
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if err := upload.saveLocked(); err != nil {
+		os.Remove(tusDataPath(id))
+		tusError(w, "保存上传状态失败", http.StatusInternalServerError)
+		return
+	}
+	tusUploadsMu.Lock()
+	tusUploads[id] = upload
+	tusUploadsMu.Unlock()
+	reservation.commit(length)
+
+	w.Header().Set("Location", "/api/tus/"+id)
+	log.Printf("[tus] 创建上传: %s (%s) - %s", id, meta["filename"], formatBytes(length))
+
+	// creation-with-upload：创建请求中直接携带了第一段数据
+	if r.ContentLength != 0 && r.Header.Get("Content-Type") == "application/offset+octet-stream" {
+		if status, msg := appendTusUploadLocked(r, upload); status != 0 {
+			tusError(w, msg, status)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		if upload.PickupCode != "" {
+			w.Header().Set("X-Pickup-Code", upload.PickupCode)
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleTusPatch(w http.ResponseWriter, r *http.Request, upload *TusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		tusError(w, "Content-Type 必须为 application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		tusError(w, "Upload-Offset 无效", http.StatusBadRequest)
+		return
+	}
+
+	// 同一上传同时只允许一个 PATCH
+	if !upload.mu.TryLock() {
+		tusError(w, "上传正在进行中", http.StatusLocked)
+		return
+	}
+	defer upload.mu.Unlock()
+
+	if upload.PickupCode != "" {
+		tusError(w, "上传已完成", http.StatusForbidden)
+		return
+	}
+	if offset != upload.Offset {
+		tusError(w, "Upload-Offset 与服务器不一致", http.StatusConflict)
+		return
+	}
+
+	if status, msg := appendTusUploadLocked(r, upload); status != 0 {
+		tusError(w, msg, status)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.PickupCode != "" {
+		w.Header().Set("X-Pickup-Code", upload.PickupCode)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendTusUploadLocked 把请求体追加到上传数据末尾，返回非零状态码表示失败
+// 调用方需持有 upload.mu
+func appendTusUploadLocked(r *http.Request, upload *TusUpload) (int, string) {
+	var checksum hash.Hash
+	var expectedSum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		fields := strings.Fields(header)
+		if len(fields) != 2 {
+			return http.StatusBadRequest, "Upload-Checksum 无效"
+		}
+		checksum = newTusChecksumHash(fields[0])
+		if checksum == nil {
+			return http.StatusBadRequest, "不支持的校验算法"
+		}
+		sum, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return http.StatusBadRequest, "Upload-Checksum 无效"
+		}
+		expectedSum = sum
+	}
+
+	hasher := sha256.New()
+	if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+		return http.StatusInternalServerError, "上传状态损坏"
+	}
+
+	f, err := os.OpenFile(tusDataPath(upload.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return http.StatusInternalServerError, "打开文件失败"
+	}
+	defer f.Close()
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		return http.StatusInternalServerError, "定位文件失败"
+	}
+
+	writers := []io.Writer{f, hasher}
+	if checksum != nil {
+		writers = append(writers, checksum)
+	}
+	remaining := upload.Length - upload.Offset
+	n, copyErr := io.Copy(io.MultiWriter(writers...), io.LimitReader(r.Body, remaining))
+
+	// 校验失败时丢弃本次写入的数据，客户端从原偏移重传
+	if checksum != nil && (copyErr != nil || !bytes.Equal(checksum.Sum(nil), expectedSum)) {
+		f.Truncate(upload.Offset)
+		if copyErr != nil {
+			return http.StatusBadRequest, "读取请求数据失败"
+		}
+		return 460, "校验和不匹配"
+	}
+
+	// 连接中断时保留已收到的部分，客户端通过 HEAD 获取偏移后继续
+	if n > 0 {
+		state, err := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			f.Truncate(upload.Offset)
+			return http.StatusInternalServerError, "保存上传状态失败"
+		}
+		upload.Offset += n
+		upload.HashState = state
+		if err := upload.saveLocked(); err != nil {
+			log.Printf("[tus] 保存状态失败 %s: %v", upload.ID, err)
+		}
+	}
+	if copyErr != nil {
+		return http.StatusBadRequest, "读取请求数据失败"
+	}
+
+	if upload.Offset == upload.Length {
+		f.Sync()
+		if status, msg := finalizeTusUploadLocked(r, upload, hex.EncodeToString(hasher.Sum(nil))); status != 0 {
+			return status, msg
+		}
+	}
+	return 0, ""
+}
+
+// tusFileName 返回元数据中的文件名，兼容 filename 和 name 两种键
+func tusFileName(meta map[string]string) string {
+	if name := meta["filename"]; name != "" {
+		return name
+	}
+	return meta["name"]
+}
+
+// finalizeTusUploadLocked 把完成的上传移入存储目录并分配取件码
+func finalizeTusUploadLocked(r *http.Request, upload *TusUpload, fileHash string) (int, string) {
+	originalName := tusFileName(upload.Metadata)
+	if originalName == "" {
+		originalName = upload.ID
+	}
+	originalName = filepath.Base(strings.ReplaceAll(originalName, "\\", "/"))
+
+	if contentPolicyActive() {
+		head, err := readFileHead(tusDataPath(upload.ID))
+		if err != nil {
+			return http.StatusInternalServerError, "读取上传数据失败"
+		}
+		if err := checkUploadContent(originalName, head); err != nil {
+			removeTusUpload(upload.ID)
+			auditLog(r, requestActor(r), "file.create", "", auditFailure, err.Error())
+			return http.StatusUnsupportedMediaType, err.Error()
+		}
+	}
+
+	if exceedsStorageQuota(getUsedStorage(), upload.Length, fileHash) {
+		removeTusUpload(upload.ID)
+		return http.StatusForbidden, "存储空间不足"
+	}
+
+	// 暂存数据需要按偏移追加，只能是明文，完成后整体加密到新的文件。暂存文件保持明文直到发布成功，
+	// 之后的步骤失败、客户端重试时重新从明文加密，不会把密文再加密一次
+	uniqueName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), sanitizeFilename(originalName))
+	stagedPath := filepath.Join(uploadDir, uniqueName)
+	if atRestEncrypt {
+		if err := encryptFileTo(tusDataPath(upload.ID), stagedPath); err != nil {
+			log.Printf("[tus] 加密失败 %s: %v", upload.ID, err)
+			return http.StatusInternalServerError, "保存文件失败"
+		}
+	} else if err := os.Rename(tusDataPath(upload.ID), stagedPath); err != nil {
+		return http.StatusInternalServerError, "保存文件失败"
+	}
+
+	stored := newStoredFileSession(generateUniquePickupCode(), uniqueName, originalName, upload.Length, fileHash)
+	stored.PasswordHash = upload.PasswordHash
+	stored.MaxDownloads, _ = parseMaxDownloads(upload.Metadata["maxDownloads"]) // 创建上传时已校验
+	if err := publishStoredFile(stored); err != nil {
+		removeTusUpload(upload.ID)
+		return publishFailed(r, stored, err)
+	}
+	auditLog(r, requestActor(r), "file.create", stored.PickupCode, auditSuccess, stored.OriginalName)
+	if atRestEncrypt {
+		os.Remove(tusDataPath(upload.ID))
+	}
+
+	// 保留状态文件一段时间，客户端可通过 HEAD 再次取得取件码
+	upload.PickupCode = stored.PickupCode
+	upload.HashState = nil
+	if err := upload.saveLocked(); err != nil {
+		log.Printf("[tus] 保存状态失败 %s: %v", upload.ID, err)
+	}
+	log.Printf("[tus] 上传完成: %s -> %s (%s)", upload.ID, stored.PickupCode, originalName)
+	return 0, ""
+}
+
+// cleanupStaleTusUploads 清理超过宽限期没有活动的 tus 上传（含已完成上传的状态文件）
+func cleanupStaleTusUploads(now time.Time) {
+	entries, err := os.ReadDir(tusDir())
+	if err != nil {
+		return
+	}
+
+	grace := chunkGracePeriod()
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(name, ".json")
+		upload := getTusUpload(id)
+		if upload == nil {
+			continue
+		}
+		if !upload.mu.TryLock() {
+			continue
+		}
+		if now.Sub(upload.UpdatedAt) > grace {
+			removeTusUpload(id)
+			log.Printf("[清理] 删除超时的 tus 上传: %s", id)
+		}
+		upload.mu.Unlock()
+	}
+}
+
+// ==================== 静态加密 ====================
+// 开启后服务器保存的文件以 AES-256-GCM 分段加密：文件头之后每 64KB 明文为一个独立认证的段，
+// 段号与是否末段参与认证，可按段随机读取，Range 下载无需解密整个文件。
+// 格式：magic(8) | 段大小 uint32(4) | nonce 前缀(8) | 段0 密文+tag | 段1 ...
+// 分块上传的临时块与 tus 暂存数据仍为明文，合并/完成时才写入加密文件。
+
+const (
+	encMagic       = "FRENC1\x00\x00"
+	encHeaderSize  = 8 + 4 + 8
+	encSegmentSize = 64 * 1024
+)
+
+var (
+	atRestKey     []byte // 已配置的密钥，关闭加密后仍用于读取已加密的文件
+	atRestEncrypt bool   // 新文件是否加密
+)
+
+// loadEncryptionKey 从环境变量 FILE_ROCKET_ENCRYPTION_KEY 或配置读取密钥
+func loadEncryptionKey() error {
+	raw := os.Getenv("FILE_ROCKET_ENCRYPTION_KEY")
+	if raw == "" {
+		raw = config.Encryption.Key
+	}
+	atRestKey = nil
+	atRestEncrypt = false
+	if raw == "" {
+		if config.Encryption.Enabled {
+			return errors.New("已开启静态加密但未配置密钥")
+		}
+		return nil
+	}
+
+	key, err := decodeEncryptionKey(raw)
+	if err != nil {
+		return err
+	}
+	atRestKey = key
+	atRestEncrypt = config.Encryption.Enabled
+	return nil
+}
+
+// decodeEncryptionKey 接受 64 位十六进制或 base64 编码的 32 字节密钥
+func decodeEncryptionKey(raw string) ([]byte, error) {
+	raw = strings.TrimSpace(raw)
+	if key, err := hex.DecodeString(raw); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(raw); err == nil && len(key) == 32 {
+			return key, nil
+		}
+	}
+	return nil, errors.New("密钥必须是 32 字节（64 位十六进制或 base64）")
+}
+
+func newAtRestAEAD() (cipher.AEAD, error) {
+	if atRestKey == nil {
+		return nil, errors.New("未配置静态加密密钥")
+	}
+	block, err := aes.NewCipher(atRestKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encSegmentNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], index)
+	return nonce
+}
+
+func encSegmentAAD(index uint32, final bool) []byte {
+	aad := make([]byte, 5)
+	binary.BigEndian.PutUint32(aad, index)
+	if final {
+		aad[4] = 1
+	}
+	return aad
+}
+
+// encryptedSize 返回明文大小对应的密文文件大小
+func encryptedSize(plainSize int64) int64 {
+	segments := (plainSize + encSegmentSize - 1) / encSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return encHeaderSize + plainSize + segments*16
+}
+
+// encryptingWriter 把明文按段加密写入 dst；缓冲区满时不立即写出，
+// 等到有后续数据或 Close 时才能确定该段是否为末段
+type encryptingWriter struct {
+	dst    io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	index  uint32
+}
+
+func newEncryptingWriter(dst io.Writer) (*encryptingWriter, error) {
+	aead, err := newAtRestAEAD()
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, encHeaderSize)
+	header = append(header, encMagic...)
+	header = binary.BigEndian.AppendUint32(header, encSegmentSize)
+	header = append(header, prefix...)
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		dst:    dst,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, encSegmentSize),
+	}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == encSegmentSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptingWriter) flush(final bool) error {
+	sealed := e.aead.Seal(nil, encSegmentNonce(e.prefix, e.index), e.buf, encSegmentAAD(e.index, final))
+	if _, err := e.dst.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// Close 写出末段（空文件也会写出一个空的末段），不关闭 dst
+func (e *encryptingWriter) Close() error {
+	return e.flush(true)
+}
+
+// decryptingReader 从某个段开始顺序解密，lastIndex 为整个文件的末段序号
+type decryptingReader struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	prefix    []byte
+	index     uint32
+	lastIndex uint32
+	ct        []byte
+	pbuf      []byte
+	plain     []byte
+	done      bool
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		final := d.index == d.lastIndex
+		n, err := io.ReadFull(d.src, d.ct[:cap(d.ct)])
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if !final && n != cap(d.ct) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		plain, err := d.aead.Open(d.pbuf[:0], encSegmentNonce(d.prefix, d.index), d.ct[:n], encSegmentAAD(d.index, final))
+		if err != nil {
+			return 0, fmt.Errorf("加密段 %d 校验失败: %w", d.index, err)
+		}
+		d.plain = plain
+		d.done = final
+		d.index++
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// openStoredRange 打开存储文件明文的 [start, start+length) 区间，plainSize 为明文总大小
+// 加密文件只向存储后端请求覆盖该区间的那几个段
+func openStoredRange(name string, encrypted bool, plainSize, start, length int64) (io.ReadCloser, error) {
+	if !encrypted {
+		return storageBackend.GetRange(name, start, length)
+	}
+
+	aead, err := newAtRestAEAD()
+	if err != nil {
+		return nil, err
+	}
+	headerReader, err := storageBackend.GetRange(name, 0, encHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encHeaderSize)
+	_, err = io.ReadFull(headerReader, header)
+	headerReader.Close()
+	if err != nil || string(header[:8]) != encMagic {
+		return nil, errors.New("不是有效的加密文件")
+	}
+	if binary.BigEndian.Uint32(header[8:12]) != encSegmentSize {
+		return nil, errors.New("不支持的加密段大小")
+	}
+
+	segments := (plainSize + encSegmentSize - 1) / encSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	firstSegment := start / encSegmentSize
+	if firstSegment >= segments {
+		firstSegment = segments - 1
+	}
+	lastSegment := firstSegment
+	if length > 0 {
+		lastSegment = (start + length - 1) / encSegmentSize
+	}
+	if lastSegment >= segments {
+		lastSegment = segments - 1
+	}
+	cipherStart := encHeaderSize + firstSegment*(encSegmentSize+16)
+	cipherEnd := encHeaderSize + (lastSegment+1)*(encSegmentSize+16)
+	if total := encryptedSize(plainSize); cipherEnd > total {
+		cipherEnd = total
+	}
+	body, err := storageBackend.GetRange(name, cipherStart, cipherEnd-cipherStart)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &decryptingReader{
+		src:       body,
+		aead:      aead,
+		prefix:    header[12:20],
+		index:     uint32(firstSegment),
+		lastIndex: uint32(segments - 1),
+		ct:        make([]byte, 0, encSegmentSize+16),
+		pbuf:      make([]byte, 0, encSegmentSize),
+	}
+	if skip := start - firstSegment*encSegmentSize; skip > 0 {
+		if _, err := io.CopyN(io.Discard, reader, skip); err != nil {
+			body.Close()
+			return nil, err
+		}
+	}
+	return readCloser{io.LimitReader(reader, length), body}, nil
+}
+
+// storedPlainSize 返回存储文件的明文大小，加密文件以索引记录为准
+func storedPlainSize(name string, encrypted bool, recordedSize int64) (int64, error) {
+	if encrypted {
+		return recordedSize, nil
+	}
+	object, err := storageBackend.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return object.Size, nil
+}
+
+// encryptExistingFiles 把未加密的存储文件原地加密（--encrypt-existing），需在服务停止时运行
+func encryptExistingFiles() {
+	if atRestKey == nil {
+		log.Fatal("[加密] 未配置密钥，请设置 encryption.key 或环境变量 FILE_ROCKET_ENCRYPTION_KEY")
+	}
+
+	storedFilesMu.Lock()
+	defer storedFilesMu.Unlock()
+
+	encrypted, failed := 0, 0
+	for name, ref := range blobRefs {
+		if ref.Encrypted {
+			continue
+		}
+		if err := encryptStoredFile(name); err != nil {
+			log.Printf("[加密] %s 失败: %v", name, err)
+			failed++
+			continue
+		}
+		ref.Encrypted = true
+		storagePhysicalSize += encryptedSize(ref.Size) - ref.Size
+		ref.Size = encryptedSize(ref.Size)
+		for _, file := range allStoredFilesLocked() {
+			if file.FileName == name {
+				file.Encrypted = true
+			}
+			for _, entry := range file.Files {
+				if entry.FileName == name {
+					entry.Encrypted = true
+				}
+			}
+		}
+		encrypted++
+		// 每个文件加密后立即保存索引，中途中断也不会丢失已完成的记录
+		saveStorageIndex()
+	}
+	log.Printf("[加密] 完成：加密 %d 个文件，失败 %d 个", encrypted, failed)
+}
+
+// encryptStoredFile 读取存储后端中的文件，加密到本地临时文件后覆盖原对象
+func encryptStoredFile(name string) error {
+	src, err := storageBackend.Get(name)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(uploadDir, fmt.Sprintf("%d.enc.tmp", time.Now().UnixNano()))
+	err = encryptToFile(src, tmpPath)
+	src.Close()
+	if err != nil {
+		return err
+	}
+	if err := storeLocalFile(name, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// encryptFileTo 把明文文件 srcPath 加密写入 dstPath（先写临时文件再重命名），源文件保持不变，
+// tus 上传完成后使用
+func encryptFileTo(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := dstPath + ".enc.tmp"
+	if err := encryptToFile(src, tmpPath); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dstPath)
+}
+
+func encryptToFile(src io.Reader, tmpPath string) error {
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	enc, err := newEncryptingWriter(dst)
+	if err == nil {
+		_, err = io.Copy(enc, src)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// ==================== 端到端加密 ====================
+// 浏览器用随机生成的 AES-256-GCM 密钥加密每个块后再调用 /api/upload-chunk，
+// 文件名、大小等元数据同样加密后随 /api/merge-chunks 提交，密钥只放在分享链接的
+// #k= 片段里（片段不会发送到服务器），或由发送方与取件码一起另行告知。
+// 服务器只保存和返回密文：下载、/api/stored-file/ 与管理后台都把这类文件当作不透明数据。
+
+const maxEncryptedMetaLen = 8 * 1024
+
+// isValidEncryptedMeta 只检查加密元数据是 base64 且长度合理，内容服务器无法也无需解读
+func isValidEncryptedMeta(meta string) bool {
+	if meta == "" || len(meta) > maxEncryptedMetaLen {
+		return false
+	}
+	_, err := base64.StdEncoding.DecodeString(meta)
+	return err == nil
+}
+
+// e2eStoredName 端到端加密文件在服务器上的展示名，不泄露原始文件名
+func e2eStoredName(pickupCode string) string {
+	return pickupCode + ".e2e"
+}
+
+// ==================== 多文件包 ====================
+// 多个文件共用一个取件码：POST /api/upload-bundle 以 multipart 流式上传多个 file 字段，
+// GET /api/bundle/<取件码> 列出文件，/api/download-stored/<取件码>/<序号> 下载单个文件，
+// /api/download-stored/<取件码> 则边读边生成 ZIP 下载整个包，不在服务器上暂存归档。
+
+const maxBundleFiles = 1000
+
+func uploadBundleHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Features.ServerStorage {
+		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.ContentLength > maxFileSize {
+		http.Error(w, `{"success":false,"message":"文件过大"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+	apiKey, reservation, ok := authorizeUpload(w, r, r.ContentLength, r.ContentLength)
+	if !ok {
+		return
+	}
+	defer reservation.release()
+	usedSpace := getUsedStorage()
+	if msg := storageQuotaError(usedSpace, r.ContentLength); msg != "" {
+		http.Error(w, fmt.Sprintf(`{"success":false,"message":"%s"}`, msg), http.StatusForbidden)
+		return
+	}
+
+	// Content-Length 未知时（分块传输编码）预留为 0，每个文件都经 reservation.reader 边读边预留，
+	// 所有文件的总大小不会超出剩余额度
+	r.Body = http.MaxBytesReader(w, r.Body, apiKeyMaxFileSize(apiKey))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+		return
+	}
+
+	var entries []*BundleFile
+	var total int64
+	bundleName, password, maxDownloadsValue := "", "", ""
+	seen := make(map[string]int)
+	discard := func() {
+		for _, entry := range entries {
+			os.Remove(filepath.Join(uploadDir, entry.FileName))
+		}
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			discard()
+			http.Error(w, `{"success":false,"message":"读取上传数据失败"}`, http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "name":
+			value, _ := io.ReadAll(io.LimitReader(part, 256))
+			bundleName = strings.TrimSpace(string(value))
+		case "password":
+			value, _ := io.ReadAll(io.LimitReader(part, maxDownloadPasswordLen+1))
+			password = string(value)
+		case "maxDownloads":
+			value, _ := io.ReadAll(io.LimitReader(part, 16))
+			maxDownloadsValue = string(value)
+		case "file", "files":
+			if len(entries) >= maxBundleFiles {
+				part.Close()
+				discard()
+				http.Error(w, `{"success":false,"message":"文件数量过多"}`, http.StatusBadRequest)
+				return
+			}
+			name := uniqueBundlePath(cleanBundlePath(rawPartFileName(part)), seen)
+			if name == "" {
+				part.Close()
+				discard()
+				http.Error(w, `{"success":false,"message":"文件名无效"}`, http.StatusBadRequest)
+				return
+			}
+
+			src, head := sniffStream(reservation.reader(part))
+			if err := checkUploadContent(name, head); err != nil {
+				part.Close()
+				discard()
+				writePolicyViolation(w, r, err)
+				return
+			}
+
+			uniqueName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), sanitizeFilename(path.Base(name)))
+			written, fileHash, err := saveUploadedFileAtomicAndHash(src, filepath.Join(uploadDir, uniqueName))
+			if err != nil {
+				part.Close()
+				discard()
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					http.Error(w, `{"success":false,"message":"文件过大"}`, http.StatusRequestEntityTooLarge)
+					return
+				}
+				if errors.Is(err, errDailyQuotaExceeded) {
+					writeDailyQuotaExceeded(w, apiKey)
+					return
+				}
+				http.Error(w, `{"success":false,"message":"写入文件失败"}`, http.StatusInternalServerError)
+				return
+			}
+			entries = append(entries, &BundleFile{Name: name, FileName: uniqueName, Size: written, FileHash: fileHash, Encrypted: atRestEncrypt})
+			total += written
+		}
+		part.Close()
+	}
+
+	if len(entries) == 0 {
+		http.Error(w, `{"success":false,"message":"没有上传任何文件"}`, http.StatusBadRequest)
+		return
+	}
+	if exceedsStorageQuota(usedSpace, total, "") {
+		discard()
+		http.Error(w, `{"success":false,"message":"存储空间不足"}`, http.StatusForbidden)
+		return
+	}
+	passwordHash, err := hashDownloadPassword(password)
+	if err != nil {
+		discard()
+		http.Error(w, `{"success":false,"message":"下载密码无效"}`, http.StatusBadRequest)
+		return
+	}
+	maxDownloads, err := parseMaxDownloads(maxDownloadsValue)
+	if err != nil {
+		discard()
+		http.Error(w, `{"success":false,"message":"下载次数上限无效"}`, http.StatusBadRequest)
+		return
+	}
+
+	pickupCode := generateUniquePickupCode()
+	if bundleName == "" {
+		bundleName = defaultBundleName(entries, pickupCode)
+	}
+	stored := newStoredFileSession(pickupCode, "", bundleName, total, "")
+	stored.Files = entries
+	stored.PasswordHash = passwordHash
+	stored.MaxDownloads = maxDownloads
+	if err := publishStoredFile(stored); err != nil {
+		writePublishError(w, r, stored, err)
+		return
+	}
+	auditLog(r, requestActor(r), "file.create", stored.PickupCode, auditSuccess, stored.OriginalName)
+	reservation.commit(total)
+	log.Printf("[上传] 多文件包: %s (%s, %d 个文件) - %s", pickupCode, bundleName, len(entries), formatBytes(total))
+
+	response := storedFileUploadResponse(stored)
+	response["isBundle"] = true
+	response["fileCount"] = len(entries)
+	response["files"] = bundleListing(stored)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// 列出多文件包内容
+func bundleListHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Features.ServerStorage {
+		http.Error(w, `{"success":false,"message":"服务器存储功能已禁用"}`, http.StatusForbidden)
+		return
+	}
+
+	code := normalizePickupCode(filepath.Base(r.URL.Path))
+	if rejectLockedClient(w, r) {
+		return
+	}
+	storedFilesMu.RLock()
+	file, exists := storedFiles[code]
+	storedFilesMu.RUnlock()
+	if !exists {
+		recordCodeFailure(codeLimitKey(r))
+		http.Error(w, `{"success":false,"message":"取件码无效或文件已过期"}`, http.StatusNotFound)
+		return
+	}
+	if !authorizeDownload(w, r, file) {
+		return
+	}
+	if !file.IsBundle() {
+		http.Error(w, `{"success":false,"message":"该取件码不是多文件包"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"pickupCode": code,
+		"name":       file.OriginalName,
+		"size":       file.Size,
+		"fileCount":  len(file.Files),
+		"files":      bundleListing(file),
+		"deleteMode": file.DeleteMode,
+	})
+}
+
+func bundleListing(file *FileSession) []map[string]interface{} {
+	files := make([]map[string]interface{}, 0, len(file.Files))
+	for i, entry := range file.Files {
+		files = append(files, map[string]interface{}{
+			"index":       i,
+			"name":        entry.Name,
+			"size":        entry.Size,
+			"fileHash":    entry.FileHash,
+			"downloadUrl": fmt.Sprintf("/api/download-stored/%s/%d", file.PickupCode, i),
+		})
+	}
+	return files
+}
+
+// serveBundleZip 逐个读取包内文件写入 ZIP 流（仅存储不压缩，树莓派上也不占 CPU），完整写出时返回 true
+func serveBundleZip(w http.ResponseWriter, file *FileSession) bool {
+	zipName := file.OriginalName
+	if !strings.HasSuffix(strings.ToLower(zipName), ".zip") {
+		zipName += ".zip"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, zipName))
+	w.Header().Set("Content-Type", "application/zip")
+
+	zw := zip.NewWriter(w)
+	for _, entry := range file.Files {
+		src, err := openStoredRange(entry.FileName, entry.Encrypted, entry.Size, 0, entry.Size)
+		if err != nil {
+			// 响应头已发出，只能中断，客户端会得到不完整的 ZIP
+			log.Printf("[下载] 多文件包 %s 读取 %s 失败: %v", file.PickupCode, entry.Name, err)
+			return false
+		}
+		dst, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entry.Name,
+			Method:   zip.Store,
+			Modified: file.UploadTime,
+		})
+		if err == nil {
+			_, err = io.Copy(dst, src)
+		}
+		src.Close()
+		if err != nil {
+			log.Printf("[下载] 多文件包 %s 写入 ZIP 中断: %v", file.PickupCode, err)
+			return false
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("[下载] 多文件包 %s 写入 ZIP 中断: %v", file.PickupCode, err)
+		return false
+	}
+	return true
+}
+
+// rawPartFileName 读取未经 Base 处理的文件名，保留浏览器上传文件夹时的相对路径
+func rawPartFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return part.FileName()
+	}
+	return params["filename"]
+}
+
+// cleanBundlePath 规范化包内路径，去掉 .. 与开头的 /，防止解压时越出目标目录
+func cleanBundlePath(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// uniqueBundlePath 同名文件追加序号，如 a.jpg、a (2).jpg
+func uniqueBundlePath(name string, seen map[string]int) string {
+	if name == "" {
+		return ""
+	}
+	seen[name]++
+	if seen[name] == 1 {
+		return name
+	}
+	ext := path.Ext(name)
+	candidate := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), seen[name], ext)
+	return uniqueBundlePath(candidate, seen)
+}
+
+// defaultBundleName 所有文件位于同一顶层目录时以目录名命名，否则使用取件码
+func defaultBundleName(entries []*BundleFile, pickupCode string) string {
+	root, _, found := strings.Cut(entries[0].Name, "/")
+	if found {
+		for _, entry := range entries[1:] {
+			if !strings.HasPrefix(entry.Name, root+"/") {
+				found = false
+				break
+			}
+		}
+	}
+	if found {
+		return root
+	}
+	return "File-Rocket-" + pickupCode
+}
+
+// ==================== 健康检查 ====================
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	activeSessionsMu.RLock()
+	storedFilesMu.RLock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "healthy",
+		"activeSessions": len(activeSessions),
+		"storedFiles":    len(storedFiles),
+		"uptime":         time.Since(startTime).Seconds(),
+	})
+
+	storedFilesMu.RUnlock()
+	activeSessionsMu.RUnlock()
+}
+
+// ==================== HTTP 流下载处理 ====================
+
+// downloadStreamHandler 处理 HTTP 流式下载
+// 当接收端不支持 File System Access API 时，通过 iframe 请求此端点进行流式下载
+func downloadStreamHandler(w http.ResponseWriter, r *http.Request) {
+	// 提取取件码
+	code := strings.TrimPrefix(r.URL.Path, "/api/download/")
+	if code == "" || code == "/api/download" {
+		http.Error(w, "取件码无效", http.StatusBadRequest)
+		return
+	}
+	code = normalizePickupCode(code)
+	if rejectLockedClient(w, r) {
+		return
+	}
+
+	// 查找会话
+	activeSessionsMu.RLock()
+	session, exists := activeSessions[code]
+	activeSessionsMu.RUnlock()
+
+	if !exists || session == nil {
+		recordCodeFailure(codeLimitKey(r))
+		http.Error(w, "链接已失效或会话不存在", http.StatusNotFound)
+		return
+	}
+
+	// 设置下载头
+	filename := url.PathEscape(session.FileName)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s; filename*=UTF-8''%s", filename, filename))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if session.Size > 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", session.Size))
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// 检查是否支持 Flusher（用于流式传输）
+	if flusher, ok := w.(http.Flusher); ok {
+		session.DownloadFlusher = flusher
+	}
+	session.DownloadResponse = w
+
+	log.Printf("[HTTP流] %s 开始流式下载，文件名: %s, 大小: %d", code, session.FileName, session.Size)
+
+	// 通知发送端开始传输
+	notifySenderForHTTPDownload(code)
+
+	// 注意：数据将通过 WebSocket 接收后写入 w
+	// 这里不需要直接返回，连接保持打开直到客户端断开或传输完成
+}
+
+var startTime time.Time
+
+// ==================== HTTPS ====================
+// 开启 tls.enabled 后服务直接以 HTTPS 监听 PORT，不再需要反向代理。证书通过 GetCertificate 提供，
+// 后台定期检查证书和私钥文件的修改时间，更新后（如 certbot 续期）自动重新加载，无需重启；
+// 新文件加载失败时继续使用旧证书。tls.selfSigned 在证书文件不存在时生成自签名证书，
+// 浏览器会提示不受信任，确认一次后即可在局域网内使用需要安全上下文的功能。
+// tls.httpRedirectPort 额外监听一个 HTTP 端口，把请求重定向到 HTTPS。
+
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// certReloader 持有当前使用的证书，文件变化后重新加载
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+
+	// 上次加载失败时文件的修改时间，文件再次变化前不重试，避免反复记录同样的错误
+	failedCertMod time.Time
+	failedKeyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// fileModTimes 返回证书和私钥文件的修改时间
+func (c *certReloader) fileModTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// reload 加载证书，成功后才替换当前证书
+func (c *certReloader) reload() error {
+	certMod, keyMod, err := c.fileModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		cert.Leaf = leaf
+		log.Printf("[TLS] 已加载证书 %s，有效期至 %s", c.certFile, leaf.NotAfter.Format("2006-01-02 15:04"))
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	c.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged 在证书或私钥文件的修改时间变化时重新加载。证书和私钥可能不是同时写入，
+// 只更新了其中一个时加载会失败，等另一个文件写入后修改时间再次变化会重试
+func (c *certReloader) reloadIfChanged() {
+	certMod, keyMod, err := c.fileModTimes()
+	if err != nil {
+		return
+	}
+	c.mu.RLock()
+	unchanged := certMod.Equal(c.certMod) && keyMod.Equal(c.keyMod)
+	failed := certMod.Equal(c.failedCertMod) && keyMod.Equal(c.failedKeyMod)
+	c.mu.RUnlock()
+	if unchanged || failed {
+		return
+	}
+	if err := c.reload(); err != nil {
+		log.Printf("[TLS] 重新加载证书失败，继续使用旧证书: %v", err)
+		c.mu.Lock()
+		c.failedCertMod = certMod
+		c.failedKeyMod = keyMod
+		c.mu.Unlock()
+	}
+}
+
+func (c *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.reloadIfChanged()
+	}
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// setupTLS 按配置准备证书：文件不存在且开启 selfSigned 时生成自签名证书，然后开始监视文件变化
+func setupTLS(cfg TLSConfig) (*certReloader, error) {
+	if _, err := os.Stat(cfg.CertFile); os.IsNotExist(err) && cfg.SelfSigned {
+		if err := generateSelfSignedCert(cfg.CertFile, cfg.KeyFile, cfg.Hosts); err != nil {
+			return nil, fmt.Errorf("生成自签名证书失败: %v", err)
+		}
+	}
+
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("加载证书失败: %v", err)
+	}
+	if cfg.ReloadSeconds > 0 {
+		go reloader.watch(time.Duration(cfg.ReloadSeconds) * time.Second)
+	}
+	return reloader, nil
+}
+
+// selfSignedHosts 返回自签名证书包含的域名和 IP：localhost、主机名、本机的非链路本地地址以及配置的额外项
+func selfSignedHosts(extra []string) ([]string, []net.IP) {
+	names := []string{"localhost"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		names = append(names, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	for _, host := range extra {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		} else if host != "" {
+			names = append(names, host)
+		}
+	}
+	return names, ips
+}
+
+// generateSelfSignedCert 生成 ECDSA P-256 自签名证书，私钥只允许当前用户读取
+func generateSelfSignedCert(certFile, keyFile string, extraHosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	names, ips := selfSignedHosts(extraHosts)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"File-Rocket"}, CommonName: "File-Rocket"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+
+	fingerprint := sha256.Sum256(der)
+	log.Printf("[TLS] 已生成自签名证书 %s（%d 天有效），包含: %s %v", certFile, int(selfSignedValidity.Hours()/24), strings.Join(names, " "), ips)
+	log.Printf("[TLS] 证书 SHA-256 指纹: %X", fingerprint)
+	return nil
+}
+
+// redirectToHTTPS 把 HTTP 请求重定向到同一主机的 HTTPS 端口，308 保留请求方法和请求体
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// ==================== 主函数 ====================
+func main() {
+	startTime = time.Now()
+	setup()
+
+	// 命令行参数
+	for i := 1; i < len(os.Args); i++ {
+		if os.Args[i] == "--reset" || os.Args[i] == "-r" {
+			resetConfig()
+			return
+		}
+		if os.Args[i] == "--encrypt-existing" {
+			encryptExistingFiles()
+			return
+		}
+		if os.Args[i] == "--generate-cert" {
+			if err := generateSelfSignedCert(config.TLS.CertFile, config.TLS.KeyFile, config.TLS.Hosts); err != nil {
+				log.Fatalf("[TLS] 生成自签名证书失败: %v", err)
+			}
+			return
+		}
+	}
+
+	// 路由
+	http.HandleFunc("/", staticHandler)
+	http.HandleFunc("/upload", staticHandler)
+	http.HandleFunc("/receive", staticHandler)
+	http.HandleFunc("/admin", staticHandler)
+
+	// API
+	http.HandleFunc("/api/upload-file", uploadFileHandler)
+	http.HandleFunc("/api/upload/", putUploadHandler) // 流式 PUT 上传
+	http.HandleFunc("/api/upload-bundle", uploadBundleHandler)
+	http.HandleFunc("/api/bundle/", bundleListHandler)
+	http.HandleFunc("/api/upload-chunk", handleChunkUpload)
+	http.HandleFunc("/api/merge-chunks", handleMergeChunks)
+	http.HandleFunc("/api/upload-status/", uploadStatusHandler)
+	http.HandleFunc("/api/tus/", tusHandler) // tus 1.0 断点续传协议
+	http.HandleFunc("/api/tus", tusHandler)
+	http.HandleFunc("/api/download-stored/", downloadStoredHandler)
+	http.HandleFunc("/api/unlock/", unlockHandler)            // 验证下载密码
+	http.HandleFunc("/api/signed-links", signedLinksHandler)  // 生成签名下载链接
+	http.HandleFunc("/api/signed-links/", signedLinksHandler) // 撤销签名下载链接
+	http.HandleFunc("/api/signed-download/", signedDownloadHandler)
+	http.HandleFunc("/api/download/", downloadStreamHandler) // HTTP 流下载
+	http.HandleFunc("/api/features", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":       true,
+			"features":      config.Features,
+			"storageConfig": publicStorageConfig(),
+			"pickupCode":    publicPickupCodePolicy(),
+			"theme":         config.Theme,
+			// 上传页据此显示 API 密钥输入框
+			"uploadRequiresApiKey": config.Security.RequireAPIKeyForUpload,
+		})
+	})
+	http.HandleFunc("/api/stored-file/", func(w http.ResponseWriter, r *http.Request) {
+		code := normalizePickupCode(filepath.Base(r.URL.Path))
+		if rejectLockedClient(w, r) {
+			return
+		}
+		storedFilesMu.RLock()
+		file, exists := storedFiles[code]
+		if !exists {
+			storedFilesMu.RUnlock()
+			recordCodeFailure(codeLimitKey(r))
+			http.Error(w, `{"success":false,"message":"取件码无效或文件已过期"}`, http.StatusNotFound)
+			return
+		}
+		downloadCount := file.DownloadCount
+		storedFilesMu.RUnlock()
+
+		// 受密码保护的文件在解锁前只透露需要密码
+		w.Header().Set("Content-Type", "application/json")
+		if !isDownloadUnlocked(r, file) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":          true,
+				"pickupCode":       code,
+				"passwordRequired": true,
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":          true,
+			"pickupCode":       code,
+			"passwordRequired": file.PasswordHash != "",
+			"fileName":         file.OriginalName,
+			"size":             file.Size,
+			"fileHash":         file.FileHash,
+			"deleteMode":       file.DeleteMode,
+			"maxDownloads":     file.MaxDownloads,
+			"downloadCount":    downloadCount,
+			"isBundle":         file.IsBundle(),
+			"fileCount":        len(file.Files),
+			"e2e":              file.E2E,
+			"encryptedMeta":    file.EncryptedMeta,
+		})
+	})
+	http.HandleFunc("/api/pickup-code/", func(w http.ResponseWriter, r *http.Request) {
+		code := normalizePickupCode(filepath.Base(r.URL.Path))
+		if code == "" || code == "pickup-code" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": "取件码不能为空",
+			})
+			return
+		}
+		if rejectLockedClient(w, r) {
+			return
+		}
+
+		activeSessionsMu.RLock()
+		session, sessionExists := activeSessions[code]
+		activeSessionsMu.RUnlock()
+		if sessionExists {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":    true,
+				"exists":     true,
+				"pickupCode": code,
+				"mode":       session.Mode,
+				"fileName":   session.FileName,
+				"size":       session.Size,
+			})
+			return
+		}
+
+		storedFilesMu.RLock()
+		file, fileExists := storedFiles[code]
+		storedFilesMu.RUnlock()
+		if fileExists {
+			w.Header().Set("Content-Type", "application/json")
+			if !isDownloadUnlocked(r, file) {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success":          true,
+					"exists":           true,
+					"pickupCode":       code,
+					"mode":             "storage",
+					"passwordRequired": true,
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":          true,
+				"exists":           true,
+				"pickupCode":       code,
+				"mode":             "storage",
+				"passwordRequired": file.PasswordHash != "",
+				"fileName":         file.OriginalName,
+				"size":             file.Size,
+				"fileHash":         file.FileHash,
+				"deleteMode":       file.DeleteMode,
+				"isBundle":         file.IsBundle(),
+				"fileCount":        len(file.Files),
+				"e2e":              file.E2E,
+				"encryptedMeta":    file.EncryptedMeta,
+			})
+			return
+		}
+
+		recordCodeFailure(codeLimitKey(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"exists":     false,
+			"pickupCode": code,
+			"mode":       "",
+		})
+	})
+
+	// 健康检查
+	http.HandleFunc("/health", healthHandler)
+
+	// 管理员 API
+	setupAdminRoutes()
+
+	// WebSocket
+	http.HandleFunc("/ws", wsHandler)
+
+	// 上传目录不直接对外提供：存储文件只能经由下载接口取得，才能校验下载密码、次数上限、
+	// 查找限制、签名链接和隔离状态
+
+	port := getEnvOrDefault("PORT", "3000")
+	handler := withAPIKey(adminOriginGuard(http.DefaultServeMux))
+
+	if !config.TLS.Enabled {
+		log.Printf("🚀 File-Rocket 服务器启动成功!")
+		log.Printf("📍 访问地址: http://localhost:%s", port)
+		log.Printf("🔐 管理后台: 点击首页版权文字 4 次")
+
+		if err := http.ListenAndServe(":"+port, handler); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	reloader, err := setupTLS(config.TLS)
+	if err != nil {
+		log.Fatalf("[TLS] %v", err)
+	}
+	if redirectPort := config.TLS.HTTPRedirectPort; redirectPort != "" {
+		go func() {
+			log.Printf("[TLS] HTTP 端口 %s 重定向到 HTTPS", redirectPort)
+			if err := http.ListenAndServe(":"+redirectPort, redirectToHTTPS(port)); err != nil {
+				log.Fatalf("[TLS] HTTP 重定向端口监听失败: %v", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		},
+	}
+	log.Printf("🚀 File-Rocket 服务器启动成功!")
+	log.Printf("📍 访问地址: https://localhost:%s", port)
+	log.Printf("🔐 管理后台: 点击首页版权文字 4 次")
+
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func getEnvOrDefault(key, defaultVal string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
+// resetConfig 把配置重置为默认值，重新创建 owner 账户并生成随机初始密码，和 saveConfig 一样原子写入
+func resetConfig() {
+	config = getDefaultConfig()
+	if err := migrateAdminAccounts(); err != nil {
+		log.Fatalf("[安全] %v", err)
+	}
+	log.Println("配置已重置为默认值")
+}
+
+// ==================== WebSocket 处理器 ====================
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectDisallowedOrigin(w, r) {
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[WS] 建立连接失败: %v", err)
+		return
+	}
+
+	socketID := generateToken()[:8]
+	log.Printf("[WS] 新连接: %s", socketID)
+
+	client := &WSClient{
+		conn:     conn,
+		socketID: socketID,
+		ip:       clientIP(r),
+		send:     make(chan OutgoingMessage, 256),
+	}
+
+	wsClientsMu.Lock()
+	wsClients[socketID] = client
+	wsClientsMu.Unlock()
+
+	go client.writePump()
+	go client.readPump()
+}
+
+type WSClient struct {
+	conn            *websocket.Conn
+	socketID        string
+	ip              string // 来源 IP，用于取件码查找限制
+	send            chan OutgoingMessage
+	UploadingFileID string // 跟踪正在进行的分块上传，用于断开时清理
+}
+
+type OutgoingMessage struct {
+	MessageType int
+	Data        []byte
+}
+
+func (c *WSClient) readPump() {
+	defer func() {
+		log.Printf("[WS] 断开连接: %s", c.socketID)
+		wsClientsMu.Lock()
+		delete(wsClients, c.socketID)
+		wsClientsMu.Unlock()
+		c.conn.Close()
+		cleanupSession(c.socketID)
+
+		// 未完成的分块上传保留一段宽限期，客户端重连后可以续传，超时由 cleanupRoutine 清理
+		if c.UploadingFileID != "" {
+			log.Printf("[分块上传] 连接断开，保留未完成的上传 %s（%v 内可续传）", c.UploadingFileID, chunkGracePeriod())
+		}
+	}()
+
+	c.conn.SetReadLimit(maxFileSize)
+	c.conn.SetReadDeadline(time.Now().Add(time.Duration(config.Security.SessionTimeout) * time.Millisecond))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(time.Duration(config.Security.SessionTimeout) * time.Millisecond))
+		return nil
+	})
+
+	for {
+		messageType, message, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("[WS] 读取错误: %v", err)
+			}
+			break
+		}
+
+		if messageType == websocket.BinaryMessage {
+			c.handleBinaryChunk(message)
+			continue
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var wsMsg WSMessage
+		if err := json.Unmarshal(message, &wsMsg); err != nil {
+			log.Printf("[WS] 消息解析错误: %v", err)
+			continue
+		}
+
+		c.handleMessage(wsMsg)
+	}
+}
+
+func (c *WSClient) writePump() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := c.conn.WriteMessage(message.MessageType, message.Data); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *WSClient) handleMessage(msg WSMessage) {
+	switch msg.Type {
+	case "create-session":
+		c.handleCreateSession(msg)
+	case "join-session":
+		c.handleJoinSession(msg)
+	case "receiver-ready":
+		c.handleReceiverReady(msg)
+	case "receiver-sink-ready":
+		c.handleReceiverSinkReady(msg)
+	case "receiver-fatal":
+		c.handleReceiverFatal(msg)
+	case "signal":
+		c.handleSignal(msg)
+	case "transfer-start":
+		c.handleTransferStart(msg)
+	case "chunk-meta":
+		c.handleChunkMeta(msg)
+	case "chunk-ack":
+		c.handleChunkAck(msg)
+	case "chunk-nack":
+		c.handleChunkNack(msg)
+	case "transfer-end":
+		c.handleTransferEnd(msg)
+	case "transfer-complete":
+		c.handleTransferComplete(msg)
+	case "verify-ok":
+		c.handleVerifyOk(msg)
+	case "verify-fail":
+		c.handleVerifyFail(msg)
+	case "transfer-chunk":
+		c.handleTransferChunk(msg)
+	case "cancel":
+		c.handleCancel(msg)
+	case "heartbeat":
+		c.handleHeartbeat()
+	case "p2p-nat-info":
+		c.handleP2PNATInfo(msg)
+	case "register-chunk-upload":
+		c.handleRegisterChunkUpload(msg)
+	case "chunk-upload-complete":
+		c.handleChunkUploadComplete(msg)
+	}
+}
+
+func (c *WSClient) handleCreateSession(msg WSMessage) {
+	payload := msg.Payload.(map[string]interface{})
+	fileName := payload["fileName"].(string)
+	fileSize := int64(payload["fileSize"].(float64))
+	mode := payload["mode"].(string)
+
+	if !isModeEnabled(mode) {
+		c.sendError("此传输模式已禁用")
+		return
+	}
+
+	// 中转和 P2P 模式下文件内容不落盘，按文件名和发送端提供的开头字节（base64）检查内容策略，
+	// 没有提供开头字节时使用浏览器声明的类型
+	if contentPolicyActive() {
+		mimeType, _ := payload["fileType"].(string)
+		if encoded, _ := payload["head"].(string); encoded != "" {
+			if head, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				mimeType = detectContentType(head)
+			}
+		}
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		if err := checkContentPolicy(fileName, mimeType); err != nil {
+			log.Printf("[内容策略] 拒绝创建会话 (%s): %v", c.ip, err)
+			c.sendError(err.Error())
+			return
+		}
+	}
+
+	// 浏览器建立 WebSocket 时无法附加请求头，API 密钥放在消息中
+	rawKey, _ := payload["apiKey"].(string)
+	var key *APIKey
+	if rawKey != "" {
+		key = lookupAPIKey(rawKey)
+	}
+	_, reservation, _, message := authorizeUploadKey(rawKey, key, fileSize, fileSize)
+	if message != "" {
+		c.sendError(message)
+		return
+	}
+	// 中转和 P2P 的数据不经过服务器存储，创建会话即按文件大小计入额度
+	reservation.commit(fileSize)
+
+	pickupCode := generateUniquePickupCode()
+
+	// 创建传输通道
+	transferChanMu.Lock()
+	fileTransferChannels[pickupCode] = make(chan []byte, 1024)
+	transferChanMu.Unlock()
+
+	now := time.Now()
+	session := &ActiveSession{
+		SocketID:         c.socketID,
+		PickupCode:       pickupCode,
+		Mode:             mode,
+		FileName:         fileName,
+		Size:             fileSize,
+		CreatedAt:        now,
+		LastActiveAt:     now,
+		IsSender:         true,
+		ExpectedFileHash: "",
+		PendingChunkMeta: make(map[int]map[string]interface{}),
+	}
+
+	activeSessionsMu.Lock()
+	activeSessions[pickupCode] = session
+	activeSessionsMu.Unlock()
+	releasePickupCode(pickupCode)
+	recordTransfer()
+
+	c.sendJSON(WSMessage{
+		Type: "session-created",
+		Payload: map[string]interface{}{
+			"pickupCode": pickupCode,
+			"mode":       mode,
+		},
+	})
+
+	log.Printf("[WS] 会话创建: %s (%s) - %s", pickupCode, mode, formatBytes(fileSize))
+}
+
+func (c *WSClient) handleJoinSession(msg WSMessage) {
+	payload := msg.Payload.(map[string]interface{})
+	pickupCode := normalizePickupCode(payload["pickupCode"].(string))
+	mode := payload["mode"].(string)
+	capabilities, _ := payload["capabilities"].(map[string]interface{}) // 提取接收端能力
+
+	if remaining := codeLockout(c.ip); remaining > 0 {
+		c.sendError(lockoutMessage(remaining))
+		return
+	}
+
+	activeSessionsMu.RLock()
+	session, exists := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+
+	if !exists {
+		if !isModeEnabled(mode) {
+			c.sendError("此传输模式已禁用")
+			return
+		}
+
+		storedFilesMu.RLock()
+		file, fileExists := storedFiles[pickupCode]
+		storedFilesMu.RUnlock()
+
+		if !fileExists {
+			recordCodeFailure(c.ip)
+			c.sendError("取件码无效")
+			return
+		}
+
+		// 服务器存储模式，受密码保护的文件只告知需要密码，由接收端解锁后再查询详情
+		if file.PasswordHash != "" {
+			c.sendJSON(WSMessage{
+				Type: "storage-mode",
+				Payload: map[string]interface{}{
+					"pickupCode":       pickupCode,
+					"passwordRequired": true,
+				},
+			})
+			log.Printf("[WS] 存储模式连接: %s（需要密码）", pickupCode)
+			return
+		}
+		c.sendJSON(WSMessage{
+			Type: "storage-mode",
+			Payload: map[string]interface{}{
+				"pickupCode":    pickupCode,
+				"fileName":      file.OriginalName,
+				"size":          file.Size,
+				"isBundle":      file.IsBundle(),
+				"fileCount":     len(file.Files),
+				"e2e":           file.E2E,
+				"encryptedMeta": file.EncryptedMeta,
+			},
+		})
+		log.Printf("[WS] 存储模式连接: %s", pickupCode)
+		return
+	}
+
+	// 更新会话中的接收者 / 模式回退
+	activeSessionsMu.Lock()
+	if session.ReceiverSocketID == "" {
+		session.ReceiverSocketID = c.socketID
+	}
+	if session.Mode != "" && mode == "memory" && session.Mode == "p2p" {
+		log.Printf("[WS] P2P 会话回退到 memory: %s", pickupCode)
+		session.Mode = "memory"
+	}
+	effectiveMode := session.Mode
+	activeSessionsMu.Unlock()
+
+	// 发送会话信息给接收方
+	c.sendJSON(WSMessage{
+		Type: "session-joined",
+		Payload: map[string]interface{}{
+			"pickupCode": pickupCode,
+			"fileName":   session.FileName,
+			"size":       session.Size,
+			"mode":       effectiveMode,
+		},
+	})
+
+	// 通知发送方
+	sendToSocket(session.SocketID, WSMessage{
+		Type: "receiver-connected",
+		Payload: map[string]interface{}{
+			"capabilities": capabilities,
+		},
+	})
+
+	log.Printf("[WS] 加入会话: %s", pickupCode)
+}
+
+func (c *WSClient) handleReceiverReady(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		return
+	}
+
+	activeSessionsMu.RLock()
+	session := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+	if session == nil || session.ReceiverSocketID != c.socketID {
+		return
+	}
+
+	sendToSocket(session.SocketID, WSMessage{Type: "receiver-ready"})
+}
+
+func (c *WSClient) handleReceiverSinkReady(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		return
+	}
+
+	activeSessionsMu.RLock()
+	session := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+	if session == nil || session.ReceiverSocketID != c.socketID {
+		return
+	}
+
+	sendToSocket(session.SocketID, WSMessage{
+		Type:    "receiver-sink-ready",
+		Payload: payload,
+	})
+}
+
+func (c *WSClient) handleReceiverFatal(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		return
+	}
+
+	activeSessionsMu.RLock()
+	session := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+	if session == nil || session.ReceiverSocketID != c.socketID {
+		return
+	}
+
+	sendToSocket(session.SocketID, WSMessage{
+		Type:    "receiver-fatal",
+		Payload: payload,
+	})
+}
+
+func (c *WSClient) handleSignal(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		return
+	}
+
+	activeSessionsMu.RLock()
+	session := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+	if session == nil {
+		return
+	}
+
+	if c.socketID == session.SocketID && session.ReceiverSocketID != "" {
+		sendToSocket(session.ReceiverSocketID, WSMessage{
+			Type:    "signal",
+			Payload: payload,
+		})
+		return
+	}
+
+	if c.socketID == session.ReceiverSocketID && session.SocketID != "" {
+		sendToSocket(session.SocketID, WSMessage{
+			Type:    "signal",
+			Payload: payload,
+		})
+	}
+}
+
+func (c *WSClient) handleP2PNATInfo(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		return
+	}
+	natType, _ := payload["natType"].(map[string]interface{})
+	role, _ := payload["role"].(string)
+	if natType == nil || role == "" {
+		return
+	}
+
+	activeSessionsMu.Lock()
+	session := activeSessions[pickupCode]
+	if session == nil {
+		activeSessionsMu.Unlock()
+		return
+	}
+
+	if role == "sender" && c.socketID == session.SocketID {
+		session.SenderNAT = natType
+		receiverSocketID := session.ReceiverSocketID
+		activeSessionsMu.Unlock()
+		if receiverSocketID != "" {
+			sendToSocket(receiverSocketID, WSMessage{
+				Type: "p2p-nat-info",
+				Payload: map[string]interface{}{
+					"pickupCode": pickupCode,
+					"natType":    natType,
+					"role":       "sender",
+				},
+			})
+		}
+	} else if role == "receiver" && c.socketID == session.ReceiverSocketID {
+		session.ReceiverNAT = natType
+		senderSocketID := session.SocketID
+		senderNAT := session.SenderNAT
+		activeSessionsMu.Unlock()
+		if senderSocketID != "" {
+			sendToSocket(senderSocketID, WSMessage{
+				Type: "p2p-nat-info",
+				Payload: map[string]interface{}{
+					"pickupCode": pickupCode,
+					"natType":    natType,
+					"role":       "receiver",
+				},
+			})
+		}
+		// 补发发送端 NAT 信息给接收端（解决时序竞争）
+		if senderNAT != nil {
+			sendToSocket(c.socketID, WSMessage{
+				Type: "p2p-nat-info",
+				Payload: map[string]interface{}{
+					"pickupCode": pickupCode,
+					"natType":    senderNAT,
+					"role":       "sender",
+				},
+			})
+		}
+	} else {
+		activeSessionsMu.Unlock()
+	}
+}
+
+func (c *WSClient) handleRegisterChunkUpload(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	fileID, _ := payload["fileID"].(string)
+	if fileID == "" {
+		return
+	}
+
+	c.UploadingFileID = fileID
+	log.Printf("[分块上传] 注册上传会话: %s -> %s", c.socketID, fileID)
+
+	c.sendJSON(WSMessage{
+		Type: "chunk-upload-registered",
+		Payload: map[string]interface{}{
+			"fileID": fileID,
+		},
+	})
+}
+
+func (c *WSClient) handleChunkUploadComplete(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	fileID, _ := payload["fileID"].(string)
+
+	if c.UploadingFileID == fileID || fileID == "" {
+		log.Printf("[分块上传] 上传完成，清除跟踪: %s -> %s", c.socketID, c.UploadingFileID)
+		c.UploadingFileID = ""
+	}
+}
+
+func (c *WSClient) getSessionBySocketID(socketID string) (string, *ActiveSession, bool) {
+	activeSessionsMu.RLock()
+	defer activeSessionsMu.RUnlock()
+	for code, session := range activeSessions {
+		if session == nil {
+			continue
+		}
+		if session.SocketID == socketID || session.ReceiverSocketID == socketID {
+			return code, session, true
+		}
+	}
+	return "", nil, false
+}
+
+func (c *WSClient) getSessionBySenderSocket() (string, *ActiveSession) {
+	activeSessionsMu.RLock()
+	defer activeSessionsMu.RUnlock()
+	for code, session := range activeSessions {
+		if session != nil && session.SocketID == c.socketID {
+			return code, session
+		}
+	}
+	return "", nil
+}
+
+func (c *WSClient) handleTransferStart(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		pickupCode, _ = c.getSessionBySenderSocket()
+	}
+
+	activeSessionsMu.Lock()
+	session := activeSessions[pickupCode]
+	if session == nil || session.SocketID != c.socketID || session.ReceiverSocketID == "" {
+		activeSessionsMu.Unlock()
+		return
+	}
+	if fileHash, ok := payload["fileHash"].(string); ok {
+		session.ExpectedFileHash = strings.ToLower(strings.TrimSpace(fileHash))
+	}
+	receiverSocketID := session.ReceiverSocketID
+	activeSessionsMu.Unlock()
+
+	sendToSocket(receiverSocketID, msg)
+}
+
+func (c *WSClient) handleChunkMeta(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		pickupCode, _ = c.getSessionBySenderSocket()
+	}
+
+	activeSessionsMu.Lock()
+	session := activeSessions[pickupCode]
+	if session == nil || session.SocketID != c.socketID || session.ReceiverSocketID == "" {
+		activeSessionsMu.Unlock()
+		return
+	}
+	if session.PendingChunkMeta == nil {
+		session.PendingChunkMeta = make(map[int]map[string]interface{})
+	}
+	chunkIndexFloat, ok := payload["chunkIndex"].(float64)
+	if !ok {
+		activeSessionsMu.Unlock()
+		return
+	}
+	chunkIndex := int(chunkIndexFloat)
+	session.PendingChunkMeta[chunkIndex] = payload
+	receiverSocketID := session.ReceiverSocketID
+	activeSessionsMu.Unlock()
+
+	sendToSocket(receiverSocketID, msg)
+}
+
+func (c *WSClient) handleChunkAck(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		pickupCode, session, exists := c.getSessionBySocketID(c.socketID)
+		if !exists || session == nil {
+			return
+		}
+		_ = pickupCode
+	}
+
+	activeSessionsMu.Lock()
+	session := activeSessions[pickupCode]
+	if session == nil || session.ReceiverSocketID != c.socketID || session.SocketID == "" {
+		activeSessionsMu.Unlock()
+		return
+	}
+	chunkIndexFloat, hasChunkIndex := payload["chunkIndex"].(float64)
+	if hasChunkIndex && session.PendingChunkMeta != nil {
+		delete(session.PendingChunkMeta, int(chunkIndexFloat))
+	}
+	senderSocketID := session.SocketID
+	receiverSocketID := session.ReceiverSocketID
+	shouldFlushEnd := session.PendingTransferEnd && len(session.PendingChunkMeta) == 0
+	endPayload := session.TransferEndPayload
+	if shouldFlushEnd {
+		session.PendingTransferEnd = false
+		session.TransferEndPayload = nil
+	}
+	activeSessionsMu.Unlock()
+
+	sendToSocket(senderSocketID, msg)
+	if shouldFlushEnd {
+		sendToSocket(receiverSocketID, WSMessage{Type: "transfer-end", Payload: endPayload})
+	}
+}
+
+func (c *WSClient) handleChunkNack(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		pickupCode, session, exists := c.getSessionBySocketID(c.socketID)
+		if !exists || session == nil {
+			return
+		}
+		_ = pickupCode
+	}
+
+	activeSessionsMu.RLock()
+	session := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+	if session == nil || session.ReceiverSocketID != c.socketID || session.SocketID == "" {
+		return
+	}
+
+	sendToSocket(session.SocketID, WSMessage{
+		Type:    "chunk-nack",
+		Payload: payload,
+	})
+}
+
+func (c *WSClient) handleTransferEnd(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		pickupCode, _ = c.getSessionBySenderSocket()
+	}
+
+	activeSessionsMu.Lock()
+	session := activeSessions[pickupCode]
+	if session == nil {
+		activeSessionsMu.Unlock()
+		return
+	}
+
+	// 检查是否是 HTTP 流下载模式
+	isHTTPStream := session.DownloadResponse != nil
+
+	// 如果是 HTTP 流模式且没有接收端，结束传输
+	if isHTTPStream && session.ReceiverSocketID == "" {
+		// 关闭 HTTP 响应
+		if h, ok := session.DownloadResponse.(http.Hijacker); ok {
+			h.Hijack()
+		}
+		session.DownloadResponse = nil
+		session.DownloadFlusher = nil
+		log.Printf("[HTTP流] %s 传输完成，关闭连接", pickupCode)
+		activeSessionsMu.Unlock()
+		return
+	}
+
+	if session.SocketID != c.socketID || session.ReceiverSocketID == "" {
+		activeSessionsMu.Unlock()
+		return
+	}
+	receiverSocketID := session.ReceiverSocketID
+	pendingCount := len(session.PendingChunkMeta)
+	if pendingCount > 0 {
+		session.PendingTransferEnd = true
+		session.TransferEndPayload = payload
+	}
+	activeSessionsMu.Unlock()
+
+	if pendingCount > 0 {
+		log.Printf("[WS] transfer-end 延迟转发，仍有 %d 个分块未ACK: %s", pendingCount, pickupCode)
+		return
+	}
+
+	sendToSocket(receiverSocketID, msg)
+}
+
+func (c *WSClient) handleTransferChunk(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		pickupCode, _ = c.getSessionBySenderSocket()
+	}
+
+	activeSessionsMu.RLock()
+	session := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+	if session == nil || session.SocketID != c.socketID || session.ReceiverSocketID == "" {
+		return
+	}
+
+	sendToSocket(session.ReceiverSocketID, msg)
+}
+
+func (c *WSClient) handleTransferComplete(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		return
+	}
+
+	activeSessionsMu.RLock()
+	session := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+	if session == nil {
+		return
+	}
+
+	if c.socketID == session.ReceiverSocketID {
+		sendToSocket(session.SocketID, WSMessage{Type: "transfer-complete"})
+	}
+}
+
+func (c *WSClient) handleVerifyOk(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		return
+	}
+	actualHash := strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", payload["actualHash"])))
+
+	activeSessionsMu.RLock()
+	session := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+	if session == nil || c.socketID != session.ReceiverSocketID {
+		return
+	}
+
+	expectedHash := strings.ToLower(strings.TrimSpace(session.ExpectedFileHash))
+	if expectedHash != "" && actualHash != "" && expectedHash != actualHash {
+		sendToSocket(session.SocketID, WSMessage{
+			Type: "verify-fail",
+			Payload: map[string]interface{}{
+				"pickupCode": pickupCode,
+				"reason":     fmt.Sprintf("接收端校验值与发送端期望不一致: expected=%s actual=%s", expectedHash, actualHash),
+			},
+		})
+		return
+	}
+
+	sendToSocket(session.SocketID, WSMessage{
+		Type: "verify-ok",
+		Payload: map[string]interface{}{
+			"pickupCode": pickupCode,
+			"actualHash": actualHash,
+		},
+	})
+}
+
+func (c *WSClient) handleVerifyFail(msg WSMessage) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pickupCode, _ := payload["pickupCode"].(string)
+	if pickupCode == "" {
+		return
+	}
+
+	activeSessionsMu.RLock()
+	session := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+	if session == nil || c.socketID != session.ReceiverSocketID {
+		return
+	}
+
+	sendToSocket(session.SocketID, WSMessage{
+		Type:    "verify-fail",
+		Payload: payload,
+	})
+}
+
+func (c *WSClient) handleBinaryChunk(data []byte) {
+	pickupCode, session := c.getSessionBySenderSocket()
+	if session == nil || pickupCode == "" {
+		return
+	}
+
+	// 检查是否是 HTTP 流下载模式
+	if session.DownloadResponse != nil && !session.PendingTransferEnd {
+		// HTTP 流模式：写入 HTTP 响应
+		_, err := session.DownloadResponse.Write(data)
+		if err != nil {
+			log.Printf("[HTTP流] %s 写入数据失败: %v", pickupCode, err)
+			return
+		}
+		// 立即刷新，让浏览器边传边下载
+		if session.DownloadFlusher != nil {
+			session.DownloadFlusher.Flush()
+		}
+		return
+	}
+
+	// 普通模式：转发给接收端
+	if session.ReceiverSocketID == "" {
+		return
+	}
+
+	wsClientsMu.RLock()
+	receiver, exists := wsClients[session.ReceiverSocketID]
+	wsClientsMu.RUnlock()
+	if !exists || receiver == nil {
+		return
+	}
+
+	receiver.sendBinary(data)
+}
+
+func (c *WSClient) handleCancel(msg WSMessage) {
+	payload := msg.Payload.(map[string]interface{})
+	pickupCode := payload["pickupCode"].(string)
+
+	cleanupSession(pickupCode)
+
+	sendToSocketID, _ := payload["socketID"].(string)
+	if sendToSocketID != "" {
+		sendToSocket(sendToSocketID, WSMessage{Type: "transfer-cancelled"})
+	}
+}
+
+func (c *WSClient) sendJSON(msg WSMessage) {
+	data, _ := json.Marshal(msg)
+	select {
+	case c.send <- OutgoingMessage{MessageType: websocket.TextMessage, Data: data}:
+	default:
+		log.Printf("[WS] 发送队列满: %s", c.socketID)
+	}
+}
+
+func (c *WSClient) sendBinary(data []byte) {
+	select {
+	case c.send <- OutgoingMessage{MessageType: websocket.BinaryMessage, Data: data}:
+	default:
+		log.Printf("[WS] 二进制发送队列满: %s", c.socketID)
+	}
+}
+
+func (c *WSClient) sendError(message string) {
+	c.sendJSON(WSMessage{
+		Type:    "error",
+		Payload: message,
+	})
+}
+
+func sendToSocket(socketID string, msg WSMessage) {
+	wsClientsMu.RLock()
+	client, exists := wsClients[socketID]
+	wsClientsMu.RUnlock()
+	if !exists || client == nil {
+		return
+	}
+	client.sendJSON(msg)
+}
+
+// notifySenderForHTTPDownload 通知发送端开始通过 HTTP 流发送数据
+func notifySenderForHTTPDownload(pickupCode string) {
+	activeSessionsMu.RLock()
+	session, exists := activeSessions[pickupCode]
+	activeSessionsMu.RUnlock()
+
+	if !exists || session == nil {
+		log.Printf("[HTTP流] %s 会话不存在", pickupCode)
+		return
+	}
+
+	// 通知发送端开始传输，数据将通过 WebSocket 发送到服务器，然后写入 HTTP 响应
+	if session.SocketID != "" {
+		sendToSocket(session.SocketID, WSMessage{
+			Type: "start-transfer",
+			Payload: map[string]interface{}{
+				"pickupCode": pickupCode,
+				"dataPlane":  "http-stream", // 标记为 HTTP 流模式
+			},
+		})
+		log.Printf("[HTTP流] %s 已通知发送端开始传输", pickupCode)
+	}
+}
+
+func cleanupSession(socketID string) {
+	activeSessionsMu.Lock()
+	defer activeSessionsMu.Unlock()
+
+	for code, session := range activeSessions {
+		if session.SocketID == socketID || session.ReceiverSocketID == socketID {
+			role := "sender"
+			if session.ReceiverSocketID == socketID {
+				role = "receiver"
+			}
+
+			delete(activeSessions, code)
+			log.Printf("[WS] 清理会话: %s (由 %s 断开)", code, role)
+
+			transferChanMu.Lock()
+			delete(fileTransferChannels, code)
+			transferChanMu.Unlock()
+			break
+		}
+	}
+}
+
+// terminateSession 结束一个传输会话并以 error 消息通知发送端和接收端
+func terminateSession(code, reason string) bool {
+	activeSessionsMu.Lock()
+	session, exists := activeSessions[code]
+	if exists {
+		delete(activeSessions, code)
+	}
+	activeSessionsMu.Unlock()
+	if !exists {
+		return false
+	}
+
+	transferChanMu.Lock()
+	delete(fileTransferChannels, code)
+	transferChanMu.Unlock()
+
+	for _, socketID := range []string{session.SocketID, session.ReceiverSocketID} {
+		if socketID != "" {
+			sendToSocket(socketID, WSMessage{Type: "error", Payload: reason})
+		}
+	}
+	log.Printf("[WS] 终止会话: %s (%s)", code, reason)
+	return true
+}
+
+func (c *WSClient) handleHeartbeat() {
+	// 重置 WebSocket 读超时，防止 Pong 丢失导致连接断开
+	c.conn.SetReadDeadline(time.Now().Add(time.Duration(config.Security.SessionTimeout) * time.Millisecond))
+
+	activeSessionsMu.Lock()
+	defer activeSessionsMu.Unlock()
+
+	for _, session := range activeSessions {
+		if session.SocketID == c.socketID {
+			session.LastActiveAt = time.Now()
+			break
+		}
+	}
+}
+
+func isModeEnabled(mode string) bool {
+	switch mode {
+	case "memory":
+		return config.Features.MemoryStreaming
+	case "storage":
+		return config.Features.ServerStorage
+	case "p2p":
+		return config.Features.P2PDirect
+	}
+	return false
+}
+
+// ==================== 管理员账户 ====================
+// 管理后台按账户登录，每个账户有一个角色：viewer 只能查看统计和文件列表；operator 还可以删除文件、
+// 终止传输会话、解除锁定和撤销链接；owner 可以修改配置与存储设置，并管理账户。
+// 密码以 argon2id 哈希保存。旧版本只有一个共享密码（明文 adminPassword 或无盐 SHA-256 的
+// adminPasswordHash），启动时迁移为 owner 账户 admin；SHA-256 哈希在下次登录成功时升级。
+
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleOwner    = "owner"
+
+	defaultAdminUsername = "admin"
+	maxAdminPasswordLen  = 128
+)
+
+var adminRoleLevels = map[string]int{roleViewer: 1, roleOperator: 2, roleOwner: 3}
+
+var adminUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// AdminUser 是一个管理员账户，保存在 config.AdminUsers 中，由 adminUsersMu 保护（saveConfig 会加读锁，持有写锁时不能调用）
+type AdminUser struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Role         string    `json:"role"`
+	Disabled     bool      `json:"disabled,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	// 两步验证：TOTPSecret 为 base32 密钥，非空表示已启用；RecoveryCodes 为恢复码的 SHA-256，每个只能使用一次
+	TOTPSecret    string   `json:"totpSecret,omitempty"`
+	TOTPLastStep  int64    `json:"totpLastStep,omitempty"` // 最近一次通过验证的时间步，同一验证码不能重复使用
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+var adminUsersMu sync.RWMutex
+
+// migrateAdminAccounts 把旧版本的共享密码迁移为 owner 账户 admin。
+// 全新安装没有任何密码时生成随机初始密码，只在日志中显示这一次
+func migrateAdminAccounts() error {
+	if len(config.AdminUsers) > 0 {
+		if config.AdminPassword != "" || config.AdminPasswordHash != "" {
+			config.AdminPassword, config.AdminPasswordHash = "", ""
+			saveConfig()
+		}
+		return nil
+	}
+
+	hash := config.AdminPasswordHash
+	migrated := config.AdminPassword != "" || hash != ""
+	if config.AdminPassword != "" || hash == "" {
+		password := config.AdminPassword
+		if password == "" {
+			password = generateToken()[:16]
+			log.Printf("[安全] 已创建 owner 账户 %s，初始密码: %s（只显示这一次，请登录后立即修改）", defaultAdminUsername, password)
+		} else if hash != "" {
+			log.Println("[安全] 配置中同时存在明文密码和哈希，以明文密码为准")
+		}
+		var err error
+		if hash, err = hashPasswordArgon2(password); err != nil {
+			return fmt.Errorf("管理员密码哈希失败: %v", err)
+		}
+	}
+
+	config.AdminUsers = []*AdminUser{{
+		Username:     defaultAdminUsername,
+		PasswordHash: hash,
+		Role:         roleOwner,
+		CreatedAt:    time.Now(),
+	}}
+	config.AdminPassword, config.AdminPasswordHash = "", ""
+	saveConfig()
+	if migrated {
+		log.Printf("[安全] 管理员密码已迁移为 owner 账户 %s", defaultAdminUsername)
+	}
+	return nil
+}
+
+// findAdminUserLocked 按用户名查找账户（不区分大小写），调用方需持有 adminUsersMu
+func findAdminUserLocked(username string) *AdminUser {
+	for _, user := range config.AdminUsers {
+		if strings.EqualFold(user.Username, username) {
+			return user
+		}
+	}
+	return nil
+}
+
+// countActiveOwnersLocked 统计未停用的 owner 账户数量，防止最后一个 owner 被降级或停用
+func countActiveOwnersLocked() int {
+	count := 0
+	for _, user := range config.AdminUsers {
+		if user.Role == roleOwner && !user.Disabled {
+			count++
+		}
+	}
+	return count
+}
+
+func validateAdminPassword(password string) error {
+	if len(password) < 6 || len(password) > maxAdminPasswordLen {
+		return fmt.Errorf("密码长度应为 6-%d 位", maxAdminPasswordLen)
+	}
+	return nil
+}
+
+// authenticateAdmin 校验用户名和密码，返回账户副本；旧版 SHA-256 哈希校验通过后升级为 argon2id
+func authenticateAdmin(username, password string) (AdminUser, bool) {
+	adminUsersMu.RLock()
+	user := findAdminUserLocked(username)
+	var account AdminUser
+	if user != nil {
+		account = *user
+	}
+	adminUsersMu.RUnlock()
+	if user == nil || account.Disabled {
+		return AdminUser{}, false
+	}
+
+	if strings.HasPrefix(account.PasswordHash, "$argon2id$") {
+		return account, verifyPasswordArgon2(password, account.PasswordHash)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashPassword(password)), []byte(strings.ToLower(account.PasswordHash))) != 1 {
+		return AdminUser{}, false
+	}
+	if err := setAdminUserPassword(account.Username, password); err != nil {
+		log.Printf("[安全] 升级管理员密码哈希失败: %v", err)
+	} else {
+		log.Printf("[安全] 账户 %s 的密码哈希已从 SHA-256 升级为 argon2id", account.Username)
+	}
+	return account, true
+}
+
+// setAdminUserPassword 以 argon2id 哈希保存账户的新密码
+func setAdminUserPassword(username, password string) error {
+	hash, err := hashPasswordArgon2(password)
+	if err != nil {
+		return err
+	}
+	adminUsersMu.Lock()
+	user := findAdminUserLocked(username)
+	if user != nil {
+		user.PasswordHash = hash
+	}
+	adminUsersMu.Unlock()
+	if user == nil {
+		return errors.New("账户不存在")
+	}
+	saveConfig()
+	return nil
+}
+
+// adminUserInfo 是返回给管理后台的账户信息，不包含密码哈希
+func adminUserInfo(user *AdminUser) map[string]interface{} {
+	return map[string]interface{}{
+		"username":    user.Username,
+		"role":        user.Role,
+		"disabled":    user.Disabled,
+		"createdAt":   user.CreatedAt.UnixMilli(),
+		"totpEnabled": user.TOTPSecret != "",
+	}
+}
+
+// checkAdminToken 把请求中的 token 解析为管理员账户（副本），token 无效、过期或账户已停用时返回 nil；
+// 没有 token 时尝试按 admin-read / admin-write 权限的 API 密钥认证
+func checkAdminToken(r *http.Request) *AdminUser {
+	token := r.Header.Get("X-Admin-Token")
+	if token == "" {
+		return apiKeyAdminUser(r)
+	}
+
+	admin := lookupAdminSession(token, clientIP(r))
+	if admin == nil {
+		return nil
+	}
+
+	adminUsersMu.RLock()
+	defer adminUsersMu.RUnlock()
+	user := findAdminUserLocked(admin.Username)
+	if user == nil || user.Disabled {
+		return nil
+	}
+	account := *user
+	return &account
+}
+
+// requireAdminRole 校验 token 与角色，未通过时写入 401/403 并返回 nil
+func requireAdminRole(w http.ResponseWriter, r *http.Request, role string) *AdminUser {
+	user := checkAdminToken(r)
+	if user == nil {
+		http.Error(w, `{"success":false,"message":"未授权"}`, http.StatusUnauthorized)
+		return nil
+	}
+	if adminRoleLevels[user.Role] < adminRoleLevels[role] {
+		http.Error(w, `{"success":false,"message":"权限不足"}`, http.StatusForbidden)
+		return nil
+	}
+	return user
+}
+
+// ==================== 管理员会话 ====================
+
+// issueAdminToken 为账户创建登录会话并返回明文 token，明文只在登录响应中出现一次
+func issueAdminToken(username string, r *http.Request) string {
+	token := generateToken()
+	userAgent := r.UserAgent()
+	if len(userAgent) > 200 {
+		userAgent = userAgent[:200]
+	}
+	now := time.Now()
+	session := &AdminToken{
+		ID:         generateToken()[:16],
+		TokenHash:  hashPassword(token),
+		Username:   username,
+		IP:         clientIP(r),
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(time.Duration(config.Security.AdminTokenExpiry) * time.Millisecond),
+	}
+
+	adminTokensMu.Lock()
+	adminTokens[session.TokenHash] = session
+	adminTokensMu.Unlock()
+	saveAdminSessions()
+	return token
+}
+
+// lookupAdminSession 按 token 查找未过期的会话（副本），并记录最近使用的时间和 IP
+func lookupAdminSession(token, ip string) *AdminToken {
+	key := hashPassword(token)
+	now := time.Now()
+
+	adminTokensMu.Lock()
+	defer adminTokensMu.Unlock()
+	session, exists := adminTokens[key]
+	if !exists || now.After(session.ExpiresAt) {
+		return nil
+	}
+	session.LastUsedAt = now
+	session.IP = ip
+	copied := *session
+	return &copied
+}
+
+// revokeAdminSession 按会话 ID 注销，返回被注销的会话；不存在时返回 nil
+func revokeAdminSession(id string) *AdminToken {
+	adminTokensMu.Lock()
+	var revoked *AdminToken
+	for key, session := range adminTokens {
+		if session.ID == id {
+			revoked = session
+			delete(adminTokens, key)
+			break
+		}
+	}
+	adminTokensMu.Unlock()
+
+	if revoked != nil {
+		saveAdminSessions()
+	}
+	return revoked
+}
+
+// revokeAdminTokens 使该账户已登录的 token 全部失效
+func revokeAdminTokens(username string) {
+	adminTokensMu.Lock()
+	for key, session := range adminTokens {
+		if strings.EqualFold(session.Username, username) {
+			delete(adminTokens, key)
+		}
+	}
+	adminTokensMu.Unlock()
+	saveAdminSessions()
+}
+
+// adminSessionInfo 是返回给管理后台的会话信息，不包含 token 哈希
+func adminSessionInfo(session *AdminToken, current bool) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         session.ID,
+		"username":   session.Username,
+		"ip":         session.IP,
+		"userAgent":  session.UserAgent,
+		"createdAt":  session.CreatedAt.UnixMilli(),
+		"lastUsedAt": session.LastUsedAt.UnixMilli(),
+		"expiresAt":  session.ExpiresAt.UnixMilli(),
+		"current":    current,
+	}
+}
+
+// loadAdminSessions 在开启持久化时恢复上次保存的未过期会话
+func loadAdminSessions() {
+	if !config.Security.PersistAdminSessions {
+		return
+	}
+	data, err := os.ReadFile(adminSessionsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[安全] 读取登录会话失败: %v", err)
+		}
+		return
+	}
+
+	var sessions []*AdminToken
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		log.Printf("[安全] 解析登录会话失败，已忽略: %v", err)
+		return
+	}
+
+	now := time.Now()
+	adminTokensMu.Lock()
+	for _, session := range sessions {
+		if session.TokenHash == "" || now.After(session.ExpiresAt) {
+			continue
+		}
+		adminTokens[session.TokenHash] = session
+	}
+	log.Printf("[安全] 已恢复 %d 个管理员登录会话", len(adminTokens))
+	adminTokensMu.Unlock()
+}
+
+// saveAdminSessions 在开启持久化时把当前会话写入文件
+func saveAdminSessions() {
+	if !config.Security.PersistAdminSessions {
+		return
+	}
+
+	adminTokensMu.RLock()
+	sessions := make([]*AdminToken, 0, len(adminTokens))
+	for _, session := range adminTokens {
+		sessions = append(sessions, session)
+	}
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	adminTokensMu.RUnlock()
+	if err != nil {
+		log.Printf("[安全] 序列化登录会话失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(adminSessionsPath, data, 0600); err != nil {
+		log.Printf("[安全] 保存登录会话失败: %v", err)
+	}
+}
+
+// ==================== 两步验证 ====================
+// 基于 RFC 6238 的 TOTP（HMAC-SHA1、30 秒、6 位），兼容常见的验证器应用。启用流程：
+// POST /api/admin/totp/setup 校验密码后生成待确认的密钥和 otpauth:// 地址（管理后台显示为二维码），
+// POST /api/admin/totp/enable 提交一次验证码确认后启用，并返回只显示一次的恢复码。
+// 启用后 /api/admin/login 在密码正确后还需要验证码或恢复码才会签发 token。
+
+const (
+	totpIssuer        = "File-Rocket"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // 允许前后各一个时间步的时钟误差
+	totpEnrollTimeout = 10 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// TOTPEnrollment 尚未确认的两步验证密钥
+type TOTPEnrollment struct {
+	Secret    string
+	ExpiresAt time.Time
+}
+
+var (
+	totpEnrollments   = make(map[string]*TOTPEnrollment) // 小写用户名 -> 待确认的密钥
+	totpEnrollmentsMu sync.Mutex
+)
+
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// totpCode 计算密钥在指定时间步的验证码
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// verifyTOTP 校验验证码，返回匹配的时间步；不接受不晚于 lastStep 的时间步，防止重放
+func verifyTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI 返回验证器应用使用的 otpauth:// 地址
+func totpProvisioningURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// normalizeRecoveryCode 去掉恢复码中的分隔符和空白并转为小写
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, strings.TrimSpace(code))
+}
+
+// generateRecoveryCodes 生成一组恢复码，返回明文（形如 1a2b3-c4d5e）和用于保存的哈希
+func generateRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := generateToken()[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashPassword(raw)
+	}
+	return codes, hashes
+}
+
+// verifyAdminSecondFactor 校验账户的动态验证码或恢复码，恢复码使用后作废；返回是否使用了恢复码
+func verifyAdminSecondFactor(username, code string) (bool, bool) {
+	code = strings.TrimSpace(code)
+	adminUsersMu.Lock()
+	user := findAdminUserLocked(username)
+	if user == nil || user.TOTPSecret == "" {
+		adminUsersMu.Unlock()
+		return false, false
+	}
+
+	usedRecovery, ok := false, false
+	if step, valid := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now()); valid {
+		user.TOTPLastStep = step
+		ok = true
+	} else {
+		codeHash := hashPassword(normalizeRecoveryCode(code))
+		for i, stored := range user.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(stored), []byte(codeHash)) == 1 {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+				usedRecovery, ok = true, true
+				break
+			}
+		}
+	}
+	adminUsersMu.Unlock()
+
+	if ok {
+		saveConfig()
+	}
+	return usedRecovery, ok
+}
+
+func pruneTOTPEnrollments(now time.Time) {
+	totpEnrollmentsMu.Lock()
+	defer totpEnrollmentsMu.Unlock()
+	for key, enrollment := range totpEnrollments {
+		if now.After(enrollment.ExpiresAt) {
+			delete(totpEnrollments, key)
+		}
+	}
+}
+
+// adminTOTPHandler 管理当前账户的两步验证：GET /api/admin/totp 查看状态，
+// POST /api/admin/totp/setup、/enable、/disable 设置、启用和关闭
+func adminTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := requireAdminRole(w, r, roleViewer)
+	if user == nil {
+		return
+	}
+
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/totp"), "/")
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if r.Method == http.MethodPost && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":           true,
+			"enabled":           user.TOTPSecret != "",
+			"recoveryCodesLeft": len(user.RecoveryCodes),
+		})
+
+	case action == "setup" && r.Method == http.MethodPost:
+		if user.TOTPSecret != "" {
+			http.Error(w, `{"success":false,"message":"两步验证已启用"}`, http.StatusConflict)
+			return
+		}
+		if _, ok := authenticateAdmin(user.Username, req.Password); !ok {
+			http.Error(w, `{"success":false,"message":"密码错误"}`, http.StatusUnauthorized)
+			return
+		}
+
+		secret := generateTOTPSecret()
+		totpEnrollmentsMu.Lock()
+		totpEnrollments[strings.ToLower(user.Username)] = &TOTPEnrollment{
+			Secret:    secret,
+			ExpiresAt: time.Now().Add(totpEnrollTimeout),
+		}
+		totpEnrollmentsMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"secret":  secret,
+			"uri":     totpProvisioningURI(user.Username, secret),
+		})
+
+	case action == "enable" && r.Method == http.MethodPost:
+		key := strings.ToLower(user.Username)
+		totpEnrollmentsMu.Lock()
+		enrollment, exists := totpEnrollments[key]
+		totpEnrollmentsMu.Unlock()
+		if !exists || time.Now().After(enrollment.ExpiresAt) {
+			http.Error(w, `{"success":false,"message":"设置已过期，请重新开始"}`, http.StatusBadRequest)
+			return
+		}
+		step, ok := verifyTOTP(enrollment.Secret, strings.TrimSpace(req.Code), 0, time.Now())
+		if !ok {
+			http.Error(w, `{"success":false,"message":"验证码错误，请检查设备时间"}`, http.StatusBadRequest)
+			return
+		}
+
+		codes, hashes := generateRecoveryCodes()
+		adminUsersMu.Lock()
+		account := findAdminUserLocked(user.Username)
+		if account != nil {
+			account.TOTPSecret, account.TOTPLastStep, account.RecoveryCodes = enrollment.Secret, step, hashes
+		}
+		adminUsersMu.Unlock()
+		if account == nil {
+			http.Error(w, `{"success":false,"message":"账户不存在"}`, http.StatusNotFound)
+			return
+		}
+		totpEnrollmentsMu.Lock()
+		delete(totpEnrollments, key)
+		totpEnrollmentsMu.Unlock()
+		saveConfig()
+		log.Printf("[安全] 账户 %s 已启用两步验证", user.Username)
+		auditLog(r, user.Username, "admin.totp.enable", "", auditSuccess, "")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":       true,
+			"recoveryCodes": codes,
+		})
+
+	case action == "disable" && r.Method == http.MethodPost:
+		if user.TOTPSecret == "" {
+			http.Error(w, `{"success":false,"message":"两步验证未启用"}`, http.StatusBadRequest)
+			return
+		}
+		if _, ok := authenticateAdmin(user.Username, req.Password); !ok {
+			http.Error(w, `{"success":false,"message":"密码错误"}`, http.StatusUnauthorized)
+			return
+		}
+		if _, ok := verifyAdminSecondFactor(user.Username, req.Code); !ok {
+			http.Error(w, `{"success":false,"message":"两步验证码错误"}`, http.StatusUnauthorized)
+			return
+		}
+
+		adminUsersMu.Lock()
+		if account := findAdminUserLocked(user.Username); account != nil {
+			account.TOTPSecret, account.TOTPLastStep, account.RecoveryCodes = "", 0, nil
+		}
+		adminUsersMu.Unlock()
+		saveConfig()
+		log.Printf("[安全] 账户 %s 已关闭两步验证", user.Username)
+		auditLog(r, user.Username, "admin.totp.disable", "", auditSuccess, "")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+
+	default:
+		http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// ==================== 管理员路由 ====================
+func setupAdminRoutes() {
+	// 登录
+	http.HandleFunc("/api/admin/login", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Username string `json:"username"` // 省略时为 admin，兼容只有一个密码的旧版本
+			Password string `json:"password"`
+			Code     string `json:"code"` // 启用两步验证的账户需要提供动态验证码或恢复码
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+			return
+		}
+		if req.Username == "" {
+			req.Username = defaultAdminUsername
+		}
+
+		// 密码和两步验证码错误都计入取件码查找限制，锁定期间不再校验密码，
+		// 否则 totpRequired 响应可以被用来逐个确认猜中的密码
+		if rejectLockedClient(w, r) {
+			return
+		}
+		user, ok := authenticateAdmin(req.Username, req.Password)
+		if !ok {
+			recordCodeFailure(codeLimitKey(r))
+			auditLog(r, req.Username, "admin.login", "", auditFailure, "用户名或密码错误")
+			http.Error(w, `{"success":false,"message":"用户名或密码错误"}`, http.StatusUnauthorized)
+			return
+		}
+
+		// 密码正确后再校验两步验证码
+		usedRecovery := false
+		if user.TOTPSecret != "" {
+			if req.Code == "" {
+				http.Error(w, `{"success":false,"totpRequired":true,"message":"请输入两步验证码"}`, http.StatusUnauthorized)
+				return
+			}
+			var ok bool
+			usedRecovery, ok = verifyAdminSecondFactor(user.Username, req.Code)
+			if !ok {
+				recordCodeFailure(codeLimitKey(r))
+				auditLog(r, user.Username, "admin.login", "", auditFailure, "两步验证码错误")
+				http.Error(w, `{"success":false,"totpRequired":true,"message":"两步验证码错误"}`, http.StatusUnauthorized)
+				return
+			}
+			if usedRecovery {
+				log.Printf("[安全] 账户 %s 使用恢复码登录 (%s)", user.Username, clientIP(r))
+			}
+		}
+
+		token := issueAdminToken(user.Username, r)
+		log.Printf("[安全] 账户 %s 登录 (%s)", user.Username, clientIP(r))
+		detail := ""
+		if user.TOTPSecret != "" {
+			detail = "两步验证"
+		}
+		if usedRecovery {
+			detail = "使用恢复码"
+		}
+		auditLog(r, user.Username, "admin.login", "", auditSuccess, detail)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"token":    token,
+			"username": user.Username,
+			"role":     user.Role,
+		})
+	})
+
+	// 管理员账户：GET 列出，POST 创建（未提供密码时生成随机密码并在响应中返回一次）
+	http.HandleFunc("/api/admin/users", func(w http.ResponseWriter, r *http.Request) {
+		owner := requireAdminRole(w, r, roleOwner)
+		if owner == nil {
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			adminUsersMu.RLock()
+			users := make([]map[string]interface{}, 0, len(config.AdminUsers))
+			for _, user := range config.AdminUsers {
+				users = append(users, adminUserInfo(user))
+			}
+			adminUsersMu.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"users":   users,
+			})
+
+		case "POST":
+			var req struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+				Role     string `json:"role"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+				return
+			}
+			if !adminUsernamePattern.MatchString(req.Username) {
+				http.Error(w, `{"success":false,"message":"用户名只能包含字母、数字和 _.-，最长 32 位"}`, http.StatusBadRequest)
+				return
+			}
+			if _, ok := adminRoleLevels[req.Role]; !ok {
+				http.Error(w, `{"success":false,"message":"角色无效"}`, http.StatusBadRequest)
+				return
+			}
+			generated := req.Password == ""
+			if generated {
+				req.Password = generateToken()[:16]
+			}
+			if err := validateAdminPassword(req.Password); err != nil {
+				http.Error(w, fmt.Sprintf(`{"success":false,"message":"%s"}`, err), http.StatusBadRequest)
+				return
+			}
+			hash, err := hashPasswordArgon2(req.Password)
+			if err != nil {
+				http.Error(w, `{"success":false,"message":"保存密码失败"}`, http.StatusInternalServerError)
+				return
+			}
+
+			adminUsersMu.Lock()
+			if findAdminUserLocked(req.Username) != nil {
+				adminUsersMu.Unlock()
+				http.Error(w, `{"success":false,"message":"用户名已存在"}`, http.StatusConflict)
+				return
+			}
+			user := &AdminUser{Username: req.Username, PasswordHash: hash, Role: req.Role, CreatedAt: time.Now()}
+			config.AdminUsers = append(config.AdminUsers, user)
+			adminUsersMu.Unlock()
+			saveConfig()
+			log.Printf("[安全] 已创建账户 %s (%s)", user.Username, user.Role)
+			auditLog(r, owner.Username, "admin.user.create", "", auditSuccess, user.Username+" ("+user.Role+")")
+
+			resp := map[string]interface{}{
+				"success": true,
+				"user":    adminUserInfo(user),
+			}
+			if generated {
+				resp["password"] = req.Password
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+
+		default:
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+		}
+	})
+
+	// 修改账户：PUT /api/admin/users/<用户名> 修改角色或停用/启用，
+	// POST /api/admin/users/<用户名>/reset 重置密码（未提供密码时生成随机密码）。停用和重置会使该账户的 token 失效
+	http.HandleFunc("/api/admin/users/", func(w http.ResponseWriter, r *http.Request) {
+		owner := requireAdminRole(w, r, roleOwner)
+		if owner == nil {
+			return
+		}
+
+		username, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/admin/users/"), "/")
+		switch {
+		case action == "" && r.Method == http.MethodPut:
+			var req struct {
+				Role     *string `json:"role"`
+				Disabled *bool   `json:"disabled"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+				return
+			}
+			if req.Role != nil {
+				if _, ok := adminRoleLevels[*req.Role]; !ok {
+					http.Error(w, `{"success":false,"message":"角色无效"}`, http.StatusBadRequest)
+					return
+				}
+			}
+
+			adminUsersMu.Lock()
+			user := findAdminUserLocked(username)
+			if user == nil {
+				adminUsersMu.Unlock()
+				http.Error(w, `{"success":false,"message":"账户不存在"}`, http.StatusNotFound)
+				return
+			}
+			updated := *user
+			if req.Role != nil {
+				updated.Role = *req.Role
+			}
+			if req.Disabled != nil {
+				updated.Disabled = *req.Disabled
+			}
+			wasOwner := user.Role == roleOwner && !user.Disabled
+			stillOwner := updated.Role == roleOwner && !updated.Disabled
+			if wasOwner && !stillOwner && countActiveOwnersLocked() <= 1 {
+				adminUsersMu.Unlock()
+				http.Error(w, `{"success":false,"message":"至少需要保留一个启用的 owner 账户"}`, http.StatusConflict)
+				return
+			}
+			*user = updated
+			adminUsersMu.Unlock()
+			saveConfig()
+			if updated.Disabled {
+				revokeAdminTokens(updated.Username)
+			}
+			log.Printf("[安全] 已修改账户 %s：角色 %s，停用 %t", updated.Username, updated.Role, updated.Disabled)
+			auditLog(r, owner.Username, "admin.user.update", "", auditSuccess,
+				fmt.Sprintf("%s：角色 %s，停用 %t", updated.Username, updated.Role, updated.Disabled))
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"user":    adminUserInfo(&updated),
+			})
+
+		case action == "totp" && r.Method == http.MethodDelete:
+			// 账户丢失验证器和恢复码时，由 owner 关闭其两步验证
+			adminUsersMu.Lock()
+			user := findAdminUserLocked(username)
+			if user != nil {
+				user.TOTPSecret, user.TOTPLastStep, user.RecoveryCodes = "", 0, nil
+			}
+			adminUsersMu.Unlock()
+			if user == nil {
+				http.Error(w, `{"success":false,"message":"账户不存在"}`, http.StatusNotFound)
+				return
+			}
+			saveConfig()
+			log.Printf("[安全] 已关闭账户 %s 的两步验证", username)
+			auditLog(r, owner.Username, "admin.user.totp-reset", "", auditSuccess, username)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
+
+		case action == "reset" && r.Method == http.MethodPost:
+			var req struct {
+				Password string `json:"password"`
+			}
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+					return
+				}
+			}
+			generated := req.Password == ""
+			if generated {
+				req.Password = generateToken()[:16]
+			}
+			if err := validateAdminPassword(req.Password); err != nil {
+				http.Error(w, fmt.Sprintf(`{"success":false,"message":"%s"}`, err), http.StatusBadRequest)
+				return
+			}
+			if err := setAdminUserPassword(username, req.Password); err != nil {
+				http.Error(w, `{"success":false,"message":"账户不存在"}`, http.StatusNotFound)
+				return
+			}
+			revokeAdminTokens(username)
+			log.Printf("[安全] 已重置账户 %s 的密码", username)
+			auditLog(r, owner.Username, "admin.user.password-reset", "", auditSuccess, username)
+
+			resp := map[string]interface{}{
+				"success": true,
+			}
+			if generated {
+				resp["password"] = req.Password
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+
+		default:
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+		}
+	})
+
+	// 获取/更新配置（根据请求方法区分）
+	http.HandleFunc("/api/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		// 查看只需 viewer，修改需要 owner
+		role := roleViewer
+		if r.Method != http.MethodGet {
+			role = roleOwner
+		}
+		user := requireAdminRole(w, r, role)
+		if user == nil {
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			stats := getStatsSnapshot()
+			storedFilesMu.RLock()
+			storedCount := len(storedFiles)
+			storedFilesMu.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":       true,
+				"features":      config.Features,
+				"storageConfig": adminStorageConfig(),
+				"theme":         config.Theme,
+				"stats": map[string]interface{}{
+					"totalTransfers": stats.TotalTransfers,
+					"todayTransfers": stats.TodayTransfers,
+					"storedFiles":    storedCount,
+				},
+			})
+
+		case "PUT", "POST":
+			var req map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+				return
+			}
+
+			if features, ok := req["features"].(map[string]interface{}); ok {
+				if v, ok := features["memoryStreaming"].(bool); ok {
+					config.Features.MemoryStreaming = v
+				}
+				if v, ok := features["serverStorage"].(bool); ok {
+					config.Features.ServerStorage = v
+				}
+				if v, ok := features["p2pDirect"].(bool); ok {
+					config.Features.P2PDirect = v
+				}
+			}
+
+			if theme, ok := req["theme"].(string); ok && (theme == "classic" || theme == "minimal") {
+				config.Theme = theme
+			}
+
+			saveConfig()
+			auditLog(r, user.Username, "admin.config.update", "", auditSuccess,
+				fmt.Sprintf("内存流式 %t，服务器存储 %t，P2P 直连 %t，主题 %s",
+					config.Features.MemoryStreaming, config.Features.ServerStorage, config.Features.P2PDirect, config.Theme))
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
+
+		default:
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+		}
+	})
+
+	// 更新存储配置
+	http.HandleFunc("/api/admin/storage-config", func(w http.ResponseWriter, r *http.Request) {
+		user := requireAdminRole(w, r, roleOwner)
+		if user == nil {
+			return
+		}
+
+		// 在当前配置基础上解码，未提交的字段保持原值
+		req := config.StorageConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+			return
+		}
+		if req.S3.SecretAccessKey == "" {
+			req.S3.SecretAccessKey = config.StorageConfig.S3.SecretAccessKey
+		}
+
+		// 存储后端在启动时创建，已有文件也不会迁移到新的位置，这些字段只能修改 config.json 后重启
+		if req.Backend != config.StorageConfig.Backend || req.UploadDir != config.StorageConfig.UploadDir || req.S3 != config.StorageConfig.S3 {
+			http.Error(w, `{"success":false,"message":"存储后端、uploadDir 和 S3 配置只能在 config.json 中修改，重启后生效"}`, http.StatusBadRequest)
+			return
+		}
+
+		config.StorageConfig = req
+		saveConfig()
+		auditLog(r, user.Username, "admin.storage-config.update", "", auditSuccess, "")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	})
+
+	// 立即核对存储用量
+	http.HandleFunc("/api/admin/storage-reconcile", func(w http.ResponseWriter, r *http.Request) {
+		user := requireAdminRole(w, r, roleOperator)
+		if user == nil {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+			return
+		}
+
+		result := reconcileStorageUsage()
+		auditLog(r, user.Username, "admin.storage.reconcile", "", auditSuccess, "")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"reconcile": result,
+		})
+	})
+
+	// 取件码查找失败记录与锁定：GET 列出，DELETE ?key=<IP 或网段> 解除
+	http.HandleFunc("/api/admin/lockouts", func(w http.ResponseWriter, r *http.Request) {
+		// 查看只需 viewer，修改需要 operator
+		role := roleViewer
+		if r.Method != http.MethodGet {
+			role = roleOperator
+		}
+		user := requireAdminRole(w, r, role)
+		if user == nil {
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			codeLimitsMu.Lock()
+			lockouts := make([]CodeLimit, 0, len(codeLimits))
+			for _, limit := range codeLimits {
+				lockouts = append(lockouts, *limit)
+			}
+			codeLimitsMu.Unlock()
+			sort.Slice(lockouts, func(i, j int) bool {
+				return lockouts[i].LastFailure.After(lockouts[j].LastFailure)
+			})
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"lockouts": lockouts,
+			})
+
+		case "DELETE":
+			key := r.URL.Query().Get("key")
+			codeLimitsMu.Lock()
+			_, exists := codeLimits[key]
+			delete(codeLimits, key)
+			codeLimitsMu.Unlock()
+			if !exists {
+				http.Error(w, `{"success":false,"message":"记录不存在"}`, http.StatusNotFound)
+				return
+			}
+			log.Printf("[安全] 管理员解除锁定: %s", key)
+			auditLog(r, user.Username, "admin.lockout.clear", "", auditSuccess, key)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
 
-		token := generateToken()
-		adminTokensMu.Lock()
-		adminTokens[token] = &AdminToken{
-			Token:     token,
-			ExpiresAt: time.Now().Add(time.Duration(config.Security.AdminTokenExpiry) * time.Millisecond),
+		default:
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
 		}
-		adminTokensMu.Unlock()
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"token":   token,
-		})
 	})
 
-	// 获取/更新配置（根据请求方法区分）
-	http.HandleFunc("/api/admin/config", func(w http.ResponseWriter, r *http.Request) {
-		if !checkAdminToken(r) {
-			http.Error(w, `{"success":false,"message":"未授权"}`, http.StatusUnauthorized)
+	// 签名下载链接：列出、撤销单个（?id=）或全部
+	http.HandleFunc("/api/admin/signed-links", func(w http.ResponseWriter, r *http.Request) {
+		// 查看只需 viewer，修改需要 operator
+		role := roleViewer
+		if r.Method != http.MethodGet {
+			role = roleOperator
+		}
+		user := requireAdminRole(w, r, role)
+		if user == nil {
 			return
 		}
 
 		switch r.Method {
 		case "GET":
-			stats := getStatsSnapshot()
 			storedFilesMu.RLock()
-			storedCount := len(storedFiles)
+			links := make([]SignedLink, 0, len(signedLinks))
+			for _, link := range signedLinks {
+				links = append(links, *link)
+			}
 			storedFilesMu.RUnlock()
+			sort.Slice(links, func(i, j int) bool {
+				return links[i].CreatedAt.After(links[j].CreatedAt)
+			})
 
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success":       true,
-				"features":      config.Features,
-				"storageConfig": config.StorageConfig,
-				"theme":         config.Theme,
-				"stats": map[string]interface{}{
-					"totalTransfers": stats.TotalTransfers,
-					"todayTransfers": stats.TodayTransfers,
-					"storedFiles":    storedCount,
-				},
+				"success": true,
+				"links":   links,
 			})
 
-		case "PUT", "POST":
-			var req map[string]interface{}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
-				return
+		case "DELETE":
+			id := r.URL.Query().Get("id")
+			storedFilesMu.Lock()
+			count := len(signedLinks)
+			if id == "" {
+				signedLinks = make(map[string]*SignedLink)
+			} else if _, exists := signedLinks[id]; exists {
+				delete(signedLinks, id)
+				count = 1
+			} else {
+				count = 0
 			}
-
-			if features, ok := req["features"].(map[string]interface{}); ok {
-				if v, ok := features["memoryStreaming"].(bool); ok {
-					config.Features.MemoryStreaming = v
-				}
-				if v, ok := features["serverStorage"].(bool); ok {
-					config.Features.ServerStorage = v
-				}
-				if v, ok := features["p2pDirect"].(bool); ok {
-					config.Features.P2PDirect = v
-				}
+			if count > 0 {
+				saveStorageIndex()
 			}
-
-			if theme, ok := req["theme"].(string); ok && (theme == "classic" || theme == "minimal") {
-				config.Theme = theme
+			storedFilesMu.Unlock()
+			if id != "" && count == 0 {
+				http.Error(w, `{"success":false,"message":"链接不存在"}`, http.StatusNotFound)
+				return
 			}
-
-			saveConfig()
+			log.Printf("[签名链接] 管理员撤销了 %d 个链接", count)
+			auditLog(r, user.Username, "admin.signed-link.revoke", "", auditSuccess, fmt.Sprintf("%d 个链接", count))
 
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"success": true,
+				"count":   count,
 			})
 
 		default:
@@ -2246,62 +8906,107 @@ func setupAdminRoutes() {
 		}
 	})
 
-	// 更新存储配置
-	http.HandleFunc("/api/admin/storage-config", func(w http.ResponseWriter, r *http.Request) {
-		if !checkAdminToken(r) {
-			http.Error(w, `{"success":false,"message":"未授权"}`, http.StatusUnauthorized)
-			return
+	// 进行中的传输会话：GET 列出，DELETE ?code=<取件码> 终止并通知双方
+	http.HandleFunc("/api/admin/transfers", func(w http.ResponseWriter, r *http.Request) {
+		// 查看只需 viewer，终止需要 operator
+		role := roleViewer
+		if r.Method != http.MethodGet {
+			role = roleOperator
 		}
-
-		var req StorageConfig
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+		user := requireAdminRole(w, r, role)
+		if user == nil {
 			return
 		}
 
-		config.StorageConfig = req
-		saveConfig()
+		switch r.Method {
+		case "GET":
+			activeSessionsMu.RLock()
+			transfers := make([]map[string]interface{}, 0, len(activeSessions))
+			for code, session := range activeSessions {
+				transfers = append(transfers, map[string]interface{}{
+					"pickupCode":   code,
+					"mode":         session.Mode,
+					"fileName":     session.FileName,
+					"size":         session.Size,
+					"transferred":  session.Transferred,
+					"hasReceiver":  session.ReceiverSocketID != "",
+					"createdAt":    session.CreatedAt.UnixMilli(),
+					"lastActiveAt": session.LastActiveAt.UnixMilli(),
+				})
+			}
+			activeSessionsMu.RUnlock()
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-		})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":   true,
+				"transfers": transfers,
+			})
+
+		case "DELETE":
+			code := r.URL.Query().Get("code")
+			if !terminateSession(code, "传输已被管理员终止") {
+				http.Error(w, `{"success":false,"message":"会话不存在"}`, http.StatusNotFound)
+				return
+			}
+			auditLog(r, user.Username, "admin.transfer.terminate", code, auditSuccess, "")
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
+
+		default:
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+		}
 	})
 
 	// 获取文件列表
 	http.HandleFunc("/api/admin/files", func(w http.ResponseWriter, r *http.Request) {
-		if !checkAdminToken(r) {
-			http.Error(w, `{"success":false,"message":"未授权"}`, http.StatusUnauthorized)
+		if requireAdminRole(w, r, roleViewer) == nil {
 			return
 		}
 
 		diskSpace := getDiskSpace()
+		logicalSize, physicalSize := getStorageUsage()
 		storedFilesMu.RLock()
 
-		files := make([]map[string]interface{}, 0, len(storedFiles))
-		for code, file := range storedFiles {
+		// 隔离区中的文件一并列出，quarantined 为 true，取件码不可用
+		all := allStoredFilesLocked()
+		files := make([]map[string]interface{}, 0, len(all))
+		for _, file := range all {
 			remainingMs := int64(0)
 			if !file.DeleteTime.IsZero() {
 				remainingMs = int64(time.Until(file.DeleteTime) / time.Millisecond)
 			}
 
 			files = append(files, map[string]interface{}{
-				"pickupCode":   code,
-				"originalName": file.OriginalName,
-				"size":         file.Size,
-				"uploadTime":   file.UploadTime.UnixMilli(),
-				"deleteMode":   file.DeleteMode,
-				"remainingMs":  remainingMs,
+				"pickupCode":    file.PickupCode,
+				"originalName":  file.OriginalName,
+				"size":          file.Size,
+				"uploadTime":    file.UploadTime.UnixMilli(),
+				"deleteMode":    file.DeleteMode,
+				"remainingMs":   remainingMs,
+				"isBundle":      file.IsBundle(),
+				"fileCount":     len(file.Files),
+				"e2e":           file.E2E,
+				"hasPassword":   file.PasswordHash != "",
+				"maxDownloads":  file.MaxDownloads,
+				"downloadCount": file.DownloadCount,
+				"quarantined":   file.InfectedWith != "",
+				"infectedWith":  file.InfectedWith,
 			})
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":   true,
-			"files":     files,
-			"diskSpace": diskSpace,
-			"totalSize": getUsedStorage(),
-			"uploadDir": getAbsoluteUploadDir(),
+			"success":      true,
+			"files":        files,
+			"diskSpace":    diskSpace,
+			"totalSize":    physicalSize,
+			"logicalSize":  logicalSize,
+			"physicalSize": physicalSize,
+			"reconcile":    getLastReconcile(),
+			"uploadDir":    getAbsoluteUploadDir(),
 		})
 
 		storedFilesMu.RUnlock()
@@ -2309,16 +9014,22 @@ func setupAdminRoutes() {
 
 	// 删除文件
 	http.HandleFunc("/api/admin/files/", func(w http.ResponseWriter, r *http.Request) {
-		if !checkAdminToken(r) {
-			http.Error(w, `{"success":false,"message":"未授权"}`, http.StatusUnauthorized)
+		user := requireAdminRole(w, r, roleOperator)
+		if user == nil {
 			return
 		}
 
 		code := filepath.Base(r.URL.Path)
 		storedFilesMu.Lock()
-		if _, exists := storedFiles[code]; exists {
-			deleteStoredFile(code)
+		_, exists := storedFiles[code]
+		if _, quarantined := quarantinedFiles[code]; quarantined {
+			exists = true
+		}
+		if exists {
+			orphaned := deleteStoredFile(code)
 			storedFilesMu.Unlock()
+			deleteBlobs(orphaned)
+			auditLog(r, user.Username, "file.delete", code, auditSuccess, "")
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"success": true,
@@ -2331,24 +9042,58 @@ func setupAdminRoutes() {
 
 	// 删除所有文件
 	http.HandleFunc("/api/admin/files/all", func(w http.ResponseWriter, r *http.Request) {
-		if !checkAdminToken(r) {
-			http.Error(w, `{"success":false,"message":"未授权"}`, http.StatusUnauthorized)
+		user := requireAdminRole(w, r, roleOwner)
+		if user == nil {
 			return
 		}
 
 		// 清空 storedFiles 记录
 		storedFilesMu.Lock()
-		count := len(storedFiles)
+		all := allStoredFilesLocked()
+		count := len(all)
+		codes := make([]string, 0, count)
+		for _, file := range all {
+			codes = append(codes, file.PickupCode)
+		}
 		storedFiles = make(map[string]*FileSession)
+		quarantinedFiles = make(map[string]*FileSession)
+		signedLinks = make(map[string]*SignedLink)
+		blobRefs = make(map[string]*BlobRef)
+		blobByHash = make(map[string]string)
+		storageLogicalSize, storagePhysicalSize = 0, 0
 		storedFilesMu.Unlock()
 		saveStorageIndex()
 
+		chunkManifestsMu.Lock()
+		chunkManifests = make(map[string]*ChunkManifest)
+		chunkManifestsMu.Unlock()
+		tusUploadsMu.Lock()
+		tusUploads = make(map[string]*TusUpload)
+		tusUploadsMu.Unlock()
+
+		// 对象存储中的文件逐个删除，本地存储的文件随 uploadDir 一并删除
+		if _, isLocal := storageBackend.(*localStorage); !isLocal {
+			objects, err := storageBackend.List("")
+			if err != nil {
+				log.Printf("[管理] 列出存储对象失败: %v", err)
+			}
+			for _, object := range objects {
+				if err := storageBackend.Delete(object.Name); err != nil {
+					log.Printf("[管理] 删除 %s 失败: %v", object.Name, err)
+				}
+			}
+		}
+
 		// 删除 uploadDir 内所有内容（包括 chunks 目录），然后重建空目录
 		if err := os.RemoveAll(uploadDir); err != nil {
 			log.Printf("[管理] 删除文件目录失败: %v", err)
 		}
 		os.MkdirAll(uploadDir, 0755)
 		log.Printf("[管理] 已清空所有文件，共 %d 条记录", count)
+		for _, code := range codes {
+			auditLog(r, user.Username, "file.delete", code, auditSuccess, "清空全部文件")
+		}
+		auditLog(r, user.Username, "admin.files.clear", "", auditSuccess, fmt.Sprintf("%d 条记录", count))
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -2357,10 +9102,309 @@ func setupAdminRoutes() {
 		})
 	})
 
+	// 退出登录：注销当前 token
+	http.HandleFunc("/api/admin/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get("X-Admin-Token")
+		if token == "" {
+			http.Error(w, `{"success":false,"message":"未授权"}`, http.StatusUnauthorized)
+			return
+		}
+
+		adminTokensMu.Lock()
+		session, exists := adminTokens[hashPassword(token)]
+		if exists {
+			delete(adminTokens, session.TokenHash)
+		}
+		adminTokensMu.Unlock()
+		if exists {
+			saveAdminSessions()
+			log.Printf("[安全] 账户 %s 退出登录 (%s)", session.Username, clientIP(r))
+			auditLog(r, session.Username, "admin.logout", "", auditSuccess, "")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	})
+
+	// 登录会话：GET 列出（所有者可看到全部账户的会话，其余角色只能看到自己的），
+	// DELETE ?id= 注销指定会话（所有者可注销任意会话）
+	http.HandleFunc("/api/admin/sessions", func(w http.ResponseWriter, r *http.Request) {
+		user := requireAdminRole(w, r, roleViewer)
+		if user == nil {
+			return
+		}
+		currentHash := hashPassword(r.Header.Get("X-Admin-Token"))
+		isOwner := user.Role == roleOwner
+
+		switch r.Method {
+		case "GET":
+			now := time.Now()
+			adminTokensMu.RLock()
+			sessions := make([]map[string]interface{}, 0, len(adminTokens))
+			for _, session := range adminTokens {
+				if now.After(session.ExpiresAt) {
+					continue
+				}
+				if !isOwner && !strings.EqualFold(session.Username, user.Username) {
+					continue
+				}
+				sessions = append(sessions, adminSessionInfo(session, session.TokenHash == currentHash))
+			}
+			adminTokensMu.RUnlock()
+			sort.Slice(sessions, func(i, j int) bool {
+				return sessions[i]["lastUsedAt"].(int64) > sessions[j]["lastUsedAt"].(int64)
+			})
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"sessions": sessions,
+			})
+
+		case "DELETE":
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				http.Error(w, `{"success":false,"message":"缺少会话 ID"}`, http.StatusBadRequest)
+				return
+			}
+
+			adminTokensMu.RLock()
+			var target *AdminToken
+			for _, session := range adminTokens {
+				if session.ID == id {
+					target = session
+					break
+				}
+			}
+			allowed := target != nil && (isOwner || strings.EqualFold(target.Username, user.Username))
+			adminTokensMu.RUnlock()
+			if !allowed {
+				http.Error(w, `{"success":false,"message":"会话不存在"}`, http.StatusNotFound)
+				return
+			}
+
+			if revoked := revokeAdminSession(id); revoked != nil {
+				log.Printf("[安全] 账户 %s 注销了 %s 的登录会话 %s", user.Username, revoked.Username, revoked.ID)
+				auditLog(r, user.Username, "admin.session.revoke", "", auditSuccess, revoked.Username+" "+revoked.ID)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
+
+		default:
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+		}
+	})
+
+	// API 密钥：GET 列出，POST 创建（明文密钥只在响应中返回一次），PUT 修改“上传必须提供密钥”开关
+	http.HandleFunc("/api/admin/api-keys", func(w http.ResponseWriter, r *http.Request) {
+		user := requireAdminRole(w, r, roleOwner)
+		if user == nil {
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			apiKeysMu.RLock()
+			keys := make([]map[string]interface{}, 0, len(config.APIKeys))
+			for _, key := range config.APIKeys {
+				keys = append(keys, apiKeyInfo(key))
+			}
+			apiKeysMu.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":                true,
+				"keys":                   keys,
+				"requireApiKeyForUpload": config.Security.RequireAPIKeyForUpload,
+			})
+
+		case "POST":
+			var req struct {
+				Name        string   `json:"name"`
+				Scopes      []string `json:"scopes"`
+				MaxFileSize int64    `json:"maxFileSize"`
+				DailyBytes  int64    `json:"dailyBytes"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+				return
+			}
+			req.Name = strings.TrimSpace(req.Name)
+			if req.Name == "" || len(req.Name) > maxAPIKeyNameLen {
+				http.Error(w, fmt.Sprintf(`{"success":false,"message":"名称不能为空，最长 %d 个字符"}`, maxAPIKeyNameLen), http.StatusBadRequest)
+				return
+			}
+			if len(req.Scopes) == 0 {
+				http.Error(w, `{"success":false,"message":"至少选择一项权限"}`, http.StatusBadRequest)
+				return
+			}
+			for _, scope := range req.Scopes {
+				if !apiKeyScopes[scope] {
+					http.Error(w, fmt.Sprintf(`{"success":false,"message":"未知权限 %s"}`, scope), http.StatusBadRequest)
+					return
+				}
+			}
+			if req.MaxFileSize < 0 || req.DailyBytes < 0 {
+				http.Error(w, `{"success":false,"message":"大小限制不能为负数"}`, http.StatusBadRequest)
+				return
+			}
+
+			id := generateToken()[:12]
+			raw := apiKeyPrefix + id + "_" + generateToken()
+			key := &APIKey{
+				ID:          id,
+				Name:        req.Name,
+				KeyHash:     hashPassword(raw),
+				Scopes:      req.Scopes,
+				MaxFileSize: req.MaxFileSize,
+				DailyBytes:  req.DailyBytes,
+				CreatedBy:   user.Username,
+				CreatedAt:   time.Now(),
+			}
+			apiKeysMu.Lock()
+			config.APIKeys = append(config.APIKeys, key)
+			apiKeysMu.Unlock()
+			saveConfig()
+			log.Printf("[安全] 账户 %s 创建了 API 密钥 %s (%s): %s", user.Username, key.ID, key.Name, strings.Join(key.Scopes, ","))
+			auditLog(r, user.Username, "admin.api-key.create", "", auditSuccess,
+				fmt.Sprintf("%s (%s): %s", key.ID, key.Name, strings.Join(key.Scopes, ",")))
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"key":     apiKeyInfo(key),
+				"apiKey":  raw,
+			})
+
+		case "PUT":
+			var req struct {
+				RequireAPIKeyForUpload *bool `json:"requireApiKeyForUpload"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, `{"success":false,"message":"请求格式错误"}`, http.StatusBadRequest)
+				return
+			}
+			if req.RequireAPIKeyForUpload != nil {
+				config.Security.RequireAPIKeyForUpload = *req.RequireAPIKeyForUpload
+				saveConfig()
+				log.Printf("[安全] 账户 %s 将上传必须提供 API 密钥设为 %v", user.Username, *req.RequireAPIKeyForUpload)
+				auditLog(r, user.Username, "admin.config.update", "", auditSuccess,
+					fmt.Sprintf("上传必须提供 API 密钥 %t", *req.RequireAPIKeyForUpload))
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
+
+		default:
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+		}
+	})
+
+	// 撤销 API 密钥：DELETE /api/admin/api-keys/<ID>
+	http.HandleFunc("/api/admin/api-keys/", func(w http.ResponseWriter, r *http.Request) {
+		user := requireAdminRole(w, r, roleOwner)
+		if user == nil {
+			return
+		}
+		if r.Method != http.MethodDelete {
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/api/admin/api-keys/")
+		apiKeysMu.Lock()
+		var revoked *APIKey
+		for i, key := range config.APIKeys {
+			if key.ID == id {
+				revoked = key
+				config.APIKeys = append(config.APIKeys[:i], config.APIKeys[i+1:]...)
+				break
+			}
+		}
+		apiKeysMu.Unlock()
+		if revoked == nil {
+			http.Error(w, `{"success":false,"message":"API 密钥不存在"}`, http.StatusNotFound)
+			return
+		}
+		saveConfig()
+		log.Printf("[安全] 账户 %s 撤销了 API 密钥 %s (%s)", user.Username, revoked.ID, revoked.Name)
+		auditLog(r, user.Username, "admin.api-key.revoke", "", auditSuccess, revoked.ID+" ("+revoked.Name+")")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	})
+
+	// 审计日志：GET 分页查询，按时间倒序。可按 action（前缀）、actor、pickupCode、outcome、
+	// since/until（毫秒时间戳）筛选
+	http.HandleFunc("/api/admin/audit", func(w http.ResponseWriter, r *http.Request) {
+		if requireAdminRole(w, r, roleViewer) == nil {
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, `{"success":false,"message":"方法不允许"}`, http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		filter := AuditFilter{
+			Action:     query.Get("action"),
+			Actor:      query.Get("actor"),
+			PickupCode: query.Get("pickupCode"),
+			Outcome:    query.Get("outcome"),
+		}
+		if ms, err := strconv.ParseInt(query.Get("since"), 10, 64); err == nil && ms > 0 {
+			filter.Since = time.UnixMilli(ms)
+		}
+		if ms, err := strconv.ParseInt(query.Get("until"), 10, 64); err == nil && ms > 0 {
+			filter.Until = time.UnixMilli(ms)
+		}
+		page, _ := strconv.Atoi(query.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		pageSize, _ := strconv.Atoi(query.Get("pageSize"))
+		if pageSize < 1 {
+			pageSize = 50
+		}
+		pageSize = min(pageSize, maxAuditPageSize)
+
+		events, total, err := queryAuditLog(filter, page, pageSize)
+		if err != nil {
+			log.Printf("[审计] 读取日志失败: %v", err)
+			http.Error(w, `{"success":false,"message":"读取审计日志失败"}`, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"events":   events,
+			"total":    total,
+			"page":     page,
+			"pageSize": pageSize,
+		})
+	})
+
+	// 两步验证（针对当前账户）
+	http.HandleFunc("/api/admin/totp", adminTOTPHandler)
+	http.HandleFunc("/api/admin/totp/", adminTOTPHandler)
+
 	// 修改密码
 	http.HandleFunc("/api/admin/change-password", func(w http.ResponseWriter, r *http.Request) {
-		if !checkAdminToken(r) {
-			http.Error(w, `{"success":false,"message":"未授权"}`, http.StatusUnauthorized)
+		user := requireAdminRole(w, r, roleViewer)
+		if user == nil {
 			return
 		}
 
@@ -2373,13 +9417,24 @@ func setupAdminRoutes() {
 			return
 		}
 
-		if req.CurrentPassword != config.AdminPassword && hashPassword(req.CurrentPassword) != config.AdminPasswordHash {
+		if _, ok := authenticateAdmin(user.Username, req.CurrentPassword); !ok {
+			auditLog(r, user.Username, "admin.password.change", "", auditFailure, "当前密码错误")
 			http.Error(w, `{"success":false,"message":"当前密码错误"}`, http.StatusUnauthorized)
 			return
 		}
+		if err := validateAdminPassword(req.NewPassword); err != nil {
+			http.Error(w, fmt.Sprintf(`{"success":false,"message":"新%s"}`, err), http.StatusBadRequest)
+			return
+		}
 
-		config.AdminPassword = req.NewPassword
-		saveConfig()
+		if err := setAdminUserPassword(user.Username, req.NewPassword); err != nil {
+			http.Error(w, `{"success":false,"message":"保存密码失败"}`, http.StatusInternalServerError)
+			return
+		}
+		// 修改密码后该账户所有已登录的会话（包括当前会话）都需要重新登录
+		revokeAdminTokens(user.Username)
+		log.Printf("[安全] 账户 %s 已修改密码，已注销全部登录会话", user.Username)
+		auditLog(r, user.Username, "admin.password.change", "", auditSuccess, "")
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -2388,23 +9443,6 @@ func setupAdminRoutes() {
 	})
 }
 
-func checkAdminToken(r *http.Request) bool {
-	token := r.Header.Get("X-Admin-Token")
-	if token == "" {
-		return false
-	}
-
-	adminTokensMu.RLock()
-	admin, exists := adminTokens[token]
-	adminTokensMu.RUnlock()
-
-	if !exists || time.Now().After(admin.ExpiresAt) {
-		return false
-	}
-
-	return true
-}
-
 func getDiskSpace() map[string]int64 {
 	diskSpace := map[string]int64{
 		"total": 0,
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录 B 的 SHA1 测试向量，密钥为 ASCII "12345678901234567890"，
+// 原始向量为 8 位，这里取后 totpDigits 位
+var totpTestKey = []byte("12345678901234567890")
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		want := v.code[len(v.code)-totpDigits:]
+		if got := totpCode(totpTestKey, v.unix/totpPeriod); got != want {
+			t.Errorf("T=%d: got %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(totpTestKey)
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	code := totpCode(totpTestKey, current)
+
+	step, ok := verifyTOTP(secret, code, 0, now)
+	if !ok || step != current {
+		t.Fatalf("valid code rejected: step=%d ok=%t", step, ok)
+	}
+	// 同一时间步不能再次使用
+	if _, ok := verifyTOTP(secret, code, step, now); ok {
+		t.Error("replayed code accepted")
+	}
+	// 小写密钥和当前时间步之前的 lastStep 不影响校验
+	if _, ok := verifyTOTP(strings.ToLower(secret), code, current-1, now); !ok {
+		t.Error("lowercase secret rejected")
+	}
+
+	// 允许前后 totpSkew 个时间步的时钟误差，超出则拒绝
+	for offset := int64(-totpSkew - 1); offset <= totpSkew+1; offset++ {
+		skewed := totpCode(totpTestKey, current+offset)
+		step, ok := verifyTOTP(secret, skewed, 0, now)
+		inWindow := offset >= -totpSkew && offset <= totpSkew
+		if ok != inWindow {
+			t.Errorf("offset %d: ok=%t, want %t", offset, ok, inWindow)
+		}
+		if ok && step != current+offset {
+			t.Errorf("offset %d: step=%d, want %d", offset, step, current+offset)
+		}
+	}
+	// 已使用过更晚的时间步后，窗口内更早的验证码也视为重放
+	if _, ok := verifyTOTP(secret, totpCode(totpTestKey, current-1), current, now); ok {
+		t.Error("code older than last used step accepted")
+	}
+
+	for _, bad := range []string{"", code[:totpDigits-1], code + "0", "abcdef"} {
+		if _, ok := verifyTOTP(secret, bad, 0, now); ok {
+			t.Errorf("malformed code %q accepted", bad)
+		}
+	}
+	if _, ok := verifyTOTP("not base32!", code, 0, now); ok {
+		t.Error("invalid secret accepted")
+	}
+}
+
+// fakeClamd 在本地端口上模拟 clamd：解析 INSTREAM 数据块，把收到的内容发到 received，
+// reply 为空时不回复，用于测试超时
+func fakeClamd(t *testing.T, reply string) (address string, received <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	ch := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		command := make([]byte, len("zINSTREAM\x00"))
+		if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+			ch <- nil
+			return
+		}
+		var data bytes.Buffer
+		for {
+			var size uint32
+			if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+				ch <- nil
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if _, err := io.CopyN(&data, conn, int64(size)); err != nil {
+				ch <- nil
+				return
+			}
+		}
+		ch <- data.Bytes()
+		if reply == "" {
+			// 保持连接不回复，直到测试结束
+			io.Copy(io.Discard, conn)
+			return
+		}
+		conn.Write([]byte(reply + "\x00"))
+	}()
+	return "tcp://" + ln.Addr().String(), ch
+}
+
+func TestClamdScanner(t *testing.T) {
+	// 超过一个数据块，覆盖分块发送
+	payload := bytes.Repeat([]byte("file-rocket"), clamdChunkSize/5)
+
+	cases := []struct {
+		name      string
+		reply     string
+		signature string
+		wantErr   bool
+	}{
+		{"clean", "stream: OK", "", false},
+		{"infected", "stream: Eicar-Test-Signature FOUND", "Eicar-Test-Signature", false},
+		{"error", "INSTREAM size limit exceeded. ERROR", "", true},
+		{"timeout", "", "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			address, received := fakeClamd(t, tc.reply)
+			scanner, err := newClamdScanner(address, 200*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			signature, err := scanner.Scan(bytes.NewReader(payload))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, wantErr %t", err, tc.wantErr)
+			}
+			if signature != tc.signature {
+				t.Errorf("signature = %q, want %q", signature, tc.signature)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("scan took %v", elapsed)
+			}
+			if data := <-received; !bytes.Equal(data, payload) {
+				t.Errorf("clamd received %d bytes, want %d", len(data), len(payload))
+			}
+		})
+	}
+}
+
+func TestNewClamdScannerAddress(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:3310", "tcp://", "http://127.0.0.1:3310"} {
+		if _, err := newClamdScanner(address, time.Second); err == nil {
+			t.Errorf("address %q accepted", address)
+		}
+	}
+	for _, address := range []string{"tcp://127.0.0.1:3310", "unix:///var/run/clamav/clamd.ctl"} {
+		if _, err := newClamdScanner(address, time.Second); err != nil {
+			t.Errorf("address %q rejected: %v", address, err)
+		}
+	}
+}